@@ -0,0 +1,210 @@
+package cache
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+var ErrNotAdmitted = errors.New("object not admitted")
+
+const (
+	DefaultAdmissionMinCount = 2    // Lookups after which a FrequencyFilter admits an object by default
+	DefaultAdmissionWidth    = 1024 // Counters per row of the sketch of a FrequencyFilter by default
+)
+
+/*
+AdmissionFilter decides which objects an AdmissionCache stores. Record is called for every lookup
+of a key, hit or miss, so filters can learn which keys are requested. Admit is called before an
+object is stored, size is the size of its body, or -1 if it is not known yet. Filters are used
+concurrently.
+*/
+type AdmissionFilter interface {
+	Record(key string)
+	Admit(meta *Object, size int64) bool
+}
+
+// sizeLimit is implemented by filters that reject bodies larger than a limit
+type sizeLimit interface {
+	// maxSize returns the largest body of the object that is admitted, 0 means no limit
+	maxSize(meta *Object) int64
+}
+
+// filterMaxSize returns the largest body of the object the filter admits, 0 means no limit
+func filterMaxSize(filter AdmissionFilter, meta *Object) int64 {
+	if limit, ok := filter.(sizeLimit); ok {
+		return limit.maxSize(meta)
+	}
+	return 0
+}
+
+/*
+FrequencyFilter admits objects whose keys were looked up at least MinCount times recently. The
+lookups are counted in a frequency sketch, which only keeps counters for keys seen more than once,
+so objects requested once, like the objects of a scan, are not stored. The zero value is ready
+to use.
+*/
+type FrequencyFilter struct {
+	MinCount int // Lookups after which an object is admitted, 0 means DefaultAdmissionMinCount
+	Width    int // Counters per row of the sketch, read on first use, 0 means DefaultAdmissionWidth
+
+	sketch *frequencySketch
+	lock   sync.Mutex
+}
+
+/*
+NewFrequencyFilter creates a filter that counts lookups in a sketch with width counters per row.
+The width should be about the number of objects the cache holds.
+*/
+func NewFrequencyFilter(width int) *FrequencyFilter {
+	return &FrequencyFilter{MinCount: DefaultAdmissionMinCount, Width: width}
+}
+
+func (f *FrequencyFilter) Record(key string) {
+	f.lock.Lock()
+	f.sketchLocked().increment(key)
+	f.lock.Unlock()
+}
+
+func (f *FrequencyFilter) Admit(meta *Object, size int64) bool {
+	minCount := f.MinCount
+	if minCount <= 0 {
+		minCount = DefaultAdmissionMinCount
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.sketchLocked().estimate(meta.Key) >= minCount
+}
+
+// sketchLocked returns the sketch, which is created on first use, the lock must be held
+func (f *FrequencyFilter) sketchLocked() *frequencySketch {
+	if f.sketch == nil {
+		width := f.Width
+		if width <= 0 {
+			width = DefaultAdmissionWidth
+		}
+		f.sketch = newFrequencySketch(width)
+	}
+	return f.sketch
+}
+
+/*
+SizeFilter admits objects whose body is at least MinSize and at most MaxSize bytes, 0 means no
+limit. Objects of unknown size are admitted, an AdmissionCache stops storing their body and
+rejects them once it exceeds MaxSize.
+*/
+type SizeFilter struct {
+	MinSize int64
+	MaxSize int64
+}
+
+func (f *SizeFilter) Record(key string) {}
+
+func (f *SizeFilter) Admit(meta *Object, size int64) bool {
+	if size < 0 {
+		return true
+	}
+	return size >= f.MinSize && (f.MaxSize <= 0 || size <= f.MaxSize)
+}
+
+func (f *SizeFilter) maxSize(meta *Object) int64 {
+	return max(f.MaxSize, 0)
+}
+
+// ProbabilisticFilter admits objects at random with the given probability between 0 and 1
+type ProbabilisticFilter struct {
+	Probability float64
+
+	random func() float64 // Source of the draws, nil means rand.Float64
+}
+
+func NewProbabilisticFilter(probability float64) *ProbabilisticFilter {
+	return &ProbabilisticFilter{Probability: probability, random: rand.Float64}
+}
+
+func (f *ProbabilisticFilter) Record(key string) {}
+
+func (f *ProbabilisticFilter) Admit(meta *Object, size int64) bool {
+	random := f.random
+	if random == nil {
+		random = rand.Float64
+	}
+	return random() < f.Probability
+}
+
+/*
+BucketFilter applies the filter of the bucket of an object, keys have the form host/bucket/object.
+Objects of buckets without a rule are passed to Default. A nil filter admits all objects.
+*/
+type BucketFilter struct {
+	Rules   map[string]AdmissionFilter
+	Default AdmissionFilter
+}
+
+func (f *BucketFilter) Record(key string) {
+	if filter := f.filter(key); filter != nil {
+		filter.Record(key)
+	}
+}
+
+func (f *BucketFilter) Admit(meta *Object, size int64) bool {
+	filter := f.filter(meta.Key)
+	return filter == nil || filter.Admit(meta, size)
+}
+
+func (f *BucketFilter) maxSize(meta *Object) int64 {
+	filter := f.filter(meta.Key)
+	if filter == nil {
+		return 0
+	}
+	return filterMaxSize(filter, meta)
+}
+
+func (f *BucketFilter) filter(key string) AdmissionFilter {
+	if filter, exists := f.Rules[keyBucket(key)]; exists {
+		return filter
+	}
+	return f.Default
+}
+
+// AllFilters combines filters into a filter that only admits objects admitted by all of them
+func AllFilters(filters ...AdmissionFilter) AdmissionFilter {
+	return allFilters(filters)
+}
+
+type allFilters []AdmissionFilter
+
+func (f allFilters) Record(key string) {
+	for _, filter := range f {
+		filter.Record(key)
+	}
+}
+
+func (f allFilters) Admit(meta *Object, size int64) bool {
+	for _, filter := range f {
+		if !filter.Admit(meta, size) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f allFilters) maxSize(meta *Object) int64 {
+	var limit int64
+	for _, filter := range f {
+		if l := filterMaxSize(filter, meta); l > 0 && (limit == 0 || l < limit) {
+			limit = l
+		}
+	}
+	return limit
+}
+
+// keyBucket returns the bucket of a key of the form host/bucket/object, or an empty string
+func keyBucket(key string) string {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[1]
+}
@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+/*
+AdmissionCache decides with an AdmissionFilter which objects are stored in the backend, so objects
+that are unlikely to be requested again do not evict the objects that are. Lookups are recorded
+with the filter. Objects fetched by an initializer are returned whether they are admitted or not,
+Put and PutStream return ErrNotAdmitted for rejected objects and store nothing.
+*/
+type AdmissionCache struct {
+	backend Cache
+	filter  AdmissionFilter
+	logger  *log.Logger
+	flights FlightGroup
+
+	admitted atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// AdmissionStats counts the decisions of an AdmissionCache
+type AdmissionStats struct {
+	Admitted uint64
+	Rejected uint64
+}
+
+/*
+NewAdmissionCache creates a cache that only stores the objects admitted by the filter in the backend.
+*/
+func NewAdmissionCache(logger *log.Logger, backend Cache, filter AdmissionFilter) *AdmissionCache {
+	return &AdmissionCache{
+		backend: backend,
+		filter:  filter,
+		logger:  logger,
+	}
+}
+
+func (ac *AdmissionCache) Get(key string, initializer Initializer) (*Object, error) {
+	return ac.GetContext(context.Background(), key, withoutContext(initializer))
+}
+
+func (ac *AdmissionCache) GetContext(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+	ac.filter.Record(key)
+	obj, err := ac.get(ctx, key)
+	if err == ErrCacheMiss {
+		return ac.initialize(ctx, key, initializer)
+	}
+	return obj, err
+}
+
+func (ac *AdmissionCache) GetTimed(key string, initializer Initializer) (*Object, int64, int64, error) {
+	ac.filter.Record(key)
+	start := time.Now()
+	obj, err := ac.get(context.Background(), key)
+	elapsed := time.Since(start).Nanoseconds()
+
+	if err == ErrCacheMiss {
+		start := time.Now()
+		obj, err := ac.initialize(context.Background(), key, withoutContext(initializer))
+		initElapsed := time.Since(start).Nanoseconds()
+		return obj, elapsed, initElapsed, err
+	}
+	return obj, elapsed, 0, err
+}
+
+func (ac *AdmissionCache) Put(o *Object) error {
+	return ac.PutContext(context.Background(), o)
+}
+
+func (ac *AdmissionCache) PutContext(ctx context.Context, o *Object) error {
+	if o == nil {
+		return ErrObjectNil
+	}
+	if !ac.admit(o, bodySize(o)) {
+		return ErrNotAdmitted
+	}
+	return ac.backend.PutContext(ctx, o)
+}
+
+func (ac *AdmissionCache) Delete(key string) error {
+	return ac.DeleteContext(context.Background(), key)
+}
+
+func (ac *AdmissionCache) DeleteContext(ctx context.Context, key string) error {
+	return ac.backend.DeleteContext(ctx, key)
+}
+
+func (ac *AdmissionCache) GetStream(ctx context.Context, key string) (io.ReadSeekCloser, *Object, error) {
+	ac.filter.Record(key)
+	return getTierStream(ctx, ac.backend, key)
+}
+
+/*
+PutStream stores an object with the body read from r if it is admitted. Rejected objects are
+rejected before their body is read. Bodies of unknown size that exceed the size limit of the
+filter are rejected while they are read, and the put fails with ErrNotAdmitted.
+*/
+func (ac *AdmissionCache) PutStream(ctx context.Context, meta *Object, r io.Reader, size int64) error {
+	if !ac.admit(meta, size) {
+		return ErrNotAdmitted
+	}
+	limit := filterMaxSize(ac.filter, meta)
+	if size >= 0 || limit <= 0 {
+		return putTierStream(ctx, ac.backend, meta, r, size)
+	}
+
+	body := &admissionLimitReader{r: r, remaining: limit}
+	err := putTierStream(ctx, ac.backend, meta, body, size)
+	if body.exceeded {
+		// The object was counted as admitted before its size was known
+		ac.admitted.Add(^uint64(0))
+		ac.rejected.Add(1)
+		return ErrNotAdmitted
+	}
+	return err
+}
+
+// Stats returns the number of admitted and rejected objects
+func (ac *AdmissionCache) Stats() AdmissionStats {
+	return AdmissionStats{
+		Admitted: ac.admitted.Load(),
+		Rejected: ac.rejected.Load(),
+	}
+}
+
+func (ac *AdmissionCache) get(ctx context.Context, key string) (*Object, error) {
+	obj, err := ac.backend.GetContext(ctx, key, nil)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, ErrCacheMiss
+	}
+	return obj, nil
+}
+
+func (ac *AdmissionCache) initialize(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+
+	lookup := func(ctx context.Context) (*Object, error) {
+		return ac.get(ctx, key)
+	}
+	return initializeWith(ctx, &ac.flights, key, lookup, ac.PutContext, ac.logger, initializer)
+}
+
+func (ac *AdmissionCache) admit(meta *Object, size int64) bool {
+	if !ac.filter.Admit(meta, size) {
+		ac.rejected.Add(1)
+		return false
+	}
+	ac.admitted.Add(1)
+	return true
+}
+
+// admissionLimitReader fails with ErrNotAdmitted once the body exceeds the limit
+type admissionLimitReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (lr *admissionLimitReader) Read(p []byte) (int, error) {
+	if lr.exceeded {
+		return 0, ErrNotAdmitted
+	}
+	n, err := lr.r.Read(p)
+	lr.remaining -= int64(n)
+	if lr.remaining < 0 {
+		lr.exceeded = true
+		return 0, ErrNotAdmitted
+	}
+	return n, err
+}
+
+// bodySize returns the size of the body of an object held in memory, or -1 if it has none
+func bodySize(o *Object) int64 {
+	if o.Data == nil {
+		return -1
+	}
+	return int64(len(*o.Data))
+}
@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestAdmissionFilters(t *testing.T) {
+	obj := func(key string) *Object {
+		return &Object{Key: key}
+	}
+
+	// Test case: Size thresholds admit objects of unknown size
+	size := &SizeFilter{MinSize: 10, MaxSize: 100}
+	for s, expected := range map[int64]bool{-1: true, 0: false, 10: true, 100: true, 101: false} {
+		if admitted := size.Admit(obj("localhost/testBucket/key"), s); admitted != expected {
+			t.Errorf("Expected admission of %d bytes %v, but got %v", s, expected, admitted)
+		}
+	}
+
+	// Test case: Objects are admitted with the configured probability
+	random := NewProbabilisticFilter(0.25)
+	draws := []float64{0.1, 0.3, 0.2, 0.9}
+	random.random = func() float64 {
+		d := draws[0]
+		draws = draws[1:]
+		return d
+	}
+	admitted := 0
+	for i := 0; i < 4; i++ {
+		if random.Admit(obj("localhost/testBucket/key"), 1) {
+			admitted++
+		}
+	}
+	if admitted != 2 {
+		t.Errorf("Expected 2 of 4 objects admitted, but got %d", admitted)
+	}
+
+	// Test case: Objects are admitted once their key was looked up MinCount times
+	frequency := NewFrequencyFilter(1024)
+	key := "localhost/testBucket/popular"
+	for i := 1; i <= 3; i++ {
+		frequency.Record(key)
+		if admitted := frequency.Admit(obj(key), 1); admitted != (i >= DefaultAdmissionMinCount) {
+			t.Errorf("Expected admission after %d lookups %v, but got %v", i, i >= DefaultAdmissionMinCount, admitted)
+		}
+	}
+
+	// Test case: Filters built as struct literals use the defaults
+	zero := &FrequencyFilter{}
+	for i := 1; i <= 3; i++ {
+		zero.Record(key)
+		if admitted := zero.Admit(obj(key), 1); admitted != (i >= DefaultAdmissionMinCount) {
+			t.Errorf("Expected admission after %d lookups %v, but got %v", i, i >= DefaultAdmissionMinCount, admitted)
+		}
+	}
+	if (&ProbabilisticFilter{Probability: 0}).Admit(obj(key), 1) || !(&ProbabilisticFilter{Probability: 1}).Admit(obj(key), 1) {
+		t.Errorf("Expected the probabilities 0 and 1 to reject and admit all objects")
+	}
+
+	// Test case: The rule of the bucket of an object applies, objects of other buckets use the default
+	buckets := &BucketFilter{
+		Rules: map[string]AdmissionFilter{
+			"logs":   &SizeFilter{MaxSize: 1},
+			"static": nil,
+		},
+		Default: AllFilters(&SizeFilter{MaxSize: 100}, NewProbabilisticFilter(1)),
+	}
+	for _, test := range []struct {
+		key      string
+		size     int64
+		admitted bool
+		maxSize  int64
+	}{
+		{"localhost/logs/2024.log", 10, false, 1},
+		{"localhost/static/video.mp4", 1 << 30, true, 0},
+		{"localhost/testBucket/key", 10, true, 100},
+		{"localhost/testBucket/key", 1000, false, 100},
+	} {
+		if admitted := buckets.Admit(obj(test.key), test.size); admitted != test.admitted {
+			t.Errorf("%s: Expected admission of %d bytes %v, but got %v", test.key, test.size, test.admitted, admitted)
+		}
+		// Bodies of unknown size are limited to the size limit of the rule
+		if maxSize := filterMaxSize(buckets, obj(test.key)); maxSize != test.maxSize {
+			t.Errorf("%s: Expected size limit %d, but got %d", test.key, test.maxSize, maxSize)
+		}
+	}
+}
+
+func TestAdmissionCache(t *testing.T) {
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	backend := NewDummyPrinterCache(logger, 1<<20)
+	ac := NewAdmissionCache(logger, backend, AllFilters(&SizeFilter{MaxSize: 100}, NewFrequencyFilter(1024)))
+
+	initializer := func(key string) Initializer {
+		return func() (*Object, error) {
+			data := []byte("testData")
+			return &Object{Key: key, Data: &data}, nil
+		}
+	}
+
+	// Test case: Objects requested once are returned but not stored
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("localhost/testBucket/scan%02d", i)
+		if obj, err := ac.Get(key, initializer(key)); err != nil || string(*obj.Data) != "testData" {
+			t.Fatalf("Expected object with data 'testData', but got %v", err)
+		}
+		if _, exists := backend.get(key); exists {
+			t.Errorf("%s: Expected object requested once not to be stored", key)
+		}
+	}
+
+	// Test case: Objects requested again are stored
+	key := "localhost/testBucket/hot"
+	ac.Get(key, initializer(key))
+	ac.Get(key, initializer(key))
+	if _, exists := backend.get(key); !exists {
+		t.Errorf("Expected object requested twice to be stored")
+	}
+	if stats := ac.Stats(); stats.Admitted != 1 || stats.Rejected != 21 {
+		t.Errorf("Expected 1 admitted and 21 rejected objects, but got %+v", stats)
+	}
+
+	// Test case: Rejected objects are not stored and their body is not read
+	large := "localhost/testBucket/large"
+	ac.Get(large, nil)
+	ac.Get(large, nil)
+	if err := ac.PutStream(context.Background(), &Object{Key: large}, failingReader{}, 1000); err != ErrNotAdmitted {
+		t.Errorf("Expected %v, but got %v", ErrNotAdmitted, err)
+	}
+	if err := ac.PutStream(context.Background(), &Object{Key: large}, strings.NewReader("small"), 5); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	// Test case: Bodies of unknown size are rejected once they exceed the size limit
+	unknown := "localhost/testBucket/unknown"
+	ac.Get(unknown, nil)
+	ac.Get(unknown, nil)
+	stats := ac.Stats()
+	if err := ac.PutStream(context.Background(), &Object{Key: unknown}, strings.NewReader(strings.Repeat("x", 101)), -1); err != ErrNotAdmitted {
+		t.Errorf("Expected %v, but got %v", ErrNotAdmitted, err)
+	}
+	if _, exists := backend.get(unknown); exists {
+		t.Errorf("Expected object larger than the limit not to be stored")
+	}
+	if after := ac.Stats(); after.Admitted != stats.Admitted || after.Rejected != stats.Rejected+1 {
+		t.Errorf("Expected 1 more rejected object, but got %+v after %+v", after, stats)
+	}
+	if err := ac.PutStream(context.Background(), &Object{Key: unknown}, strings.NewReader(strings.Repeat("x", 100)), -1); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+
+	// Test case: Rejections by a tier are not failed writes
+	tc := NewTieredCache(logger, Tier{"memory", NewAdmissionCache(logger, NewDummyPrinterCache(logger, 1<<20), &SizeFilter{MaxSize: 1})})
+	tc.Put(&Object{Key: key, Data: &[]byte{'a', 'b'}})
+	if stats := tc.Stats(); stats.Tiers[0].Failures != 0 {
+		t.Errorf("Expected no failed writes, but got %d", stats.Tiers[0].Failures)
+	}
+}
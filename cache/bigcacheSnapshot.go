@@ -0,0 +1,253 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+var ErrSnapshotCorrupted = errors.New("snapshot is corrupted")
+
+const (
+	snapshotMagic   = "BCSN"
+	snapshotVersion = 1
+)
+
+/*
+SaveSnapshot writes all entries of the cache to the file at path, replacing an earlier snapshot
+atomically. Entries are read while the cache keeps serving, so entries changed during the
+snapshot may be missing or saved in their earlier state. It returns the number of saved entries.
+
+The snapshot is written as follows, all integers are big endian:
+
+	magic "BCSN" | version uint8 | created at int64 (Unix nanoseconds)
+	entries, each: key length uint32 | key | value length uint32 | value | CRC-32C of key and value uint32
+	end: uint32 0 | entry count uint64 | CRC-32C of everything before it uint32
+
+The values are the encoded objects as bigcache stores them. Entries with an empty key are not
+saved, as their key length marks the end of the entries.
+*/
+func (bw *BigcacheWrapper) SaveSnapshot(path string) (int, error) {
+	bw.snapshotLock.Lock()
+	defer bw.snapshotLock.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"-*")
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := bw.writeSnapshot(temp)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return 0, fmt.Errorf("failed to save snapshot: %w", err)
+	}
+	return count, nil
+}
+
+/*
+LoadSnapshot adds the entries of the snapshot at path to the cache and returns their number. The
+snapshot is checked completely before any entry is added, a snapshot that is damaged, incomplete
+or of another version is skipped with a warning and returns ErrSnapshotCorrupted. A missing
+snapshot is not an error. Expired objects and objects in another format are not restored.
+*/
+func (bw *BigcacheWrapper) LoadSnapshot(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if err := readSnapshot(f, nil); err != nil {
+		bw.logger.Printf("Warning: skipping snapshot %s: %v", path, err)
+		return 0, fmt.Errorf("%w: %w", ErrSnapshotCorrupted, err)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	now := bw.Clock.now()
+	restored := 0
+	err = readSnapshot(f, func(key string, value []byte) error {
+		o, err := decodeObject(value)
+		if err != nil || o.IsExpired(now) {
+			return nil
+		}
+		if err := bw.bc.Set(key, value); err != nil {
+			return err
+		}
+		restored++
+		return nil
+	})
+	return restored, err
+}
+
+func (bw *BigcacheWrapper) writeSnapshot(f io.Writer) (int, error) {
+	checksum := crc32.New(castagnoli)
+	w := bufio.NewWriter(io.MultiWriter(f, checksum))
+
+	header := append([]byte(snapshotMagic), snapshotVersion)
+	header = binary.BigEndian.AppendUint64(header, uint64(bw.Clock.now().UnixNano()))
+	w.Write(header)
+
+	count := 0
+	it := bw.bc.Iterator()
+	for it.SetNext() {
+		entry, err := it.Value()
+		if err != nil {
+			// Removed while the snapshot is written
+			continue
+		}
+		key, value := entry.Key(), entry.Value()
+		if key == "" {
+			// An empty key would be read as the end of the entries
+			continue
+		}
+		record := binary.BigEndian.AppendUint32(make([]byte, 0, 12+len(key)+len(value)), uint32(len(key)))
+		record = append(record, key...)
+		record = binary.BigEndian.AppendUint32(record, uint32(len(value)))
+		record = append(record, value...)
+		record = binary.BigEndian.AppendUint32(record, entryChecksum(key, value))
+		if _, err := w.Write(record); err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	end := binary.BigEndian.AppendUint32(nil, 0)
+	end = binary.BigEndian.AppendUint64(end, uint64(count))
+	w.Write(end)
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	_, err := f.Write(binary.BigEndian.AppendUint32(nil, checksum.Sum32()))
+	return count, err
+}
+
+/*
+readSnapshot reads a snapshot and passes its entries to add, which may be nil to only check the
+snapshot. The checksum of the whole snapshot is only known at its end, so entries are passed to
+add before the snapshot is known to be intact.
+*/
+func readSnapshot(f io.Reader, add func(key string, value []byte) error) error {
+	r := &snapshotReader{r: bufio.NewReader(f), checksum: crc32.New(castagnoli)}
+
+	header := r.bytes(len(snapshotMagic) + 1 + 8)
+	if r.err != nil {
+		return r.err
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return ErrObjectFormat
+	}
+	if header[len(snapshotMagic)] != snapshotVersion {
+		return ErrObjectVersion
+	}
+
+	var count uint64
+	for {
+		keyLength := r.uint32()
+		if r.err != nil {
+			return r.err
+		}
+		if keyLength == 0 {
+			break
+		}
+		key := string(r.bytes(int(keyLength)))
+		value := r.bytes(int(r.uint32()))
+		checksum := r.uint32()
+		if r.err != nil {
+			return r.err
+		}
+		if entryChecksum(key, value) != checksum {
+			return fmt.Errorf("entry %s: %w", key, ErrChecksumMismatch)
+		}
+		if add != nil {
+			if err := add(key, value); err != nil {
+				return err
+			}
+		}
+		count++
+	}
+
+	if saved := r.uint64(); r.err == nil && saved != count {
+		return fmt.Errorf("expected %d entries, but found %d", saved, count)
+	}
+	expected := r.checksum.Sum32()
+	r.checksum = nil
+	if saved := r.uint32(); r.err == nil && saved != expected {
+		return ErrChecksumMismatch
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if _, err := r.r.ReadByte(); err != io.EOF {
+		return ErrObjectFormat
+	}
+	return nil
+}
+
+// entryChecksum returns the CRC-32C of the key and the value of an entry
+func entryChecksum(key string, value []byte) uint32 {
+	return crc32.Update(crc32.Checksum([]byte(key), castagnoli), castagnoli, value)
+}
+
+// snapshotReader reads the fields of a snapshot and updates its checksum, after the first error all reads return zero values
+type snapshotReader struct {
+	r        *bufio.Reader
+	checksum hash.Hash32
+	err      error
+}
+
+func (sr *snapshotReader) bytes(n int) []byte {
+	if sr.err != nil {
+		return nil
+	}
+	// Read without allocating n bytes up front, a damaged length must not exhaust the memory
+	b, err := io.ReadAll(io.LimitReader(sr.r, int64(n)))
+	if err == nil && len(b) < n {
+		err = ErrObjectTruncated
+	}
+	if err != nil {
+		sr.err = err
+		return nil
+	}
+	if sr.checksum != nil {
+		sr.checksum.Write(b)
+	}
+	return b
+}
+
+func (sr *snapshotReader) uint32() uint32 {
+	if b := sr.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (sr *snapshotReader) uint64() uint64 {
+	if b := sr.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
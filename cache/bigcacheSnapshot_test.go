@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBigcacheWrapper_Snapshot(t *testing.T) {
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	path := filepath.Join(t.TempDir(), "snapshots", "memory.snapshot")
+
+	bw := NewBigcacheWrapper(logger, 1000)
+	for i := 0; i < 100; i++ {
+		data := []byte(fmt.Sprintf("data%d", i))
+		bw.Put(&Object{Key: fmt.Sprintf("localhost/testBucket/key%d", i), Data: &data, OriginalHeaders: map[string][]string{"Etag": {"\"1\""}}})
+	}
+	data := []byte("expiring")
+	bw.Put(&Object{Key: "localhost/testBucket/expiring", Data: &data, ExpiresAt: clock.now.Add(time.Minute)})
+	// Not saved, its key length would end the entries of the snapshot
+	empty := []byte("empty")
+	if err := bw.Put(&Object{Key: "", Data: &empty}); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	// Test case: A missing snapshot restores nothing
+	restored := NewBigcacheWrapper(logger, 1000)
+	if n, err := restored.LoadSnapshot(path); err != nil || n != 0 {
+		t.Errorf("Expected no entries and no error, but got %d, %v", n, err)
+	}
+
+	// Test case: All entries are restored, except for expired objects
+	if n, err := bw.SaveSnapshot(path); err != nil || n != 101 {
+		t.Fatalf("Expected 101 saved entries, but got %d, %v", n, err)
+	}
+	restored.Clock = func() time.Time { return clock.now.Add(time.Hour) }
+	if n, err := restored.LoadSnapshot(path); err != nil || n != 100 {
+		t.Fatalf("Expected 100 restored entries, but got %d, %v", n, err)
+	}
+	for i := 0; i < 100; i++ {
+		obj, err := restored.Get(fmt.Sprintf("localhost/testBucket/key%d", i), nil)
+		if err != nil || string(*obj.Data) != fmt.Sprintf("data%d", i) || obj.OriginalHeaders["Etag"][0] != "\"1\"" {
+			t.Fatalf("Expected the restored object key%d, but got %v", i, err)
+		}
+	}
+
+	// Test case: Damaged snapshots are skipped as a whole
+	snapshot, _ := os.ReadFile(path)
+	flipped := bytes.Clone(snapshot)
+	flipped[len(flipped)/2] ^= 0xff
+	future := bytes.Clone(snapshot)
+	future[len(snapshotMagic)] = snapshotVersion + 1
+	for name, damaged := range map[string][]byte{
+		"flipped":   flipped,
+		"truncated": snapshot[:len(snapshot)-100],
+		"trailer":   snapshot[:len(snapshot)-1],
+		"version":   future,
+		"empty":     {},
+	} {
+		os.WriteFile(path, damaged, 0o644)
+		empty := NewBigcacheWrapper(logger, 1000)
+		if n, err := empty.LoadSnapshot(path); !errors.Is(err, ErrSnapshotCorrupted) || n != 0 {
+			t.Errorf("%s: Expected %v, but got %d entries and %v", name, ErrSnapshotCorrupted, n, err)
+		}
+		if entries := empty.bc.Len(); entries != 0 {
+			t.Errorf("%s: Expected no restored entries, but got %d", name, entries)
+		}
+	}
+
+	// Test case: Temporary files are not left behind
+	if files, _ := os.ReadDir(filepath.Dir(path)); len(files) != 1 {
+		t.Errorf("Expected only the snapshot file, but found %d files", len(files))
+	}
+}
@@ -1,10 +1,10 @@
 package cache
 
 import (
-	"bytes"
 	"context"
-	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"sync"
@@ -23,10 +23,19 @@ type StatsLog struct {
 	sync.Mutex
 }
 
+/*
+BigcacheWrapper stores objects in bigcache. Entries leave bigcache after its LifeWindow at the
+latest, objects with an earlier expiry are removed when they are looked up after it.
+*/
 type BigcacheWrapper struct {
-	bc     *bigcache.BigCache
-	logger *log.Logger
-	stats  StatsLog
+	Clock Clock // Time against which the expiry of objects is checked
+
+	bc      *bigcache.BigCache
+	logger  *log.Logger
+	stats   StatsLog
+	flights FlightGroup
+
+	snapshotLock sync.Mutex // Serializes snapshots, which iterate over the whole cache
 }
 
 /*
@@ -70,12 +79,19 @@ func NewBigcacheWrapper(logger *log.Logger, maxMemory int) *BigcacheWrapper {
 }
 
 func (bw *BigcacheWrapper) Get(key string, initializer Initializer) (*Object, error) {
+	return bw.GetContext(context.Background(), key, withoutContext(initializer))
+}
+
+func (bw *BigcacheWrapper) GetContext(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	data, err := bw.get(key)
 
 	if err != nil {
 		//object not found
 
-		return bw.initialize(key, initializer)
+		return bw.initialize(ctx, key, initializer)
 	}
 	return data, nil
 }
@@ -88,7 +104,7 @@ func (bw *BigcacheWrapper) GetTimed(key string, initializer Initializer) (*Objec
 	if err != nil {
 		//object not found
 		start := time.Now()
-		obj, err := bw.initialize(key, initializer)
+		obj, err := bw.initialize(context.Background(), key, withoutContext(initializer))
 		initElapsed := time.Since(start).Nanoseconds()
 		return obj, elapsed, initElapsed, err
 	}
@@ -99,25 +115,68 @@ func (bw *BigcacheWrapper) Put(o *Object) error {
 	return bw.put(o)
 }
 
-func (bw *BigcacheWrapper) initialize(key string, initializer Initializer) (*Object, error) {
+func (bw *BigcacheWrapper) PutContext(ctx context.Context, o *Object) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return bw.put(o)
+}
 
-	if initializer == nil {
-		return nil, ErrInitializerNil
+/*
+Delete removes the object from the cache. ErrCacheMiss is returned if the object is not cached.
+*/
+func (bw *BigcacheWrapper) Delete(key string) error {
+	return bw.DeleteContext(context.Background(), key)
+}
+
+func (bw *BigcacheWrapper) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
+	err := bw.bc.Delete(key)
+	if err == bigcache.ErrEntryNotFound {
+		return ErrCacheMiss
+	}
+	return err
+}
 
-	// double check if the object was not initialized by another goroutine
-	obj, err := bw.get(key)
+func (bw *BigcacheWrapper) GetStream(ctx context.Context, key string) (io.ReadSeekCloser, *Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	o, err := bw.get(key)
+	// Entries that cannot be decoded, for example written by an earlier version, are misses
+	if err == bigcache.ErrEntryNotFound || errors.Is(err, ErrDeserialization) {
+		return nil, nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	body, meta := newStreamedObject(o)
+	return body, meta, nil
+}
 
+/*
+PutStream stores an object with the body read from r. Bigcache keeps entries in memory, so the
+body is read completely before the object is stored.
+*/
+func (bw *BigcacheWrapper) PutStream(ctx context.Context, meta *Object, r io.Reader, size int64) error {
+	o, err := readStreamedObject(meta, r, size)
 	if err != nil {
-		obj, err := initializer()
-		if err != nil {
-			return nil, err
-		}
-		go bw.put(obj)
-		return obj, nil
+		return err
 	}
+	return bw.PutContext(ctx, o)
+}
+
+func (bw *BigcacheWrapper) initialize(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
 
-	return obj, nil
+	lookup := func(ctx context.Context) (*Object, error) {
+		return bw.get(key)
+	}
+	put := func(ctx context.Context, obj *Object) error {
+		return bw.put(obj)
+	}
+	return initializeWith(ctx, &bw.flights, key, lookup, put, bw.logger, initializer)
 }
 
 func (bw *BigcacheWrapper) put(o *Object) error {
@@ -140,7 +199,11 @@ func (bw *BigcacheWrapper) get(key string) (*Object, error) {
 
 	o, err := bw.deserializeObj(data)
 	if err != nil {
-		return nil, fmt.Errorf("%v: %w", ErrDeserialization, err)
+		return nil, fmt.Errorf("%w: %w", ErrDeserialization, err)
+	}
+	if o.IsExpired(bw.Clock.now()) {
+		bw.bc.Delete(key)
+		return nil, bigcache.ErrEntryNotFound
 	}
 
 	return &o, nil
@@ -151,26 +214,16 @@ func (bw *BigcacheWrapper) GetStats() *StatsLog {
 }
 
 func (bw *BigcacheWrapper) serializeObj(o Object) ([]byte, error) {
-	b := bytes.Buffer{}
-	e := gob.NewEncoder(&b)
-	err := e.Encode(o)
-	if err != nil {
-		return nil, err
-	}
-	return b.Bytes(), nil
-
+	return encodeObject(&o), nil
 }
 
+// deserializeObj returns ErrObjectFormat for entries written in another format, which are treated as misses
 func (bw *BigcacheWrapper) deserializeObj(serialized []byte) (Object, error) {
-	o := Object{}
-	b := bytes.Buffer{}
-	b.Write(serialized)
-	d := gob.NewDecoder(&b)
-	err := d.Decode(&o)
+	o, err := decodeObject(serialized)
 	if err != nil {
 		return Object{}, err
 	}
-	return o, nil
+	return *o, nil
 }
 
 func (bw *BigcacheWrapper) SaveStats() {
@@ -1,7 +1,9 @@
 package cache
 
 import (
+	"context"
 	"errors"
+	"time"
 )
 
 var (
@@ -19,12 +21,67 @@ type Object struct {
 	Key             string
 	Data            *[]byte
 	OriginalHeaders map[string][]string
+	StoredAt        time.Time      // Time the object was retrieved from or last revalidated with the origin
+	MaxAge          time.Duration  // Freshness lifetime of the object, 0 means the object never becomes stale
+	StatusCode      int            // HTTP status of a cached error response (negative entry), 0 for objects
+	Chunks          *ChunkManifest // Set on the manifest entry of an object stored in chunks, see ChunkedCache
+	Codec           string         // Name of the codec that compressed Data, empty if Data is not compressed, see CompressedCache
+	ExpiresAt       time.Time      // Time after which the backends drop the object, zero means the object does not expire
+}
+
+// IsStale reports whether the object has outlived its freshness lifetime and has to be revalidated
+func (o *Object) IsStale(now time.Time) bool {
+	return o.MaxAge > 0 && now.Sub(o.StoredAt) > o.MaxAge
+}
+
+// IsExpired reports whether the object has outlived its time to live and must not be served anymore
+func (o *Object) IsExpired(now time.Time) bool {
+	return !o.ExpiresAt.IsZero() && !now.Before(o.ExpiresAt)
+}
+
+/*
+Clock returns the current time. Backends that expire objects read the time from their Clock, so
+tests can control it. A nil Clock is the system clock.
+*/
+type Clock func() time.Time
+
+func (c Clock) now() time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c()
 }
 
 type Initializer func() (*Object, error)
 
+/*
+ContextInitializer is an Initializer that receives the context of the fill. The context is
+canceled once no caller waits for the object anymore.
+*/
+type ContextInitializer func(ctx context.Context) (*Object, error)
+
+/*
+Cache is implemented by all cache backends. The Context methods stop waiting for the backend
+and for fills when the context is done, and return the context error. The other methods are
+equivalent to the Context methods with context.Background().
+*/
 type Cache interface {
 	Get(key string, initializer Initializer) (*Object, error)
 	GetTimed(key string, initializer Initializer) (*Object, int64, int64, error)
 	Put(*Object) error
+	Delete(key string) error
+
+	GetContext(ctx context.Context, key string, initializer ContextInitializer) (*Object, error)
+	PutContext(ctx context.Context, o *Object) error
+	DeleteContext(ctx context.Context, key string) error
+}
+
+// withoutContext adapts an Initializer for the Context methods
+func withoutContext(initializer Initializer) ContextInitializer {
+	if initializer == nil {
+		return nil
+	}
+	return func(context.Context) (*Object, error) {
+		return initializer()
+	}
 }
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+// testClock is a Clock that only moves when the test advances it
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func TestObjectExpiry(t *testing.T) {
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+
+	memory := newTestMemoryCache(t, 1<<20, PolicyLRU)
+	memory.Clock = clock.Now
+	dummy := NewDummyPrinterCache(logger, 1<<20)
+	dummy.Clock = clock.Now
+	bigcache := NewBigcacheWrapper(logger, 1000)
+	bigcache.Clock = clock.Now
+	disk := newTestDiskCache(t, t.TempDir(), 1<<20)
+	disk.Clock = clock.Now
+	t.Cleanup(func() { disk.Close() })
+
+	for name, c := range map[string]StreamCache{
+		"memory":   memory,
+		"dummy":    dummy,
+		"bigcache": bigcache,
+		"disk":     disk,
+	} {
+		start := clock.now
+		data := []byte("testData")
+		expiring := &Object{Key: "localhost/testBucket/expiring", Data: &data, ExpiresAt: start.Add(time.Minute)}
+		lasting := &Object{Key: "localhost/testBucket/lasting", Data: &data}
+		for _, o := range []*Object{expiring, lasting} {
+			if err := c.Put(o); err != nil {
+				t.Fatalf("%s: Expected no error, but got %v", name, err)
+			}
+		}
+
+		// Test case: Objects are served until they expire
+		clock.now = start.Add(time.Minute - time.Second)
+		if obj, err := c.Get(expiring.Key, nil); err != nil || !obj.ExpiresAt.Equal(expiring.ExpiresAt) {
+			t.Errorf("%s: Expected the object with its expiry, but got %v", name, err)
+		}
+
+		// Test case: Expired objects are misses, objects without expiry are kept
+		clock.now = start.Add(time.Minute)
+		if _, err := c.Get(expiring.Key, nil); err == nil {
+			t.Errorf("%s: Expected the expired object to be a miss", name)
+		}
+		if _, _, err := c.GetStream(context.Background(), expiring.Key); err != ErrCacheMiss {
+			t.Errorf("%s: Expected %v, but got %v", name, ErrCacheMiss, err)
+		}
+		if _, err := c.Get(lasting.Key, nil); err != nil {
+			t.Errorf("%s: Expected the object without expiry, but got %v", name, err)
+		}
+	}
+
+	if stats := memory.Stats(); stats.Evictions[EvictionExpired] != 1 {
+		t.Errorf("Expected 1 expired object, but got %v", stats.Evictions)
+	}
+	if stats := disk.Stats(); stats.Expired != 1 || stats.Entries != 1 {
+		t.Errorf("Expected 1 expired object and 1 entry, but got %+v", stats)
+	}
+}
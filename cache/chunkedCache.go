@@ -0,0 +1,298 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"time"
+)
+
+/*
+DefaultChunkSize fits into a bigcache shard of the BigcacheWrapper and into the default 1 MB
+item limit of memcached, with room for the metadata of the chunk.
+*/
+const DefaultChunkSize = 256 << 10
+
+// ChunkManifest lists the chunks of an object that is stored in parts
+type ChunkManifest struct {
+	Generation int64    // Distinguishes the chunks of successive writes of the same key
+	Size       int64    // Size of the whole body
+	ChunkSize  int      // Size of every chunk but the last
+	Checksums  []uint32 // CRC-32 (IEEE) of every chunk
+}
+
+/*
+ChunkedCache stores objects larger than a chunk in a backend with an entry size limit. The body of
+such an object is split into chunks of a fixed size, stored under keys derived from the object key,
+and a manifest entry with the metadata of the object and the checksums of the chunks is stored
+under the object key. Smaller objects are stored as they are.
+
+The manifest is written after all chunks, so a lookup never finds the manifest of an incomplete
+write. A chunk that was evicted, or that does not match its size or checksum, makes the object a
+miss. The chunks of an overwritten object are removed once the new object is stored, and the
+chunks of a write that fails are removed right away.
+*/
+type ChunkedCache struct {
+	backend   Cache
+	chunkSize int
+	logger    *log.Logger
+	flights   FlightGroup
+}
+
+/*
+NewChunkedCache creates a cache that stores objects larger than chunkSize in chunks in the backend.
+*/
+func NewChunkedCache(logger *log.Logger, backend Cache, chunkSize int) *ChunkedCache {
+	return &ChunkedCache{
+		backend:   backend,
+		chunkSize: chunkSize,
+		logger:    logger,
+	}
+}
+
+func (cc *ChunkedCache) Get(key string, initializer Initializer) (*Object, error) {
+	return cc.GetContext(context.Background(), key, withoutContext(initializer))
+}
+
+func (cc *ChunkedCache) GetContext(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+	obj, err := cc.get(ctx, key)
+	if err == ErrCacheMiss {
+		return cc.initialize(ctx, key, initializer)
+	}
+	return obj, err
+}
+
+func (cc *ChunkedCache) GetTimed(key string, initializer Initializer) (*Object, int64, int64, error) {
+	start := time.Now()
+	obj, err := cc.get(context.Background(), key)
+	elapsed := time.Since(start).Nanoseconds()
+
+	if err == ErrCacheMiss {
+		start := time.Now()
+		obj, err := cc.initialize(context.Background(), key, withoutContext(initializer))
+		initElapsed := time.Since(start).Nanoseconds()
+		return obj, elapsed, initElapsed, err
+	}
+	return obj, elapsed, 0, err
+}
+
+func (cc *ChunkedCache) Put(o *Object) error {
+	return cc.PutContext(context.Background(), o)
+}
+
+func (cc *ChunkedCache) PutContext(ctx context.Context, o *Object) error {
+	if o == nil {
+		return ErrObjectNil
+	}
+	return cc.replace(ctx, o.Key, func(manifest *ChunkManifest) error {
+		if o.Data == nil || len(*o.Data) <= cc.chunkSize {
+			return cc.backend.PutContext(ctx, o)
+		}
+
+		data := *o.Data
+		manifest.Size = int64(len(data))
+		for start := 0; start < len(data); start += cc.chunkSize {
+			chunk := data[start:min(start+cc.chunkSize, len(data))]
+			if err := cc.putChunk(ctx, o, manifest, chunk); err != nil {
+				return err
+			}
+		}
+		return cc.putManifest(ctx, o, manifest)
+	})
+}
+
+/*
+Delete removes the object and its chunks. ErrCacheMiss is returned if the object is not cached.
+*/
+func (cc *ChunkedCache) Delete(key string) error {
+	return cc.DeleteContext(context.Background(), key)
+}
+
+func (cc *ChunkedCache) DeleteContext(ctx context.Context, key string) error {
+	if manifest := cc.storedManifest(ctx, key); manifest != nil {
+		cc.deleteChunks(ctx, key, manifest)
+	}
+	return cc.backend.DeleteContext(ctx, key)
+}
+
+/*
+GetStream returns the body of the object. The chunks have to be checked before the body can be
+served, so the body of a chunked object is assembled in memory.
+*/
+func (cc *ChunkedCache) GetStream(ctx context.Context, key string) (io.ReadSeekCloser, *Object, error) {
+	obj, err := cc.get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, meta := newStreamedObject(obj)
+	return body, meta, nil
+}
+
+/*
+PutStream stores an object with the body read from r. Chunks are stored as they are read, so only
+one chunk of the body is held in memory.
+*/
+func (cc *ChunkedCache) PutStream(ctx context.Context, meta *Object, r io.Reader, size int64) error {
+	if size >= 0 {
+		// One byte more than expected is enough to detect a longer body
+		r = io.LimitReader(r, size+1)
+	}
+
+	return cc.replace(ctx, meta.Key, func(manifest *ChunkManifest) error {
+		for {
+			chunk := make([]byte, cc.chunkSize)
+			n, err := io.ReadFull(r, chunk)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return fmt.Errorf("failed to read object body: %w", err)
+			}
+			chunk = chunk[:n]
+			last := err != nil
+
+			// A body that fits into one chunk is stored as it is
+			if len(manifest.Checksums) == 0 && last {
+				if size >= 0 && int64(n) != size {
+					return fmt.Errorf("failed to read object body: %w", ErrSizeMismatch)
+				}
+				o := *meta
+				o.Data = &chunk
+				return cc.backend.PutContext(ctx, &o)
+			}
+
+			if n > 0 {
+				manifest.Size += int64(n)
+				if size >= 0 && manifest.Size > size {
+					return fmt.Errorf("failed to read object body: %w", ErrSizeMismatch)
+				}
+				if err := cc.putChunk(ctx, meta, manifest, chunk); err != nil {
+					return err
+				}
+			}
+			if last {
+				break
+			}
+		}
+		if size >= 0 && manifest.Size != size {
+			return fmt.Errorf("failed to read object body: %w", ErrSizeMismatch)
+		}
+		return cc.putManifest(ctx, meta, manifest)
+	})
+}
+
+/*
+replace runs a write of the object with a new manifest, which write fills with the chunks it stored.
+The chunks are removed again if the write fails. Once the write succeeded, the chunks of the object
+it replaced are removed.
+*/
+func (cc *ChunkedCache) replace(ctx context.Context, key string, write func(manifest *ChunkManifest) error) error {
+	replaced := cc.storedManifest(ctx, key)
+	manifest := &ChunkManifest{Generation: time.Now().UnixNano(), ChunkSize: cc.chunkSize}
+
+	// The chunks are removed even if the write failed because the context was canceled
+	if err := write(manifest); err != nil {
+		cc.deleteChunks(context.WithoutCancel(ctx), key, manifest)
+		return err
+	}
+	if replaced != nil && replaced.Generation != manifest.Generation {
+		cc.deleteChunks(context.WithoutCancel(ctx), key, replaced)
+	}
+	return nil
+}
+
+// storedManifest returns the manifest of the object stored under key, or nil if the object is not chunked
+func (cc *ChunkedCache) storedManifest(ctx context.Context, key string) *ChunkManifest {
+	if obj, err := cc.backend.GetContext(ctx, key, nil); err == nil {
+		return obj.Chunks
+	}
+	return nil
+}
+
+// get returns the object from the backend, assembled from its chunks if it is chunked
+func (cc *ChunkedCache) get(ctx context.Context, key string) (*Object, error) {
+	obj, err := cc.backend.GetContext(ctx, key, nil)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, ErrCacheMiss
+	}
+	if obj.Chunks == nil {
+		return obj, nil
+	}
+
+	manifest := obj.Chunks
+	data := make([]byte, 0, manifest.Size)
+	for i, checksum := range manifest.Checksums {
+		chunk, err := cc.backend.GetContext(ctx, chunkKey(key, manifest.Generation, i), nil)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			cc.discard(ctx, key, manifest, fmt.Sprintf("chunk %d is missing", i))
+			return nil, ErrCacheMiss
+		}
+		expected := min(int64(manifest.ChunkSize), manifest.Size-int64(len(data)))
+		if chunk.Data == nil || int64(len(*chunk.Data)) != expected || crc32.ChecksumIEEE(*chunk.Data) != checksum {
+			cc.discard(ctx, key, manifest, fmt.Sprintf("chunk %d is corrupted", i))
+			return nil, ErrCacheMiss
+		}
+		data = append(data, *chunk.Data...)
+	}
+	if int64(len(data)) != manifest.Size {
+		cc.discard(ctx, key, manifest, "chunks do not add up to the object size")
+		return nil, ErrCacheMiss
+	}
+
+	o := *obj
+	o.Data = &data
+	o.Chunks = nil
+	return &o, nil
+}
+
+func (cc *ChunkedCache) initialize(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+
+	lookup := func(ctx context.Context) (*Object, error) {
+		return cc.get(ctx, key)
+	}
+	return initializeWith(ctx, &cc.flights, key, lookup, cc.PutContext, cc.logger, initializer)
+}
+
+// putChunk stores the next chunk of an object, which expires with the object, and adds its checksum to the manifest
+func (cc *ChunkedCache) putChunk(ctx context.Context, meta *Object, manifest *ChunkManifest, chunk []byte) error {
+	i := len(manifest.Checksums)
+	err := cc.backend.PutContext(ctx, &Object{Key: chunkKey(meta.Key, manifest.Generation, i), Data: &chunk, ExpiresAt: meta.ExpiresAt})
+	if err != nil {
+		return fmt.Errorf("failed to store chunk %d: %w", i, err)
+	}
+	manifest.Checksums = append(manifest.Checksums, crc32.ChecksumIEEE(chunk))
+	return nil
+}
+
+// putManifest stores the manifest of a chunked object under the object key
+func (cc *ChunkedCache) putManifest(ctx context.Context, meta *Object, manifest *ChunkManifest) error {
+	o := *meta
+	// Backends reject objects without data
+	o.Data = &[]byte{}
+	o.Chunks = manifest
+	return cc.backend.PutContext(ctx, &o)
+}
+
+// discard removes a chunked object that can no longer be assembled
+func (cc *ChunkedCache) discard(ctx context.Context, key string, manifest *ChunkManifest, reason string) {
+	cc.logger.Printf("Discarding chunked object %s: %s", key, reason)
+	ctx = context.WithoutCancel(ctx)
+	cc.backend.DeleteContext(ctx, key)
+	cc.deleteChunks(ctx, key, manifest)
+}
+
+func (cc *ChunkedCache) deleteChunks(ctx context.Context, key string, manifest *ChunkManifest) {
+	for i := range manifest.Checksums {
+		cc.backend.DeleteContext(ctx, chunkKey(key, manifest.Generation, i))
+	}
+}
+
+// chunkKey derives the key of a chunk from the object key, the key keeps the parts of the object key
+func chunkKey(key string, generation int64, i int) string {
+	return fmt.Sprintf("%s#chunk-%x-%d", key, generation, i)
+}
@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// limitedCache is a backend that rejects entries larger than its limit, as bigcache and memcached do
+type limitedCache struct {
+	*DummyPrinterCache
+	limit int
+}
+
+func (lc limitedCache) PutContext(ctx context.Context, o *Object) error {
+	if o.Data != nil && len(*o.Data) > lc.limit {
+		return errors.New("entry is too large")
+	}
+	return lc.DummyPrinterCache.PutContext(ctx, o)
+}
+
+func newTestChunkedCache() (*ChunkedCache, *DummyPrinterCache) {
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	backend := NewDummyPrinterCache(logger, 1024)
+	return NewChunkedCache(logger, limitedCache{backend, 100}, 100), backend
+}
+
+func TestChunkedCache_PutGet(t *testing.T) {
+	cc, backend := newTestChunkedCache()
+	key := "localhost/testBucket/testKey"
+	body := strings.Repeat("0123456789", 25)
+
+	// Test case: Large objects are stored in chunks and assembled on reads
+	data := []byte(body)
+	if err := cc.Put(&Object{Key: key, Data: &data, OriginalHeaders: map[string][]string{"Etag": {"\"1\""}}}); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if n := len(backend.store); n != 4 {
+		t.Errorf("Expected a manifest and 3 chunks, but got %d entries", n)
+	}
+	obj, err := cc.Get(key, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if string(*obj.Data) != body || obj.OriginalHeaders["Etag"][0] != "\"1\"" || obj.Chunks != nil {
+		t.Errorf("Expected the assembled object, but got %v", obj)
+	}
+
+	// Test case: Chunks expire with their object
+	expiresAt := time.Unix(1700000000, 0)
+	expiring := "localhost/testBucket/expiring"
+	cc.PutStream(context.Background(), &Object{Key: expiring, ExpiresAt: expiresAt}, strings.NewReader(body), -1)
+	for storedKey, stored := range backend.store {
+		if strings.HasPrefix(storedKey, expiring) && !stored.ExpiresAt.Equal(expiresAt) {
+			t.Errorf("Expected %s to expire at %v, but got %v", storedKey, expiresAt, stored.ExpiresAt)
+		}
+	}
+	backend.Clock = func() time.Time { return expiresAt }
+	if _, err := cc.Get(expiring, nil); err == nil {
+		t.Errorf("Expected the expired object to be a miss")
+	}
+	backend.Clock = nil
+	cc.Delete(expiring)
+
+	// Test case: Small objects are stored as they are
+	small := []byte("testData")
+	cc.Put(&Object{Key: "localhost/testBucket/small", Data: &small})
+	if stored, _ := backend.get("localhost/testBucket/small"); stored == nil || stored.Chunks != nil {
+		t.Errorf("Expected the small object to be stored as it is, but got %v", stored)
+	}
+
+	// Test case: Streamed bodies are stored in chunks
+	streamed := "localhost/testBucket/streamed"
+	if err := cc.PutStream(context.Background(), &Object{Key: streamed}, strings.NewReader(body), -1); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	r, _, err := cc.GetStream(context.Background(), streamed)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	read, _ := io.ReadAll(r)
+	r.Close()
+	if string(read) != body {
+		t.Errorf("Expected body of %d bytes, but got %d bytes", len(body), len(read))
+	}
+	err = cc.PutStream(context.Background(), &Object{Key: "localhost/testBucket/short"}, strings.NewReader(body), 300)
+	if !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("Expected %v, but got %v", ErrSizeMismatch, err)
+	}
+
+	// Test case: Deleting an object removes its chunks
+	entries := len(backend.store)
+	if err := cc.Delete(key); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+	if n := len(backend.store); n != entries-4 {
+		t.Errorf("Expected %d entries, but got %d", entries-4, n)
+	}
+}
+
+func TestChunkedCache_Damaged(t *testing.T) {
+	cc, backend := newTestChunkedCache()
+	body := strings.Repeat("0123456789", 25)
+
+	put := func(key string) *ChunkManifest {
+		t.Helper()
+		data := []byte(body)
+		if err := cc.Put(&Object{Key: key, Data: &data}); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		manifest, _ := backend.get(key)
+		return manifest.Chunks
+	}
+
+	// Test case: A missing chunk makes the object a miss
+	manifest := put("localhost/testBucket/missing")
+	backend.Delete(chunkKey("localhost/testBucket/missing", manifest.Generation, 1))
+	if _, err := cc.Get("localhost/testBucket/missing", nil); err != ErrInitializerNil {
+		t.Errorf("Expected %v, but got %v", ErrInitializerNil, err)
+	}
+
+	// Test case: A corrupted chunk makes the object a miss and is refilled
+	manifest = put("localhost/testBucket/corrupted")
+	corrupted := []byte(strings.Repeat("x", 100))
+	backend.Put(&Object{Key: chunkKey("localhost/testBucket/corrupted", manifest.Generation, 2), Data: &corrupted})
+	if _, _, err := cc.GetStream(context.Background(), "localhost/testBucket/corrupted"); err != ErrCacheMiss {
+		t.Errorf("Expected %v, but got %v", ErrCacheMiss, err)
+	}
+	obj, err := cc.Get("localhost/testBucket/corrupted", func() (*Object, error) {
+		data := []byte(body)
+		return &Object{Key: "localhost/testBucket/corrupted", Data: &data}, nil
+	})
+	if err != nil || string(*obj.Data) != body {
+		t.Errorf("Expected the refilled object, but got %v, %v", obj, err)
+	}
+
+	// The damaged objects and their chunks were removed, only the refilled object is left
+	if n := len(backend.store); n != 4 {
+		t.Errorf("Expected 4 entries, but got %d", n)
+	}
+}
+
+func TestChunkedCache_Cleanup(t *testing.T) {
+	cc, backend := newTestChunkedCache()
+	key := "localhost/testBucket/testKey"
+	body := strings.Repeat("0123456789", 25)
+
+	// Test case: A failing body removes the chunks that were already stored
+	err := cc.PutStream(context.Background(), &Object{Key: key}, io.MultiReader(strings.NewReader(body), &failingReader{}), -1)
+	if err == nil {
+		t.Errorf("Expected an error for a failing body")
+	}
+	if n := len(backend.store); n != 0 {
+		t.Errorf("Expected no entries, but got %d", n)
+	}
+	err = cc.PutStream(context.Background(), &Object{Key: key}, strings.NewReader(body), 300)
+	if !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("Expected %v, but got %v", ErrSizeMismatch, err)
+	}
+	if n := len(backend.store); n != 0 {
+		t.Errorf("Expected no entries, but got %d", n)
+	}
+
+	// Test case: Overwriting an object removes the chunks of the earlier write
+	for i := 0; i < 2; i++ {
+		data := []byte(body)
+		if err := cc.Put(&Object{Key: key, Data: &data}); err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		if n := len(backend.store); n != 4 {
+			t.Errorf("Expected a manifest and 3 chunks, but got %d entries", n)
+		}
+	}
+	if err := cc.PutStream(context.Background(), &Object{Key: key}, strings.NewReader(body), -1); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if n := len(backend.store); n != 4 {
+		t.Errorf("Expected a manifest and 3 chunks, but got %d entries", n)
+	}
+
+	// Test case: Replacing a chunked object with a small object removes the chunks
+	small := []byte("testData")
+	cc.Put(&Object{Key: key, Data: &small})
+	if n := len(backend.store); n != 1 {
+		t.Errorf("Expected 1 entry, but got %d", n)
+	}
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+/*
+Codec compresses the bodies of cached objects. Codecs are registered under their name, which is
+stored with every compressed object, so the name of a codec must not change once objects were
+compressed with it.
+*/
+type Codec interface {
+	Name() string
+	// NewWriter returns a writer that compresses to w, the compressed body is complete after Close
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = struct {
+	byName map[string]Codec
+	sync.RWMutex
+}{byName: make(map[string]Codec)}
+
+func init() {
+	RegisterCodec(gzipCodec{})
+	RegisterCodec(flateCodec{})
+}
+
+// RegisterCodec makes a codec available under its name, replacing a codec with the same name
+func RegisterCodec(codec Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byName[codec.Name()] = codec
+}
+
+// LookupCodec returns the codec registered under the name
+func LookupCodec(name string) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	codec, exists := codecs.byName[name]
+	return codec, exists
+}
+
+// gzipCodec compresses with gzip at the default level
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// flateCodec compresses with raw DEFLATE at the default level, without the gzip header and checksum
+type flateCodec struct{}
+
+func (flateCodec) Name() string {
+	return "flate"
+}
+
+func (flateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+func (flateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
@@ -0,0 +1,280 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMinCompressSize is the size below which bodies are stored uncompressed by default
+const DefaultMinCompressSize = 1024
+
+// compressedContentTypes are content types whose bodies are compressed already
+var compressedContentTypes = map[string]bool{
+	"application/gzip":               true,
+	"application/x-gzip":             true,
+	"application/zip":                true,
+	"application/zstd":               true,
+	"application/x-bzip2":            true,
+	"application/x-xz":               true,
+	"application/x-7z-compressed":    true,
+	"application/x-rar-compressed":   true,
+	"application/vnd.apache.parquet": true,
+	"application/x-parquet":          true,
+	"application/pdf":                true,
+}
+
+/*
+CompressedCache compresses the bodies of objects before they are stored in the backend and
+decompresses them when they are read. Bodies that are compressed already, according to their
+Content-Type or Content-Encoding, bodies smaller than MinSize, and bodies that do not get smaller
+are stored as they are. The codec of a compressed body is stored with the object, so objects
+compressed with another registered codec can still be read after the codec is changed.
+*/
+type CompressedCache struct {
+	MinSize int // Bodies smaller than MinSize are not compressed
+
+	backend Cache
+	codec   Codec
+	logger  *log.Logger
+	flights FlightGroup
+
+	compressed   atomic.Uint64
+	skipped      atomic.Uint64
+	bodyBytes    atomic.Uint64
+	storedBytes  atomic.Uint64
+	decodeErrors atomic.Uint64
+}
+
+// CompressionStats counts the bodies stored by a CompressedCache
+type CompressionStats struct {
+	Compressed   uint64 // Bodies stored compressed
+	Skipped      uint64 // Bodies stored as they are
+	BodyBytes    uint64 // Size of all stored bodies before compression
+	StoredBytes  uint64 // Size of all stored bodies after compression
+	DecodeErrors uint64 // Compressed bodies that could not be decompressed and were treated as misses
+}
+
+// Ratio returns the size of the stored bodies before compression divided by their size after it
+func (s CompressionStats) Ratio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.BodyBytes) / float64(s.StoredBytes)
+}
+
+/*
+NewCompressedCache creates a cache that compresses bodies with the named codec before they are
+stored in the backend.
+*/
+func NewCompressedCache(logger *log.Logger, backend Cache, codec string) (*CompressedCache, error) {
+	c, exists := LookupCodec(codec)
+	if !exists {
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+	return &CompressedCache{
+		MinSize: DefaultMinCompressSize,
+		backend: backend,
+		codec:   c,
+		logger:  logger,
+	}, nil
+}
+
+func (cc *CompressedCache) Get(key string, initializer Initializer) (*Object, error) {
+	return cc.GetContext(context.Background(), key, withoutContext(initializer))
+}
+
+func (cc *CompressedCache) GetContext(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+	obj, err := cc.get(ctx, key)
+	if err == ErrCacheMiss {
+		return cc.initialize(ctx, key, initializer)
+	}
+	return obj, err
+}
+
+func (cc *CompressedCache) GetTimed(key string, initializer Initializer) (*Object, int64, int64, error) {
+	start := time.Now()
+	obj, err := cc.get(context.Background(), key)
+	elapsed := time.Since(start).Nanoseconds()
+
+	if err == ErrCacheMiss {
+		start := time.Now()
+		obj, err := cc.initialize(context.Background(), key, withoutContext(initializer))
+		initElapsed := time.Since(start).Nanoseconds()
+		return obj, elapsed, initElapsed, err
+	}
+	return obj, elapsed, 0, err
+}
+
+func (cc *CompressedCache) Put(o *Object) error {
+	return cc.PutContext(context.Background(), o)
+}
+
+func (cc *CompressedCache) PutContext(ctx context.Context, o *Object) error {
+	if o == nil {
+		return ErrObjectNil
+	}
+	stored, err := cc.compress(o)
+	if err != nil {
+		return err
+	}
+	return cc.backend.PutContext(ctx, stored)
+}
+
+func (cc *CompressedCache) Delete(key string) error {
+	return cc.DeleteContext(context.Background(), key)
+}
+
+func (cc *CompressedCache) DeleteContext(ctx context.Context, key string) error {
+	return cc.backend.DeleteContext(ctx, key)
+}
+
+/*
+GetStream returns the body of the object. A compressed body is decompressed into memory, so the
+body can be read from any offset.
+*/
+func (cc *CompressedCache) GetStream(ctx context.Context, key string) (io.ReadSeekCloser, *Object, error) {
+	obj, err := cc.get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, meta := newStreamedObject(obj)
+	return body, meta, nil
+}
+
+/*
+PutStream stores an object with the body read from r. Whether compression pays off is only known
+for the whole body, so the body is read completely before the object is stored.
+*/
+func (cc *CompressedCache) PutStream(ctx context.Context, meta *Object, r io.Reader, size int64) error {
+	o, err := readStreamedObject(meta, r, size)
+	if err != nil {
+		return err
+	}
+	return cc.PutContext(ctx, o)
+}
+
+// Stats returns the counts of the stored bodies and their sizes before and after compression
+func (cc *CompressedCache) Stats() CompressionStats {
+	return CompressionStats{
+		Compressed:   cc.compressed.Load(),
+		Skipped:      cc.skipped.Load(),
+		BodyBytes:    cc.bodyBytes.Load(),
+		StoredBytes:  cc.storedBytes.Load(),
+		DecodeErrors: cc.decodeErrors.Load(),
+	}
+}
+
+// get returns the object from the backend with its body decompressed
+func (cc *CompressedCache) get(ctx context.Context, key string) (*Object, error) {
+	obj, err := cc.backend.GetContext(ctx, key, nil)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, ErrCacheMiss
+	}
+	if obj.Codec == "" || obj.Data == nil {
+		return obj, nil
+	}
+
+	data, err := decompress(obj)
+	if err != nil {
+		cc.decodeErrors.Add(1)
+		cc.logger.Printf("Failed to decompress object %s: %v", key, err)
+		return nil, ErrCacheMiss
+	}
+	o := *obj
+	o.Data = &data
+	o.Codec = ""
+	return &o, nil
+}
+
+func (cc *CompressedCache) initialize(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+
+	lookup := func(ctx context.Context) (*Object, error) {
+		return cc.get(ctx, key)
+	}
+	return initializeWith(ctx, &cc.flights, key, lookup, cc.PutContext, cc.logger, initializer)
+}
+
+// compress returns the object to store, with a compressed body if compression pays off
+func (cc *CompressedCache) compress(o *Object) (*Object, error) {
+	if o.Data == nil || o.Codec != "" {
+		return o, nil
+	}
+	data := *o.Data
+	cc.bodyBytes.Add(uint64(len(data)))
+
+	if len(data) < cc.MinSize || isCompressed(o.OriginalHeaders) {
+		cc.skipped.Add(1)
+		cc.storedBytes.Add(uint64(len(data)))
+		return o, nil
+	}
+
+	var b bytes.Buffer
+	w, err := cc.codec.NewWriter(&b)
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress object %s: %w", o.Key, err)
+	}
+
+	if b.Len() >= len(data) {
+		cc.skipped.Add(1)
+		cc.storedBytes.Add(uint64(len(data)))
+		return o, nil
+	}
+	cc.compressed.Add(1)
+	cc.storedBytes.Add(uint64(b.Len()))
+
+	stored := *o
+	compressed := b.Bytes()
+	stored.Data = &compressed
+	stored.Codec = cc.codec.Name()
+	return &stored, nil
+}
+
+// decompress returns the body of an object compressed with a registered codec
+func decompress(o *Object) ([]byte, error) {
+	codec, exists := LookupCodec(o.Codec)
+	if !exists {
+		return nil, fmt.Errorf("unknown codec %q", o.Codec)
+	}
+	r, err := codec.NewReader(bytes.NewReader(*o.Data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// isCompressed reports whether the headers of an object describe a body that is compressed already
+func isCompressed(headers map[string][]string) bool {
+	header := http.Header(headers)
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return true
+	}
+	contentType, _, _ := strings.Cut(header.Get("Content-Type"), ";")
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	if compressedContentTypes[contentType] {
+		return true
+	}
+	// Media formats are compressed, except for the text based SVG
+	for _, prefix := range []string{"image/", "video/", "audio/"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return contentType != "image/svg+xml"
+		}
+	}
+	return false
+}
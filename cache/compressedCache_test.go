@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestCompressedCache(t *testing.T) {
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	backend := NewDummyPrinterCache(logger, 1024)
+	cc, err := NewCompressedCache(logger, backend, "gzip")
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if _, err := NewCompressedCache(logger, backend, "unknown"); err == nil {
+		t.Errorf("Expected an error for an unknown codec")
+	}
+
+	csv := strings.Repeat("id,name,value\n1,test,42\n", 1000)
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, test := range []struct {
+		key        string
+		body       string
+		headers    map[string][]string
+		compressed bool
+	}{
+		{"localhost/testBucket/data.csv", csv, map[string][]string{"Content-Type": {"text/csv"}}, true},
+		{"localhost/testBucket/data.csv.gz", csv, map[string][]string{"Content-Type": {"application/gzip"}}, false},
+		{"localhost/testBucket/encoded.csv", csv, map[string][]string{"Content-Encoding": {"gzip"}}, false},
+		{"localhost/testBucket/photo.jpg", csv, map[string][]string{"Content-Type": {"image/jpeg"}}, false},
+		{"localhost/testBucket/small.csv", "id,name\n", nil, false},
+		{"localhost/testBucket/random", string(random), nil, false},
+	} {
+		data := []byte(test.body)
+		if err := cc.Put(&Object{Key: test.key, Data: &data, OriginalHeaders: test.headers}); err != nil {
+			t.Fatalf("%s: Expected no error, but got %v", test.key, err)
+		}
+
+		// Test case: Compressible bodies are stored compressed, other bodies as they are
+		stored, _ := backend.get(test.key)
+		if compressed := stored.Codec != ""; compressed != test.compressed {
+			t.Errorf("%s: Expected compressed %v, but got codec %q", test.key, test.compressed, stored.Codec)
+		}
+		if test.compressed && len(*stored.Data) >= len(test.body)/10 {
+			t.Errorf("%s: Expected a compressed body, but got %d of %d bytes", test.key, len(*stored.Data), len(test.body))
+		}
+
+		// Test case: Bodies are read as they were stored
+		obj, err := cc.Get(test.key, nil)
+		if err != nil || string(*obj.Data) != test.body || obj.Codec != "" {
+			t.Errorf("%s: Expected the original body, but got %v", test.key, err)
+		}
+		r, _, err := cc.GetStream(context.Background(), test.key)
+		if err != nil {
+			t.Fatalf("%s: Expected no error, but got %v", test.key, err)
+		}
+		read, _ := io.ReadAll(r)
+		r.Close()
+		if string(read) != test.body {
+			t.Errorf("%s: Expected the original body from the stream, but got %d bytes", test.key, len(read))
+		}
+	}
+
+	stats := cc.Stats()
+	if stats.Compressed != 1 || stats.Skipped != 5 || stats.Ratio() <= 1 {
+		t.Errorf("Expected 1 compressed and 5 skipped bodies with a ratio above 1, but got %+v", stats)
+	}
+
+	// Test case: Objects compressed with another registered codec can be read
+	flate, _ := NewCompressedCache(logger, backend, "flate")
+	data := []byte(csv)
+	flate.Put(&Object{Key: "localhost/testBucket/flate.csv", Data: &data})
+	if obj, err := cc.Get("localhost/testBucket/flate.csv", nil); err != nil || string(*obj.Data) != csv {
+		t.Errorf("Expected the original body, but got %v", err)
+	}
+
+	// Test case: Bodies that cannot be decompressed are misses
+	damaged := []byte("not compressed")
+	backend.Put(&Object{Key: "localhost/testBucket/damaged", Data: &damaged, Codec: "gzip"})
+	if _, _, err := cc.GetStream(context.Background(), "localhost/testBucket/damaged"); err != ErrCacheMiss {
+		t.Errorf("Expected %v, but got %v", ErrCacheMiss, err)
+	}
+	if stats := cc.Stats(); stats.DecodeErrors != 1 {
+		t.Errorf("Expected 1 decode error, but got %d", stats.DecodeErrors)
+	}
+}
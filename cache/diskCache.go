@@ -0,0 +1,639 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+var ErrEntryTooLarge = errors.New("entry is larger than the cache")
+
+// DefaultIndexInterval is the time between two writes of the index of a DiskCache
+const DefaultIndexInterval = time.Minute
+
+const (
+	diskFileMagic  = "DCOBJ002" // Start of every object file
+	diskIndexFile  = "index"
+	diskObjectsDir = "objects"
+	diskTempDir    = "tmp"
+)
+
+/*
+DiskCache stores objects as files below a directory, so the cache can be much larger than the memory
+of the node. Every object is a single file with the metadata in front of the body, written to a
+temporary file first and renamed into place, so readers never see a partial object. The total size
+of the files is kept within a byte budget by evicting the least recently used objects. Expired
+objects are removed when they are looked up.
+
+The index of the cached objects, in LRU order, is written to the directory periodically and on
+Close. On start the index is checked against the object files: files the index does not know, for
+example after a crash, are added from their metadata, and entries without a file are dropped.
+*/
+type DiskCache struct {
+	Clock Clock // Time against which the expiry of objects is checked
+
+	dir      string
+	maxBytes int64
+	logger   *log.Logger
+	flights  FlightGroup
+
+	entries map[string]*list.Element
+	lru     list.List // Most recently used entry first
+	size    int64
+	dirty   bool // The index changed since it was written
+	stats   DiskCacheStats
+	lock    sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// DiskCacheStats counts the lookups and evictions of a DiskCache
+type DiskCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Expired   uint64 // Expired objects removed when they were looked up
+	Entries   int
+	Bytes     int64
+}
+
+// diskEntry is an object of the index, also the format in which the index is written
+type diskEntry struct {
+	Key        string
+	File       string // Path of the object file relative to the objects directory
+	Size       int64  // Size of the object file
+	LastAccess time.Time
+	ExpiresAt  time.Time // Expiry of the object, zero if it does not expire
+}
+
+func (e *diskEntry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
+}
+
+/*
+NewDiskCache opens or creates a disk cache in dir, whose object files take at most maxBytes.
+Objects left by a previous run are kept and evicted first if they exceed the budget.
+*/
+func NewDiskCache(logger *log.Logger, dir string, maxBytes int64) (*DiskCache, error) {
+
+	dc := &DiskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		logger:   logger,
+		entries:  make(map[string]*list.Element),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	for _, sub := range []string{diskObjectsDir, diskTempDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	// Temporary files were not completed before the last shutdown
+	temps, err := os.ReadDir(filepath.Join(dir, diskTempDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, temp := range temps {
+		os.Remove(filepath.Join(dir, diskTempDir, temp.Name()))
+	}
+
+	if err := dc.loadIndex(); err != nil {
+		return nil, err
+	}
+	if err := dc.SaveIndex(); err != nil {
+		return nil, err
+	}
+
+	go dc.saveIndexPeriodically(DefaultIndexInterval)
+	return dc, nil
+}
+
+func (dc *DiskCache) Get(key string, initializer Initializer) (*Object, error) {
+	return dc.GetContext(context.Background(), key, withoutContext(initializer))
+}
+
+func (dc *DiskCache) GetContext(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+	obj, err := dc.get(ctx, key)
+	if err == ErrCacheMiss {
+		return dc.initialize(ctx, key, initializer)
+	}
+	return obj, err
+}
+
+func (dc *DiskCache) GetTimed(key string, initializer Initializer) (*Object, int64, int64, error) {
+	start := time.Now()
+	obj, err := dc.get(context.Background(), key)
+	elapsed := time.Since(start).Nanoseconds()
+
+	if err == ErrCacheMiss {
+		start := time.Now()
+		obj, err := dc.initialize(context.Background(), key, withoutContext(initializer))
+		initElapsed := time.Since(start).Nanoseconds()
+		return obj, elapsed, initElapsed, err
+	}
+	return obj, elapsed, 0, err
+}
+
+func (dc *DiskCache) Put(o *Object) error {
+	return dc.PutContext(context.Background(), o)
+}
+
+func (dc *DiskCache) PutContext(ctx context.Context, o *Object) error {
+	if o == nil {
+		return ErrObjectNil
+	}
+	if o.Data == nil {
+		return ErrDataNil
+	}
+	body, meta := newStreamedObject(o)
+	return dc.PutStream(ctx, meta, body, int64(len(*o.Data)))
+}
+
+/*
+Delete removes the object from the cache. ErrCacheMiss is returned if the object is not cached.
+*/
+func (dc *DiskCache) Delete(key string) error {
+	return dc.DeleteContext(context.Background(), key)
+}
+
+func (dc *DiskCache) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	e, exists := dc.entries[key]
+	if !exists {
+		return ErrCacheMiss
+	}
+	dc.removeLocked(e)
+	return nil
+}
+
+/*
+GetStream returns the body of a cached object, read from its file, and its metadata. Objects
+evicted or replaced while the body is read stay readable until the body is closed.
+*/
+func (dc *DiskCache) GetStream(ctx context.Context, key string) (io.ReadSeekCloser, *Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	dc.lock.Lock()
+	e, exists := dc.entries[key]
+	if exists && e.Value.(*diskEntry).expired(dc.Clock.now()) {
+		dc.removeLocked(e)
+		dc.stats.Expired++
+		exists = false
+	}
+	if !exists {
+		dc.stats.Misses++
+		dc.lock.Unlock()
+		return nil, nil, ErrCacheMiss
+	}
+	dc.lru.MoveToFront(e)
+	entry := e.Value.(*diskEntry)
+	entry.LastAccess = time.Now()
+	file := entry.File
+	dc.dirty = true
+	dc.lock.Unlock()
+
+	f, err := os.Open(dc.objectPath(file))
+	if err == nil {
+		var body io.ReadSeekCloser
+		var meta *Object
+		body, meta, err = openObjectFile(f)
+		if err == nil && meta.Key == key {
+			dc.lock.Lock()
+			dc.stats.Hits++
+			dc.lock.Unlock()
+			return body, meta, nil
+		}
+		f.Close()
+		if err == nil {
+			err = fmt.Errorf("object file %s belongs to key %s", file, meta.Key)
+		}
+	}
+
+	// The file was removed or damaged outside of the cache
+	dc.logger.Printf("Failed to read object %s: %v", key, err)
+	dc.lock.Lock()
+	if current, exists := dc.entries[key]; exists && current == e {
+		dc.removeLocked(current)
+	}
+	dc.stats.Misses++
+	dc.lock.Unlock()
+	return nil, nil, ErrCacheMiss
+}
+
+/*
+PutStream writes the object to a temporary file and renames it into place once the body was read
+completely, replacing a cached object with the same key. Least recently used objects are evicted
+until the cache is within its budget again.
+*/
+func (dc *DiskCache) PutStream(ctx context.Context, meta *Object, r io.Reader, size int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if meta == nil {
+		return ErrObjectNil
+	}
+	if meta.Key == "" {
+		return ErrInvalidKey
+	}
+	if size > dc.maxBytes {
+		return ErrEntryTooLarge
+	}
+
+	temp, err := os.CreateTemp(filepath.Join(dc.dir, diskTempDir), "object-*")
+	if err != nil {
+		return err
+	}
+	fileSize, err := writeObjectFile(temp, meta, &contextReader{ctx: ctx, r: r}, size, dc.maxBytes)
+	if err == nil {
+		// The data has to be on the disk before the rename makes the file visible
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	file := objectFileName(meta.Key)
+	path := dc.objectPath(file)
+
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if e, exists := dc.entries[meta.Key]; exists {
+		// The file of the replaced entry was overwritten by the rename
+		dc.size -= e.Value.(*diskEntry).Size
+		dc.lru.Remove(e)
+		delete(dc.entries, meta.Key)
+	}
+	dc.addLocked(&diskEntry{Key: meta.Key, File: file, Size: fileSize, LastAccess: time.Now(), ExpiresAt: meta.ExpiresAt}, true)
+	dc.evictLocked()
+	return nil
+}
+
+// Stats returns the lookup and eviction counts and the current size of the cache
+func (dc *DiskCache) Stats() DiskCacheStats {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	stats := dc.stats
+	stats.Entries = len(dc.entries)
+	stats.Bytes = dc.size
+	return stats
+}
+
+// SaveIndex writes the index to the cache directory, replacing the previous one atomically
+func (dc *DiskCache) SaveIndex() error {
+
+	dc.lock.Lock()
+	index := make([]diskEntry, 0, len(dc.entries))
+	for e := dc.lru.Front(); e != nil; e = e.Next() {
+		index = append(index, *e.Value.(*diskEntry))
+	}
+	dc.dirty = false
+	dc.lock.Unlock()
+
+	temp, err := os.CreateTemp(filepath.Join(dc.dir, diskTempDir), "index-*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(temp)
+	err = gob.NewEncoder(w).Encode(index)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), filepath.Join(dc.dir, diskIndexFile))
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		dc.lock.Lock()
+		dc.dirty = true
+		dc.lock.Unlock()
+		return fmt.Errorf("failed to save index: %w", err)
+	}
+	return nil
+}
+
+// Close stops the periodic index writes and writes the index a last time
+func (dc *DiskCache) Close() error {
+	close(dc.stop)
+	<-dc.done
+	return dc.SaveIndex()
+}
+
+func (dc *DiskCache) saveIndexPeriodically(interval time.Duration) {
+	defer close(dc.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dc.stop:
+			return
+		case <-ticker.C:
+			dc.lock.Lock()
+			dirty := dc.dirty
+			dc.lock.Unlock()
+			if !dirty {
+				continue
+			}
+			if err := dc.SaveIndex(); err != nil {
+				dc.logger.Printf("%v", err)
+			}
+		}
+	}
+}
+
+/*
+loadIndex restores the entries from the index and the object files. The index is only trusted for
+files that still exist with the recorded size. Other files are read to find their key, damaged
+files are removed. A missing or unreadable index is rebuilt from the files alone.
+*/
+func (dc *DiskCache) loadIndex() error {
+
+	indexed := make(map[string]diskEntry)
+	var index []diskEntry
+	data, err := os.ReadFile(filepath.Join(dc.dir, diskIndexFile))
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&index)
+		if err != nil {
+			dc.logger.Printf("Failed to read index, rebuilding it from the object files: %v", err)
+			index = nil
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, entry := range index {
+		indexed[entry.File] = entry
+	}
+
+	objectsDir := filepath.Join(dc.dir, diskObjectsDir)
+	var found []*diskEntry
+	err = filepath.WalkDir(objectsDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		file, err := filepath.Rel(objectsDir, path)
+		if err != nil {
+			return err
+		}
+
+		if entry, exists := indexed[file]; exists && entry.Size == info.Size() {
+			found = append(found, &entry)
+			return nil
+		}
+
+		meta, err := readObjectMetadata(path)
+		if err != nil || objectFileName(meta.Key) != file {
+			dc.logger.Printf("Removing damaged object file %s: %v", file, err)
+			os.Remove(path)
+			return nil
+		}
+		found = append(found, &diskEntry{Key: meta.Key, File: file, Size: info.Size(), LastAccess: info.ModTime(), ExpiresAt: meta.ExpiresAt})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Most recently used entries first, as in the index
+	sortEntriesByAccess(found)
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+	for _, entry := range found {
+		dc.addLocked(entry, false)
+	}
+	dc.evictLocked()
+	return nil
+}
+
+// addLocked adds an entry as most recently used, or as least recently used for entries restored in LRU order
+func (dc *DiskCache) addLocked(entry *diskEntry, recent bool) {
+	if recent {
+		dc.entries[entry.Key] = dc.lru.PushFront(entry)
+	} else {
+		dc.entries[entry.Key] = dc.lru.PushBack(entry)
+	}
+	dc.size += entry.Size
+	dc.dirty = true
+}
+
+func (dc *DiskCache) removeLocked(e *list.Element) {
+	entry := e.Value.(*diskEntry)
+	if err := os.Remove(dc.objectPath(entry.File)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		dc.logger.Printf("Failed to remove object file %s: %v", entry.File, err)
+	}
+	dc.size -= entry.Size
+	dc.lru.Remove(e)
+	delete(dc.entries, entry.Key)
+	dc.dirty = true
+}
+
+// evictLocked removes the least recently used entries until the cache is within its budget
+func (dc *DiskCache) evictLocked() {
+	for dc.size > dc.maxBytes && dc.lru.Len() > 0 {
+		dc.removeLocked(dc.lru.Back())
+		dc.stats.Evictions++
+	}
+}
+
+func (dc *DiskCache) objectPath(file string) string {
+	return filepath.Join(dc.dir, diskObjectsDir, file)
+}
+
+func (dc *DiskCache) get(ctx context.Context, key string) (*Object, error) {
+	body, meta, err := dc.GetStream(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	meta.Data = &data
+	return meta, nil
+}
+
+func (dc *DiskCache) initialize(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+
+	lookup := func(ctx context.Context) (*Object, error) {
+		return dc.get(ctx, key)
+	}
+	return initializeWith(ctx, &dc.flights, key, lookup, dc.PutContext, dc.logger, initializer)
+}
+
+// objectFileName derives the file of an object from its key, spread over subdirectories
+func objectFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(name[:2], name[2:])
+}
+
+/*
+writeObjectFile writes an object file: the magic, the length of the metadata, the metadata
+serialized by encodeObject without a body, and the body. It returns the size of the file. The body must match size unless it is
+-1, and the file must not exceed maxBytes.
+*/
+func writeObjectFile(f *os.File, meta *Object, body io.Reader, size int64, maxBytes int64) (int64, error) {
+
+	header := *meta
+	header.Data = nil
+	encoded := encodeObject(&header)
+
+	w := bufio.NewWriter(f)
+	w.WriteString(diskFileMagic)
+	binary.Write(w, binary.BigEndian, uint32(len(encoded)))
+	w.Write(encoded)
+	headerSize := int64(len(diskFileMagic) + 4 + len(encoded))
+
+	if headerSize > maxBytes {
+		return 0, ErrEntryTooLarge
+	}
+	n, err := io.Copy(w, io.LimitReader(body, maxBytes-headerSize+1))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read object body: %w", err)
+	}
+	if headerSize+n > maxBytes {
+		return 0, ErrEntryTooLarge
+	}
+	if size >= 0 && n != size {
+		return 0, ErrSizeMismatch
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	return headerSize + n, nil
+}
+
+// readObjectHeader reads the metadata of an object file and returns the offset of the body
+func readObjectHeader(r io.Reader) (*Object, int64, error) {
+
+	magic := make([]byte, len(diskFileMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, 0, err
+	}
+	if string(magic) != diskFileMagic {
+		return nil, 0, fmt.Errorf("%v: not an object file", ErrDeserialization)
+	}
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, 0, err
+	}
+	// Read without allocating length bytes up front, a damaged length must not exhaust the memory
+	encoded, err := io.ReadAll(io.LimitReader(r, int64(length)))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(encoded) < int(length) {
+		return nil, 0, fmt.Errorf("%v: %w", ErrDeserialization, ErrObjectTruncated)
+	}
+
+	meta, err := decodeObject(encoded)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%v: %w", ErrDeserialization, err)
+	}
+	return meta, int64(len(diskFileMagic)+4) + int64(length), nil
+}
+
+// openObjectFile returns the body and the metadata of an open object file, the body closes the file
+func openObjectFile(f *os.File) (io.ReadSeekCloser, *Object, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, offset, err := readObjectHeader(bufio.NewReader(f))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &fileBody{SectionReader: io.NewSectionReader(f, offset, info.Size()-offset), f: f}, meta, nil
+}
+
+func readObjectMetadata(path string) (*Object, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	meta, _, err := readObjectHeader(bufio.NewReader(f))
+	return meta, err
+}
+
+func sortEntriesByAccess(entries []*diskEntry) {
+	slices.SortStableFunc(entries, func(a, b *diskEntry) int {
+		return b.LastAccess.Compare(a.LastAccess)
+	})
+}
+
+// fileBody is the body of an object read from its file
+type fileBody struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (b *fileBody) Close() error {
+	return b.f.Close()
+}
+
+// contextReader stops reading a body once the context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestDiskCache(t *testing.T, dir string, maxBytes int64) *DiskCache {
+	dc, err := NewDiskCache(log.New(io.Discard, "", log.LstdFlags), dir, maxBytes)
+	if err != nil {
+		t.Fatalf("Failed to open disk cache: %v", err)
+	}
+	return dc
+}
+
+func TestDiskCache_PutGet(t *testing.T) {
+	dc := newTestDiskCache(t, t.TempDir(), 1<<20)
+	defer dc.Close()
+
+	data := []byte("testData")
+	obj := &Object{
+		Key:             "localhost/testBucket/testKey",
+		Data:            &data,
+		OriginalHeaders: map[string][]string{"Etag": {"\"1\""}},
+	}
+	if err := dc.Put(obj); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+
+	// Test case: Objects are read back with their metadata
+	stored, err := dc.Get(obj.Key, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if string(*stored.Data) != "testData" || stored.OriginalHeaders["Etag"][0] != "\"1\"" {
+		t.Errorf("Expected object with data 'testData', but got %v", stored)
+	}
+
+	// Test case: Bodies can be read from an offset
+	body, _, err := dc.GetStream(context.Background(), obj.Key)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	body.Seek(4, io.SeekStart)
+	part, _ := io.ReadAll(body)
+	body.Close()
+	if string(part) != "Data" {
+		t.Errorf("Expected 'Data', but got %s", string(part))
+	}
+
+	// Test case: Deleted objects are misses
+	if err := dc.Delete(obj.Key); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+	if _, _, err := dc.GetStream(context.Background(), obj.Key); err != ErrCacheMiss {
+		t.Errorf("Expected %v, but got %v", ErrCacheMiss, err)
+	}
+	if err := dc.Delete(obj.Key); err != ErrCacheMiss {
+		t.Errorf("Expected %v, but got %v", ErrCacheMiss, err)
+	}
+}
+
+func TestDiskCache_Eviction(t *testing.T) {
+	dir := t.TempDir()
+	put := func(dc *DiskCache, key string) {
+		t.Helper()
+		err := dc.PutStream(context.Background(), &Object{Key: key}, strings.NewReader(strings.Repeat("x", 1000)), 1000)
+		if err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+	}
+
+	// Room for two objects with their metadata
+	dc := newTestDiskCache(t, dir, 2500)
+	put(dc, "localhost/testBucket/a")
+	put(dc, "localhost/testBucket/b")
+	dc.Get("localhost/testBucket/a", nil)
+
+	// Test case: The least recently used object is evicted
+	put(dc, "localhost/testBucket/c")
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := dc.Get("localhost/testBucket/"+key, nil)
+		if cached := key != "b"; (err == nil) != cached {
+			t.Errorf("Object %s: Expected cached %v, but got error %v", key, cached, err)
+		}
+	}
+	if stats := dc.Stats(); stats.Evictions != 1 || stats.Entries != 2 || stats.Bytes > 2500 {
+		t.Errorf("Expected 1 eviction and 2 entries within the budget, but got %+v", stats)
+	}
+
+	// Test case: Objects larger than the budget are rejected
+	err := dc.PutStream(context.Background(), &Object{Key: "localhost/testBucket/d"}, strings.NewReader(strings.Repeat("x", 3000)), -1)
+	if err != ErrEntryTooLarge {
+		t.Errorf("Expected %v, but got %v", ErrEntryTooLarge, err)
+	}
+	dc.Close()
+
+	// Test case: The LRU order survives a restart, a smaller budget evicts the oldest objects
+	dc = newTestDiskCache(t, dir, 1500)
+	defer dc.Close()
+	for key, cached := range map[string]bool{"a": false, "c": true} {
+		_, err := dc.Get("localhost/testBucket/"+key, nil)
+		if (err == nil) != cached {
+			t.Errorf("Object %s: Expected cached %v after restart, but got error %v", key, cached, err)
+		}
+	}
+}
+
+func TestDiskCache_Recovery(t *testing.T) {
+	dir := t.TempDir()
+
+	// The cache is not closed, so the index does not know the objects, as after a crash
+	dc := newTestDiskCache(t, dir, 1<<20)
+	data := []byte("testData")
+	dc.Put(&Object{Key: "localhost/testBucket/a", Data: &data})
+	dc.Put(&Object{Key: "localhost/testBucket/b", Data: &data})
+
+	// A failing body leaves nothing behind
+	err := dc.PutStream(context.Background(), &Object{Key: "localhost/testBucket/c"}, io.MultiReader(strings.NewReader("test"), &failingReader{}), -1)
+	if err == nil {
+		t.Errorf("Expected an error for a failing body")
+	}
+	if _, _, err := dc.GetStream(context.Background(), "localhost/testBucket/c"); err != ErrCacheMiss {
+		t.Errorf("Expected %v, but got %v", ErrCacheMiss, err)
+	}
+
+	// Damage one object file and leave a temporary file, as an interrupted write would
+	os.WriteFile(dc.objectPath(objectFileName("localhost/testBucket/b")), []byte("damaged"), 0o644)
+	// A damaged header length must not be allocated
+	damaged := dc.objectPath(objectFileName("localhost/testBucket/d"))
+	os.MkdirAll(filepath.Dir(damaged), 0o755)
+	if err := os.WriteFile(damaged, append([]byte(diskFileMagic), 0xff, 0xff, 0xff, 0xff), 0o644); err != nil {
+		t.Fatalf("Failed to write object file: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, diskTempDir, "object-1"), []byte("partial"), 0o644)
+	os.WriteFile(filepath.Join(dir, diskIndexFile), []byte("corrupted index"), 0o644)
+
+	// Test case: The index is rebuilt from the intact object files
+	recovered := newTestDiskCache(t, dir, 1<<20)
+	defer recovered.Close()
+
+	obj, err := recovered.Get("localhost/testBucket/a", nil)
+	if err != nil || string(*obj.Data) != "testData" {
+		t.Errorf("Expected recovered object with data 'testData', but got %v, %v", obj, err)
+	}
+	if _, err := recovered.Get("localhost/testBucket/b", nil); err != ErrInitializerNil {
+		t.Errorf("Expected damaged object to be a miss, but got %v", err)
+	}
+	if _, err := recovered.Get("localhost/testBucket/d", nil); err != ErrInitializerNil {
+		t.Errorf("Expected object with a damaged header length to be a miss, but got %v", err)
+	}
+	if stats := recovered.Stats(); stats.Entries != 1 {
+		t.Errorf("Expected 1 entry, but got %d", stats.Entries)
+	}
+	if temps, _ := os.ReadDir(filepath.Join(dir, diskTempDir)); len(temps) != 0 {
+		t.Errorf("Expected temporary files to be removed, but found %d", len(temps))
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
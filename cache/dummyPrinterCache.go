@@ -1,19 +1,25 @@
 package cache
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
 	"sync"
+	"time"
 )
 
 // DummyPrinterCache is a dummy implementation of the Cache interface.
 // It is used for testing purposes.
 
 type DummyPrinterCache struct {
+	Clock Clock // Time against which the expiry of objects is checked
+
 	logger  *log.Logger
 	maxSize int64
 	store   map[string]*Object
 	lock    sync.RWMutex
+	flights FlightGroup
 }
 
 // func printObjectData(o *Object, logger *log.Logger) {
@@ -29,10 +35,17 @@ type DummyPrinterCache struct {
 // }
 
 func (dpc *DummyPrinterCache) Get(key string, initializer Initializer) (*Object, error) {
+	return dpc.GetContext(context.Background(), key, withoutContext(initializer))
+}
+
+func (dpc *DummyPrinterCache) GetContext(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	obj, exists := dpc.get(key)
 	if !exists {
 		//dpc.logger.Println("Attempting to retrieve object from remote:")
-		return dpc.initialize(key, initializer)
+		return dpc.initialize(ctx, key, initializer)
 	}
 
 	//dpc.logger.Println("Object retrieved from cache:")
@@ -42,6 +55,20 @@ func (dpc *DummyPrinterCache) Get(key string, initializer Initializer) (*Object,
 	return obj, nil
 }
 
+func (dpc *DummyPrinterCache) GetTimed(key string, initializer Initializer) (*Object, int64, int64, error) {
+	start := time.Now()
+	obj, exists := dpc.get(key)
+	elapsed := time.Since(start).Nanoseconds()
+
+	if !exists {
+		start := time.Now()
+		obj, err := dpc.initialize(context.Background(), key, withoutContext(initializer))
+		initElapsed := time.Since(start).Nanoseconds()
+		return obj, elapsed, initElapsed, err
+	}
+	return obj, elapsed, 0, nil
+}
+
 func (dpc *DummyPrinterCache) Put(o *Object) error {
 	dpc.lock.Lock()
 	defer dpc.lock.Unlock()
@@ -57,31 +84,76 @@ func (dpc *DummyPrinterCache) Put(o *Object) error {
 
 }
 
+func (dpc *DummyPrinterCache) PutContext(ctx context.Context, o *Object) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return dpc.Put(o)
+}
+
+func (dpc *DummyPrinterCache) Delete(key string) error {
+	dpc.lock.Lock()
+	defer dpc.lock.Unlock()
+	if _, exists := dpc.store[key]; !exists {
+		return ErrCacheMiss
+	}
+	delete(dpc.store, key)
+	return nil
+}
+
+func (dpc *DummyPrinterCache) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return dpc.Delete(key)
+}
+
+func (dpc *DummyPrinterCache) GetStream(ctx context.Context, key string) (io.ReadSeekCloser, *Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	obj, exists := dpc.get(key)
+	if !exists {
+		return nil, nil, ErrCacheMiss
+	}
+	body, meta := newStreamedObject(obj)
+	return body, meta, nil
+}
+
+func (dpc *DummyPrinterCache) PutStream(ctx context.Context, meta *Object, r io.Reader, size int64) error {
+	obj, err := readStreamedObject(meta, r, size)
+	if err != nil {
+		return err
+	}
+	return dpc.PutContext(ctx, obj)
+}
+
 func (dpc *DummyPrinterCache) get(key string) (*Object, bool) {
 	dpc.lock.RLock()
 	defer dpc.lock.RUnlock()
 	obj, exists := dpc.store[key]
+	if exists && obj.IsExpired(dpc.Clock.now()) {
+		return nil, false
+	}
 	return obj, exists
 }
 
-func (dpc *DummyPrinterCache) initialize(key string, initializer Initializer) (*Object, error) {
+func (dpc *DummyPrinterCache) initialize(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
 
-	data, exists := dpc.get(key)
-	if exists {
-		return data, nil
+	if initializer == nil {
+		return nil, fmt.Errorf("Object with key %s not found", key)
 	}
 
-	if initializer != nil {
-
-		obj, err := initializer()
-		if err != nil {
-			return nil, err
+	lookup := func(ctx context.Context) (*Object, error) {
+		if data, exists := dpc.get(key); exists {
+			return data, nil
 		}
-		dpc.Put(obj)
-		return obj, nil
-
+		return nil, ErrCacheMiss
+	}
+	put := func(ctx context.Context, obj *Object) error {
+		return dpc.Put(obj)
 	}
-	return nil, fmt.Errorf("Object with key %s not found", key)
+	return initializeWith(ctx, &dpc.flights, key, lookup, put, dpc.logger, initializer)
 }
 
 func NewDummyPrinterCache(logger *log.Logger, maxSize int64) *DummyPrinterCache {
@@ -2,9 +2,11 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"log"
+	"strings"
 	"testing"
 	"time"
 )
@@ -138,3 +140,52 @@ func TestDummyPrinterCache_Put(t *testing.T) {
 		t.Errorf("Expected stored object data %v, but got %v", data, *storedObj.Data)
 	}
 }
+
+func TestDummyPrinterCache_Stream(t *testing.T) {
+	cache := NewDummyPrinterCache(log.New(io.Discard, "", log.LstdFlags), 1024)
+	ctx := context.Background()
+
+	meta := &Object{
+		Key:             "localhost/testBucket/testKey",
+		OriginalHeaders: map[string][]string{"Etag": {"\"1\""}},
+	}
+
+	// Test case: Bodies of known and unknown size are stored
+	for _, size := range []int64{8, -1} {
+		err := cache.PutStream(ctx, meta, strings.NewReader("testData"), size)
+		if err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+
+		body, storedMeta, err := cache.GetStream(ctx, meta.Key)
+		if err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		data, _ := io.ReadAll(body)
+		body.Close()
+		if string(data) != "testData" {
+			t.Errorf("Expected object data 'testData', but got %s", string(data))
+		}
+		if storedMeta.Data != nil || storedMeta.OriginalHeaders["Etag"][0] != "\"1\"" {
+			t.Errorf("Expected metadata without data, but got %v", storedMeta)
+		}
+	}
+
+	// Test case: Objects stored with PutStream can be read with Get
+	obj, err := cache.Get(meta.Key, nil)
+	if err != nil || string(*obj.Data) != "testData" {
+		t.Errorf("Expected object with data 'testData', but got %v, %v", obj, err)
+	}
+
+	// Test case: Bodies that do not match the size are not stored
+	for _, size := range []int64{4, 16} {
+		meta := &Object{Key: "localhost/testBucket/mismatch"}
+		err := cache.PutStream(ctx, meta, strings.NewReader("testData"), size)
+		if !errors.Is(err, ErrSizeMismatch) {
+			t.Errorf("Size %d: Expected %v, but got %v", size, ErrSizeMismatch, err)
+		}
+		if _, _, err := cache.GetStream(ctx, meta.Key); err != ErrCacheMiss {
+			t.Errorf("Size %d: Expected %v, but got %v", size, ErrCacheMiss, err)
+		}
+	}
+}
@@ -0,0 +1,487 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+)
+
+// EvictionPolicy selects the objects a MemoryCache evicts when it is full
+type EvictionPolicy string
+
+const (
+	PolicyLRU      EvictionPolicy = "lru"       // Least recently used
+	PolicyLFU      EvictionPolicy = "lfu"       // Least frequently used, the least recently used of those first
+	PolicyARC      EvictionPolicy = "arc"       // Adaptive replacement cache, balances recency and frequency
+	PolicyWTinyLFU EvictionPolicy = "w-tinylfu" // Small LRU window in front of a segmented LRU with frequency based admission
+	PolicyS3FIFO   EvictionPolicy = "s3-fifo"   // Small and main FIFO queues, objects not accessed again leave through the small queue
+)
+
+// EvictionReason tells why an object left a MemoryCache or was not stored
+type EvictionReason string
+
+const (
+	EvictionCapacity  EvictionReason = "capacity"  // Evicted to make room for other objects
+	EvictionAdmission EvictionReason = "admission" // New object rejected, it was accessed less often than the object it would have replaced
+	EvictionTooLarge  EvictionReason = "too-large" // Object larger than the cache, not stored
+	EvictionExpired   EvictionReason = "expired"   // Object outlived its time to live, removed when it was looked up
+)
+
+// memoryEntry is an object in a MemoryCache, the policy fields are guarded by the lock of its shard
+type memoryEntry struct {
+	key  string
+	obj  *Object
+	size int64
+
+	elem  *list.Element // Position in the queue of the policy
+	queue int           // Queue of the policy that holds the entry
+	freq  int           // Accesses counted by LFU and S3-FIFO
+	index int           // Position in the LFU heap
+	tick  uint64        // Last access, orders LFU entries with the same frequency
+}
+
+/*
+evictionPolicy orders the entries of a shard. The shard tells the policy about new, accessed and
+removed entries, and calls evict while it exceeds its budget. evict removes the entry from the
+policy and returns it, or returns nil if the policy holds no entries.
+*/
+type evictionPolicy interface {
+	added(e *memoryEntry)
+	accessed(e *memoryEntry)
+	removed(e *memoryEntry)
+	evict() (*memoryEntry, EvictionReason)
+}
+
+func newEvictionPolicy(policy EvictionPolicy, capacity int64) (evictionPolicy, error) {
+	switch policy {
+	case PolicyLRU:
+		return &lruPolicy{}, nil
+	case PolicyLFU:
+		return &lfuPolicy{}, nil
+	case PolicyARC:
+		return &arcPolicy{capacity: capacity}, nil
+	case PolicyWTinyLFU:
+		return newTinyLFUPolicy(capacity), nil
+	case PolicyS3FIFO:
+		return &s3FIFOPolicy{smallMax: capacity / 10, ghostMax: capacity - capacity/10}, nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q", policy)
+}
+
+// entryQueue is a list of entries, the most recently inserted first, that keeps track of their size
+type entryQueue struct {
+	entries list.List
+	bytes   int64
+}
+
+func (q *entryQueue) pushFront(e *memoryEntry, queue int) {
+	e.elem = q.entries.PushFront(e)
+	e.queue = queue
+	q.bytes += e.size
+}
+
+func (q *entryQueue) moveToFront(e *memoryEntry) {
+	q.entries.MoveToFront(e.elem)
+}
+
+func (q *entryQueue) remove(e *memoryEntry) {
+	q.entries.Remove(e.elem)
+	e.elem = nil
+	q.bytes -= e.size
+}
+
+func (q *entryQueue) back() *memoryEntry {
+	if elem := q.entries.Back(); elem != nil {
+		return elem.Value.(*memoryEntry)
+	}
+	return nil
+}
+
+func (q *entryQueue) len() int {
+	return q.entries.Len()
+}
+
+// ghostQueue remembers the keys and sizes of evicted entries, the most recently evicted first
+type ghostQueue struct {
+	keys    map[string]*list.Element
+	entries list.List
+	bytes   int64
+}
+
+type ghostEntry struct {
+	key  string
+	size int64
+}
+
+func (g *ghostQueue) add(key string, size int64) {
+	if g.keys == nil {
+		g.keys = make(map[string]*list.Element)
+	}
+	g.remove(key)
+	g.keys[key] = g.entries.PushFront(ghostEntry{key, size})
+	g.bytes += size
+}
+
+// remove forgets the key and reports whether it was remembered
+func (g *ghostQueue) remove(key string) bool {
+	elem, exists := g.keys[key]
+	if !exists {
+		return false
+	}
+	g.entries.Remove(elem)
+	delete(g.keys, key)
+	g.bytes -= elem.Value.(ghostEntry).size
+	return true
+}
+
+// trim forgets the oldest keys until the remembered sizes add up to at most maxBytes
+func (g *ghostQueue) trim(maxBytes int64) {
+	for g.bytes > maxBytes && g.entries.Len() > 0 {
+		g.remove(g.entries.Back().Value.(ghostEntry).key)
+	}
+}
+
+// lruPolicy evicts the least recently used entry
+type lruPolicy struct {
+	queue entryQueue
+}
+
+func (p *lruPolicy) added(e *memoryEntry) {
+	p.queue.pushFront(e, 0)
+}
+
+func (p *lruPolicy) accessed(e *memoryEntry) {
+	p.queue.moveToFront(e)
+}
+
+func (p *lruPolicy) removed(e *memoryEntry) {
+	p.queue.remove(e)
+}
+
+func (p *lruPolicy) evict() (*memoryEntry, EvictionReason) {
+	e := p.queue.back()
+	if e != nil {
+		p.queue.remove(e)
+	}
+	return e, EvictionCapacity
+}
+
+// lfuPolicy evicts the least frequently used entry, of those the least recently used
+type lfuPolicy struct {
+	entries lfuHeap
+	tick    uint64
+}
+
+func (p *lfuPolicy) added(e *memoryEntry) {
+	p.tick++
+	e.freq, e.tick = 1, p.tick
+	heap.Push(&p.entries, e)
+}
+
+func (p *lfuPolicy) accessed(e *memoryEntry) {
+	p.tick++
+	e.freq, e.tick = e.freq+1, p.tick
+	heap.Fix(&p.entries, e.index)
+}
+
+func (p *lfuPolicy) removed(e *memoryEntry) {
+	heap.Remove(&p.entries, e.index)
+}
+
+func (p *lfuPolicy) evict() (*memoryEntry, EvictionReason) {
+	if len(p.entries) == 0 {
+		return nil, EvictionCapacity
+	}
+	return heap.Pop(&p.entries).(*memoryEntry), EvictionCapacity
+}
+
+// lfuHeap is a min-heap of entries by frequency and last access
+type lfuHeap []*memoryEntry
+
+func (h lfuHeap) Len() int {
+	return len(h)
+}
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *lfuHeap) Push(x any) {
+	e := x.(*memoryEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+const (
+	arcRecent   = iota // T1, entries accessed once
+	arcFrequent        // T2, entries accessed more than once
+)
+
+/*
+arcPolicy is the adaptive replacement cache of Megiddo and Modha, weighted by the size of the
+entries. Entries seen once are kept in the recent queue, entries seen again in the frequent queue.
+The keys of evicted entries are remembered in a ghost queue for each. A miss on a key in a ghost
+queue shifts the target size of the recent queue towards the queue that would have kept the entry.
+*/
+type arcPolicy struct {
+	capacity       int64
+	target         int64 // Target size of the recent queue
+	recent         entryQueue
+	frequent       entryQueue
+	recentGhosts   ghostQueue
+	frequentGhosts ghostQueue
+}
+
+func (p *arcPolicy) added(e *memoryEntry) {
+	switch {
+	case p.recentGhosts.keys[e.key] != nil:
+		// The entry was evicted too early from the recent queue
+		delta := max(e.size, e.size*p.frequentGhosts.bytes/max(p.recentGhosts.bytes, 1))
+		p.target = min(p.capacity, p.target+delta)
+		p.recentGhosts.remove(e.key)
+		p.frequent.pushFront(e, arcFrequent)
+	case p.frequentGhosts.keys[e.key] != nil:
+		// The entry was evicted too early from the frequent queue
+		delta := max(e.size, e.size*p.recentGhosts.bytes/max(p.frequentGhosts.bytes, 1))
+		p.target = max(0, p.target-delta)
+		p.frequentGhosts.remove(e.key)
+		p.frequent.pushFront(e, arcFrequent)
+	default:
+		p.recent.pushFront(e, arcRecent)
+	}
+	p.trimGhosts()
+}
+
+func (p *arcPolicy) accessed(e *memoryEntry) {
+	if e.queue == arcRecent {
+		p.recent.remove(e)
+		p.frequent.pushFront(e, arcFrequent)
+		return
+	}
+	p.frequent.moveToFront(e)
+}
+
+func (p *arcPolicy) removed(e *memoryEntry) {
+	if e.queue == arcRecent {
+		p.recent.remove(e)
+	} else {
+		p.frequent.remove(e)
+	}
+}
+
+func (p *arcPolicy) evict() (*memoryEntry, EvictionReason) {
+	var e *memoryEntry
+	if p.recent.len() > 0 && (p.recent.bytes > p.target || p.frequent.len() == 0) {
+		e = p.recent.back()
+		p.recent.remove(e)
+		p.recentGhosts.add(e.key, e.size)
+	} else if p.frequent.len() > 0 {
+		e = p.frequent.back()
+		p.frequent.remove(e)
+		p.frequentGhosts.add(e.key, e.size)
+	}
+	p.trimGhosts()
+	return e, EvictionCapacity
+}
+
+// trimGhosts keeps the recent queue and its ghosts within the capacity, and all queues within twice the capacity
+func (p *arcPolicy) trimGhosts() {
+	p.recentGhosts.trim(max(0, p.capacity-p.recent.bytes))
+	p.frequentGhosts.trim(max(0, 2*p.capacity-p.recent.bytes-p.frequent.bytes-p.recentGhosts.bytes))
+}
+
+const (
+	tinyLFUWindow    = iota // Admission window, LRU
+	tinyLFUProbation        // Main segment, entries not accessed since they were admitted
+	tinyLFUProtected        // Main segment, entries accessed after they were admitted
+)
+
+// Average size of an entry assumed to size the frequency sketch of W-TinyLFU
+const tinyLFUAverageEntry = 16 << 10
+
+/*
+tinyLFUPolicy is W-TinyLFU as used by Caffeine. New entries enter a small LRU window. Entries
+leaving the window are candidates for the main segmented LRU, and are only admitted if they were
+seen more often recently than the entry they would replace, according to a frequency sketch.
+The main segment keeps entries accessed after their admission in a protected segment.
+*/
+type tinyLFUPolicy struct {
+	sketch       *frequencySketch
+	window       entryQueue
+	probation    entryQueue
+	protected    entryQueue
+	windowMax    int64
+	mainMax      int64
+	protectedMax int64
+}
+
+func newTinyLFUPolicy(capacity int64) *tinyLFUPolicy {
+	windowMax := max(capacity/100, 1)
+	mainMax := capacity - windowMax
+	return &tinyLFUPolicy{
+		sketch:       newFrequencySketch(int(min(max(capacity/tinyLFUAverageEntry, 1024), 1<<22))),
+		windowMax:    windowMax,
+		mainMax:      mainMax,
+		protectedMax: mainMax * 8 / 10,
+	}
+}
+
+func (p *tinyLFUPolicy) added(e *memoryEntry) {
+	p.sketch.increment(e.key)
+	p.window.pushFront(e, tinyLFUWindow)
+}
+
+func (p *tinyLFUPolicy) accessed(e *memoryEntry) {
+	p.sketch.increment(e.key)
+	switch e.queue {
+	case tinyLFUWindow:
+		p.window.moveToFront(e)
+	case tinyLFUProbation:
+		p.probation.remove(e)
+		p.protected.pushFront(e, tinyLFUProtected)
+		// Entries that do not fit into the protected segment get another chance in probation
+		for p.protected.bytes > p.protectedMax && p.protected.len() > 1 {
+			demoted := p.protected.back()
+			p.protected.remove(demoted)
+			p.probation.pushFront(demoted, tinyLFUProbation)
+		}
+	case tinyLFUProtected:
+		p.protected.moveToFront(e)
+	}
+}
+
+func (p *tinyLFUPolicy) removed(e *memoryEntry) {
+	p.queue(e.queue).remove(e)
+}
+
+func (p *tinyLFUPolicy) evict() (*memoryEntry, EvictionReason) {
+	for p.window.bytes > p.windowMax {
+		candidate := p.window.back()
+		p.window.remove(candidate)
+		p.probation.pushFront(candidate, tinyLFUProbation)
+		if p.probation.bytes+p.protected.bytes <= p.mainMax {
+			continue
+		}
+
+		victim := p.probation.back()
+		if victim == candidate {
+			victim = p.protected.back()
+		}
+		if victim == nil {
+			continue
+		}
+		if p.sketch.estimate(candidate.key) > p.sketch.estimate(victim.key) {
+			p.queue(victim.queue).remove(victim)
+			return victim, EvictionCapacity
+		}
+		p.probation.remove(candidate)
+		return candidate, EvictionAdmission
+	}
+
+	for _, q := range []*entryQueue{&p.probation, &p.protected, &p.window} {
+		if e := q.back(); e != nil {
+			q.remove(e)
+			return e, EvictionCapacity
+		}
+	}
+	return nil, EvictionCapacity
+}
+
+func (p *tinyLFUPolicy) queue(queue int) *entryQueue {
+	switch queue {
+	case tinyLFUWindow:
+		return &p.window
+	case tinyLFUProbation:
+		return &p.probation
+	}
+	return &p.protected
+}
+
+const (
+	s3FIFOSmall = iota // Entries inserted recently
+	s3FIFOMain         // Entries accessed while they were in the small queue, or seen again after their eviction
+)
+
+// s3FIFOMaxFreq caps the access count of an entry, so popular entries leave the main queue after a few rounds without access
+const s3FIFOMaxFreq = 3
+
+/*
+s3FIFOPolicy is S3-FIFO of Yang et al. New entries enter a small FIFO queue that takes a tenth of
+the capacity. Entries accessed while they are in the small queue move to the main FIFO queue when
+they reach its end, the others are evicted and their keys remembered in a ghost queue. Entries
+whose key is remembered are inserted into the main queue directly. Entries at the end of the main
+queue that were accessed are reinserted with a decremented access count.
+*/
+type s3FIFOPolicy struct {
+	small    entryQueue
+	main     entryQueue
+	ghosts   ghostQueue
+	smallMax int64
+	ghostMax int64
+}
+
+func (p *s3FIFOPolicy) added(e *memoryEntry) {
+	e.freq = 0
+	if p.ghosts.remove(e.key) {
+		p.main.pushFront(e, s3FIFOMain)
+		return
+	}
+	p.small.pushFront(e, s3FIFOSmall)
+}
+
+func (p *s3FIFOPolicy) accessed(e *memoryEntry) {
+	e.freq = min(e.freq+1, s3FIFOMaxFreq)
+}
+
+func (p *s3FIFOPolicy) removed(e *memoryEntry) {
+	if e.queue == s3FIFOSmall {
+		p.small.remove(e)
+	} else {
+		p.main.remove(e)
+	}
+}
+
+func (p *s3FIFOPolicy) evict() (*memoryEntry, EvictionReason) {
+	for {
+		if p.small.len() > 0 && (p.small.bytes > p.smallMax || p.main.len() == 0) {
+			e := p.small.back()
+			p.small.remove(e)
+			if e.freq > 0 {
+				e.freq = 0
+				p.main.pushFront(e, s3FIFOMain)
+				continue
+			}
+			p.ghosts.add(e.key, e.size)
+			p.ghosts.trim(p.ghostMax)
+			return e, EvictionCapacity
+		}
+
+		e := p.main.back()
+		if e == nil {
+			return nil, EvictionCapacity
+		}
+		p.main.remove(e)
+		if e.freq > 0 {
+			e.freq--
+			p.main.pushFront(e, s3FIFOMain)
+			continue
+		}
+		return e, EvictionCapacity
+	}
+}
@@ -1,8 +1,11 @@
 package cache
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"time"
 )
 
 // FakePasstroughCache is a dummy implementation of the Cache interface.
@@ -14,14 +17,27 @@ type FakePasstroughCache struct {
 }
 
 func (pc *FakePasstroughCache) Get(key string, initializer Initializer) (*Object, error) {
+	return pc.GetContext(context.Background(), key, withoutContext(initializer))
+}
+
+func (pc *FakePasstroughCache) GetContext(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	obj, exists := pc.get(key)
 	if !exists {
-		return pc.initialize(key, initializer)
+		return pc.initialize(ctx, key, initializer)
 	}
 
 	return obj, nil
 }
 
+func (pc *FakePasstroughCache) GetTimed(key string, initializer Initializer) (*Object, int64, int64, error) {
+	start := time.Now()
+	obj, err := pc.initialize(context.Background(), key, withoutContext(initializer))
+	return obj, 0, time.Since(start).Nanoseconds(), err
+}
+
 func (pc *FakePasstroughCache) Put(o *Object) error {
 	pc.put(o)
 
@@ -29,6 +45,40 @@ func (pc *FakePasstroughCache) Put(o *Object) error {
 
 }
 
+func (pc *FakePasstroughCache) PutContext(ctx context.Context, o *Object) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return pc.Put(o)
+}
+
+func (pc *FakePasstroughCache) Delete(key string) error {
+	return ErrCacheMiss
+}
+
+func (pc *FakePasstroughCache) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return pc.Delete(key)
+}
+
+func (pc *FakePasstroughCache) GetStream(ctx context.Context, key string) (io.ReadSeekCloser, *Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return nil, nil, ErrCacheMiss
+}
+
+// PutStream reads the body like a cache would, without storing it
+func (pc *FakePasstroughCache) PutStream(ctx context.Context, meta *Object, r io.Reader, size int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
 func (pc *FakePasstroughCache) get(key string) (*Object, bool) {
 	return nil, false
 }
@@ -36,7 +86,7 @@ func (pc *FakePasstroughCache) get(key string) (*Object, bool) {
 func (pc *FakePasstroughCache) put(o *Object) {
 }
 
-func (pc *FakePasstroughCache) initialize(key string, initializer Initializer) (*Object, error) {
+func (pc *FakePasstroughCache) initialize(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
 
 	data, exists := pc.get(key)
 	if exists {
@@ -45,7 +95,7 @@ func (pc *FakePasstroughCache) initialize(key string, initializer Initializer) (
 
 	if initializer != nil {
 
-		obj, err := initializer()
+		obj, err := initializer(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultFillTimeout is the time a caller waits by default for a fill that was started by another caller
+const DefaultFillTimeout = 30 * time.Second
+
+var ErrFillTimeout = errors.New("timed out waiting for object initialization")
+
+/*
+FlightGroup makes sure that only one initializer runs per key at a time. Callers that miss
+on a key while its initializer is running wait for it and share its result and error.
+The zero value is ready to use.
+*/
+type FlightGroup struct {
+	Timeout time.Duration // Maximum time to wait for a fill started by another caller, 0 means DefaultFillTimeout
+
+	calls map[string]*flight
+	lock  sync.Mutex
+}
+
+// flight is an initializer call in progress or completed
+type flight struct {
+	done   chan struct{}
+	obj    *Object
+	err    error
+	refs   int                // Callers still waiting for the result, guarded by the group lock
+	cancel context.CancelFunc // Cancels the context of the call
+}
+
+/*
+Do runs fn for the key, unless a call for the same key is already in flight. In that case Do
+waits for the running call and returns its result. A waiter that gives up after the timeout
+receives ErrFillTimeout, the running call is not affected and its result is still delivered
+to the other waiters.
+*/
+func (g *FlightGroup) Do(key string, fn func() (*Object, error)) (*Object, error) {
+	return g.DoContext(context.Background(), key, func(context.Context) (*Object, error) {
+		return fn()
+	})
+}
+
+/*
+DoContext is Do with a context. A waiter whose context is done stops waiting and receives the
+context error. The context passed to fn keeps the values of the caller that started the call,
+and is canceled once the contexts of this caller and of all waiters are done, so the call is only
+abandoned when no caller needs its result anymore. The caller that started the call always waits
+for fn to return.
+*/
+func (g *FlightGroup) DoContext(ctx context.Context, key string, fn func(ctx context.Context) (*Object, error)) (*Object, error) {
+
+	g.lock.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	if f, exists := g.calls[key]; exists {
+		f.refs++
+		g.lock.Unlock()
+		return g.wait(ctx, f)
+	}
+	callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	f := &flight{done: make(chan struct{}), refs: 1, cancel: cancel}
+	g.calls[key] = f
+	g.lock.Unlock()
+
+	stop := context.AfterFunc(ctx, func() {
+		g.release(f)
+	})
+	defer stop()
+
+	// Reported to the waiters if fn panics
+	f.err = ErrInitializer
+	defer g.finish(key, f)
+
+	f.obj, f.err = fn(callCtx)
+	return f.obj, f.err
+}
+
+func (g *FlightGroup) wait(ctx context.Context, f *flight) (*Object, error) {
+	timeout := g.Timeout
+	if timeout <= 0 {
+		timeout = DefaultFillTimeout
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-f.done:
+		return f.obj, f.err
+	case <-timer.C:
+		g.release(f)
+		return nil, ErrFillTimeout
+	case <-ctx.Done():
+		g.release(f)
+		return nil, ctx.Err()
+	}
+}
+
+// release removes a caller from the call and cancels the call when it was the last one
+func (g *FlightGroup) release(f *flight) {
+	g.lock.Lock()
+	f.refs--
+	last := f.refs == 0
+	g.lock.Unlock()
+	if last {
+		f.cancel()
+	}
+}
+
+func (g *FlightGroup) finish(key string, f *flight) {
+	g.lock.Lock()
+	delete(g.calls, key)
+	g.lock.Unlock()
+	f.cancel()
+	close(f.done)
+}
+
+/*
+initializeWith is the cache miss path of the cache backends. Concurrent misses on the same key share a
+single initializer call of flights. The call looks the key up again before it runs the initializer, since
+a fill that just ended may have stored the object, and stores the initialized object with put before the
+flight ends, so later misses find the object in the cache. A failing put is logged, unless the object
+was not admitted, the miss is still answered with the initialized object.
+*/
+func initializeWith(ctx context.Context, flights *FlightGroup, key string, lookup func(ctx context.Context) (*Object, error), put func(ctx context.Context, obj *Object) error, logger *log.Logger, initializer ContextInitializer) (*Object, error) {
+
+	if initializer == nil {
+		return nil, ErrInitializerNil
+	}
+
+	return flights.DoContext(ctx, key, func(ctx context.Context) (*Object, error) {
+
+		if obj, err := lookup(ctx); err == nil {
+			return obj, nil
+		}
+
+		obj, err := initializer(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := put(context.WithoutCancel(ctx), obj); err != nil && err != ErrNotAdmitted {
+			logger.Printf("Failed to store object %s: %v", obj.Key, err)
+		}
+		return obj, nil
+	})
+}
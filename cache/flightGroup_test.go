@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroup_Do(t *testing.T) {
+	group := &FlightGroup{}
+
+	data := []byte("testData")
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	fn := func() (*Object, error) {
+		calls.Add(1)
+		<-release
+		return &Object{Key: "testHost/testBucket/testKey", Data: &data}, nil
+	}
+
+	// Test case: Concurrent callers share a single call
+	var wg sync.WaitGroup
+	results := make(chan *Object, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			obj, err := group.Do("testHost/testBucket/testKey", fn)
+			if err != nil {
+				t.Errorf("Expected no error, but got %v", err)
+			}
+			results <- obj
+		}()
+	}
+
+	// Give the callers time to join the flight before it completes
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected 1 initializer call, but got %d", n)
+	}
+	for obj := range results {
+		if obj == nil || string(*obj.Data) != "testData" {
+			t.Errorf("Expected shared object with data 'testData', but got %v", obj)
+		}
+	}
+
+	// Test case: Completed flights are not reused
+	release = make(chan struct{})
+	close(release)
+	group.Do("testHost/testBucket/testKey", fn)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Expected 2 initializer calls, but got %d", n)
+	}
+}
+
+func TestFlightGroup_Do_Error(t *testing.T) {
+	group := &FlightGroup{}
+	initErr := errors.New("retrieval failed")
+	release := make(chan struct{})
+
+	fn := func() (*Object, error) {
+		<-release
+		return nil, initErr
+	}
+
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := group.Do("testHost/testBucket/testKey", fn)
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	// Test case: The error is shared by all waiters
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != initErr {
+			t.Errorf("Expected %v, but got %v", initErr, err)
+		}
+	}
+}
+
+func TestFlightGroup_Do_Timeout(t *testing.T) {
+	group := &FlightGroup{Timeout: 50 * time.Millisecond}
+	release := make(chan struct{})
+	data := []byte("testData")
+
+	fn := func() (*Object, error) {
+		<-release
+		return &Object{Key: "testHost/testBucket/testKey", Data: &data}, nil
+	}
+
+	leader := make(chan *Object)
+	go func() {
+		obj, _ := group.Do("testHost/testBucket/testKey", fn)
+		leader <- obj
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// Test case: Waiter gives up after the timeout
+	_, err := group.Do("testHost/testBucket/testKey", fn)
+	if err != ErrFillTimeout {
+		t.Errorf("Expected %v, but got %v", ErrFillTimeout, err)
+	}
+
+	// Test case: The fill continues after a waiter timed out
+	close(release)
+	if obj := <-leader; obj == nil || string(*obj.Data) != "testData" {
+		t.Errorf("Expected object with data 'testData', but got %v", obj)
+	}
+}
+
+func TestFlightGroup_DoContext(t *testing.T) {
+	group := &FlightGroup{}
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+
+	fn := func(ctx context.Context) (*Object, error) {
+		close(started)
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, err := group.DoContext(leaderCtx, "testHost/testBucket/testKey", fn)
+		leader <- err
+	}()
+	<-started
+
+	// Test case: A waiter stops waiting when its context is canceled
+	waiterCtx, cancelWaiter := context.WithCancel(context.Background())
+	waiter := make(chan error)
+	go func() {
+		_, err := group.DoContext(waiterCtx, "testHost/testBucket/testKey", fn)
+		waiter <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancelWaiter()
+	if err := <-waiter; err != context.Canceled {
+		t.Errorf("Expected %v, but got %v", context.Canceled, err)
+	}
+
+	// Test case: The call continues while a caller still waits for it
+	select {
+	case <-canceled:
+		t.Fatalf("Expected the call to continue, but it was canceled")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Test case: The call is canceled once no caller waits for it
+	cancelLeader()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the call to be canceled")
+	}
+	if err := <-leader; err != context.Canceled {
+		t.Errorf("Expected %v, but got %v", context.Canceled, err)
+	}
+}
+
+func TestDummyPrinterCache_Get_Coalescing(t *testing.T) {
+	cache := NewDummyPrinterCache(log.New(io.Discard, "", log.LstdFlags), 1024)
+
+	data := []byte("testData")
+	var calls atomic.Int32
+	initializer := func() (*Object, error) {
+		calls.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		return &Object{Key: "localhost/testBucket/testKey", Data: &data}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			obj, err := cache.Get("localhost/testBucket/testKey", initializer)
+			if err != nil || string(*obj.Data) != "testData" {
+				t.Errorf("Expected object with data 'testData', but got %v, %v", obj, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected 1 initializer call, but got %d", n)
+	}
+}
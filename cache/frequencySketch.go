@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"hash/maphash"
+	"math/bits"
+)
+
+const (
+	sketchDepth      = 4  // Rows of counters, every key has one counter per row
+	sketchMaxCount   = 15 // Counters saturate, only the order of the frequencies matters
+	sketchResetRatio = 10 // The counters are halved after this many increments per counter of a row
+)
+
+/*
+frequencySketch estimates how often keys were seen recently, in constant memory. It is a count-min
+sketch with small saturating counters behind a doorkeeper: the first occurrence of a key only sets
+its bits in the doorkeeper bloom filter, so keys that are seen once do not take up counters. After
+a number of increments proportional to its width the sketch ages, all counters are halved and the
+doorkeeper is cleared, so the estimates follow changes of the popular keys.
+
+The sketch is not safe for concurrent use.
+*/
+type frequencySketch struct {
+	rows       [sketchDepth][]uint8
+	doorkeeper []uint64
+	mask       uint64
+	additions  int
+	resetAt    int
+	seed       maphash.Seed
+}
+
+// newFrequencySketch creates a sketch with width counters per row, rounded up to a power of two
+func newFrequencySketch(width int) *frequencySketch {
+	width = 1 << bits.Len(uint(max(width, 64)-1))
+	s := &frequencySketch{
+		doorkeeper: make([]uint64, width/64),
+		mask:       uint64(width - 1),
+		resetAt:    width * sketchResetRatio,
+		seed:       maphash.MakeSeed(),
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// increment records an occurrence of the key
+func (s *frequencySketch) increment(key string) {
+	h := maphash.String(s.seed, key)
+	if !s.admitDoorkeeper(h) {
+		return
+	}
+
+	// Conservative update: only the counters at the minimum are incremented
+	minimum := s.count(h)
+	if minimum < sketchMaxCount {
+		for i := range s.rows {
+			if c := &s.rows[i][s.index(h, i)]; *c == minimum {
+				*c++
+			}
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.reset()
+	}
+}
+
+// estimate returns how often the key was seen since the sketch last aged, at most sketchMaxCount + 1
+func (s *frequencySketch) estimate(key string) int {
+	h := maphash.String(s.seed, key)
+	n := int(s.count(h))
+	if s.inDoorkeeper(h) {
+		n++
+	}
+	return n
+}
+
+// reset halves all counters and clears the doorkeeper
+func (s *frequencySketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	clear(s.doorkeeper)
+	s.additions /= 2
+}
+
+func (s *frequencySketch) count(h uint64) uint8 {
+	minimum := uint8(sketchMaxCount)
+	for i := range s.rows {
+		minimum = min(minimum, s.rows[i][s.index(h, i)])
+	}
+	return minimum
+}
+
+// index derives the counter of the key in a row by double hashing
+func (s *frequencySketch) index(h uint64, row int) uint64 {
+	h2 := bits.RotateLeft64(h, 32)*0x9e3779b97f4a7c15 | 1
+	return (h + uint64(row)*h2) & s.mask
+}
+
+// admitDoorkeeper sets the bits of the key in the doorkeeper and reports whether they were all set already
+func (s *frequencySketch) admitDoorkeeper(h uint64) bool {
+	seen := true
+	for _, bit := range s.doorkeeperBits(h) {
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if s.doorkeeper[word]&mask == 0 {
+			seen = false
+			s.doorkeeper[word] |= mask
+		}
+	}
+	return seen
+}
+
+func (s *frequencySketch) inDoorkeeper(h uint64) bool {
+	for _, bit := range s.doorkeeperBits(h) {
+		if s.doorkeeper[bit/64]&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *frequencySketch) doorkeeperBits(h uint64) [2]uint64 {
+	return [2]uint64{h & s.mask, (h >> 32) & s.mask}
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// Points a node of weight 1 gets on the ring, the number libketama uses
+const ketamaPointsPerWeight = 160
+
+/*
+hashRing maps keys to nodes with consistent hashing as done by ketama. Every node gets points on
+a ring of 32 bit hashes in proportion to its weight, and a key belongs to the node of the first
+point at or after the hash of the key. Adding or removing a node only moves the keys of its
+points, about 1/n of all keys, while modulo hashing moves almost all of them.
+*/
+type hashRing struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash uint32
+	node int
+}
+
+/*
+newHashRing places the nodes with the given names and weights on a ring, the nodes are referred to
+by their index. Weights below 1 count as 1.
+*/
+func newHashRing(names []string, weights []int) *hashRing {
+	r := &hashRing{}
+	for node, name := range names {
+		weight := max(weights[node], 1)
+		// Every digest gives 4 points
+		for i := 0; i < ketamaPointsPerWeight/4*weight; i++ {
+			digest := md5.Sum([]byte(name + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				r.points = append(r.points, ringPoint{hash: binary.LittleEndian.Uint32(digest[j*4:]), node: node})
+			}
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].node < r.points[j].node
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+/*
+lookup returns the node of the key, skipping the nodes for which usable returns false. The keys of
+a skipped node move to the nodes that follow its points, the keys of the other nodes stay where
+they are. ok is false if no node is usable.
+*/
+func (r *hashRing) lookup(key string, usable func(node int) bool) (node int, ok bool) {
+	if len(r.points) == 0 {
+		return 0, false
+	}
+	digest := md5.Sum([]byte(key))
+	hash := binary.LittleEndian.Uint32(digest[:])
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+
+	var skipped map[int]bool
+	for i := 0; i < len(r.points); i++ {
+		node := r.points[(start+i)%len(r.points)].node
+		if skipped[node] {
+			continue
+		}
+		if usable == nil || usable(node) {
+			return node, true
+		}
+		if skipped == nil {
+			skipped = map[int]bool{}
+		}
+		skipped[node] = true
+	}
+	return 0, false
+}
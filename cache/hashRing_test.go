@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	names := []string{"node1:11211", "node2:11211", "node3:11211", "node4:11211"}
+	ring := newHashRing(names, []int{1, 1, 1, 3})
+
+	keys := make([]string, 10000)
+	owners := make([]int, len(keys))
+	counts := make([]int, len(names))
+	for i := range keys {
+		keys[i] = fmt.Sprintf("localhost/testBucket/key%d", i)
+		node, ok := ring.lookup(keys[i], nil)
+		if !ok {
+			t.Fatalf("Expected a node for %s", keys[i])
+		}
+		owners[i] = node
+		counts[node]++
+	}
+
+	// Test case: Keys are spread in proportion to the weights
+	for node, count := range counts {
+		expected := len(keys) / 6
+		if node == 3 {
+			expected *= 3
+		}
+		if count < expected*8/10 || count > expected*12/10 {
+			t.Errorf("Expected about %d keys on %s, but got %d", expected, names[node], count)
+		}
+	}
+
+	// Test case: Skipping a node only moves its own keys
+	for i, key := range keys {
+		node, _ := ring.lookup(key, func(node int) bool { return node != 1 })
+		if owners[i] != 1 && node != owners[i] {
+			t.Fatalf("Expected %s to stay on %s, but it moved to %s", key, names[owners[i]], names[node])
+		}
+		if node == 1 {
+			t.Fatalf("Expected %s to leave the skipped node", key)
+		}
+	}
+
+	// Test case: Removing a node moves about its share of the keys, not all of them
+	smaller := newHashRing(names[:3], []int{1, 1, 1})
+	moved := 0
+	for i, key := range keys {
+		if node, _ := smaller.lookup(key, nil); node != owners[i] {
+			moved++
+		}
+	}
+	if moved != counts[3] {
+		t.Errorf("Expected %d moved keys, but got %d", counts[3], moved)
+	}
+
+	// Test case: No usable node
+	if _, ok := ring.lookup(keys[0], func(int) bool { return false }); ok {
+		t.Errorf("Expected no node when all nodes are skipped")
+	}
+	if _, ok := newHashRing(nil, nil).lookup(keys[0], nil); ok {
+		t.Errorf("Expected no node on an empty ring")
+	}
+}
@@ -1,9 +1,10 @@
 package cache
 
 import (
-	"bytes"
-	"encoding/gob"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"strings"
 	"time"
@@ -11,10 +12,28 @@ import (
 	"github.com/bradfitz/gomemcache/memcache"
 )
 
+// Longest expiration memcached accepts in seconds, larger values are taken as Unix times
+const memcachedMaxRelativeTTL = 30 * 24 * 60 * 60
+
+/*
+MemcachedClient stores objects in memcached. Objects with an expiry are stored with it as their
+expiration, the others with the default TTL.
+
+Keys are distributed over the servers with a consistent-hash ring, see hashRing, so adding or
+losing a server only moves its share of the keys. A server that fails FailureLimit requests in a
+row is ejected from the ring and its keys go to the next servers, until a probe after
+RetryInterval finds it reachable again.
+*/
 type MemcachedClient struct {
-	client *memcache.Client
-	ttl    int32
-	logger *log.Logger
+	Clock         Clock         // Time from which the expiration of objects and the ejection of nodes is derived
+	FailureLimit  int           // Consecutive failures after which a node is ejected, 0 means DefaultMemcachedFailureLimit
+	RetryInterval time.Duration // Time an ejected node stays out of the ring before it is probed, 0 means DefaultMemcachedRetryInterval
+
+	nodes   []*memcachedNode
+	ring    *hashRing
+	ttl     int32
+	logger  *log.Logger
+	flights FlightGroup
 }
 
 /*
@@ -22,20 +41,48 @@ Creates a new MemcachedClient with the given logger, default TTL and server addr
 defaultTTL is expressed in seconds (max 1 month), or an absolute time in UNIX ecpoch.
 */
 func NewMemcachedClient(logger *log.Logger, defaultTTL int32, server ...string) *MemcachedClient {
-	return &MemcachedClient{
-		client: memcache.New(server...),
+	servers := make([]MemcachedServer, len(server))
+	for i, addr := range server {
+		servers[i] = MemcachedServer{Addr: addr, Weight: 1}
+	}
+	return NewWeightedMemcachedClient(logger, defaultTTL, servers...)
+}
+
+// NewWeightedMemcachedClient creates a MemcachedClient over servers of different weights, weights below 1 count as 1
+func NewWeightedMemcachedClient(logger *log.Logger, defaultTTL int32, servers ...MemcachedServer) *MemcachedClient {
+	mw := &MemcachedClient{
 		ttl:    defaultTTL,
 		logger: logger,
 	}
+	names := make([]string, len(servers))
+	weights := make([]int, len(servers))
+	for i, server := range servers {
+		server.Weight = max(server.Weight, 1)
+		mw.nodes = append(mw.nodes, newMemcachedNode(server))
+		names[i], weights[i] = server.Addr, server.Weight
+	}
+	mw.ring = newHashRing(names, weights)
+	return mw
 }
 
 func (mw *MemcachedClient) Get(key string, initializer Initializer) (*Object, error) {
+	return mw.GetContext(context.Background(), key, withoutContext(initializer))
+}
 
-	obj, err := mw.get(key)
+func (mw *MemcachedClient) GetContext(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+
+	var obj *Object
+	err := call(ctx, func() (err error) {
+		obj, err = mw.get(key)
+		return err
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 
 	if err != nil {
 
-		return mw.initialize(key, initializer)
+		return mw.initialize(ctx, key, initializer)
 
 	}
 	return obj, nil
@@ -49,7 +96,7 @@ func (mw *MemcachedClient) GetTimed(key string, initializer Initializer) (*Objec
 	if err != nil {
 		//object not found
 		start := time.Now()
-		obj, err := mw.initialize(key, initializer)
+		obj, err := mw.initialize(context.Background(), key, withoutContext(initializer))
 		initElapsed := time.Since(start).Nanoseconds()
 		return obj, elapsed, initElapsed, err
 	}
@@ -60,12 +107,26 @@ func (mw *MemcachedClient) Put(obj *Object) error {
 	return mw.set(obj)
 }
 
+func (mw *MemcachedClient) PutContext(ctx context.Context, obj *Object) error {
+	return call(ctx, func() error {
+		return mw.set(obj)
+	})
+}
+
 func (mw *MemcachedClient) Delete(key string) error {
+	return mw.DeleteContext(context.Background(), key)
+}
+
+func (mw *MemcachedClient) DeleteContext(ctx context.Context, key string) error {
 
 	if key == "" || len(strings.Split(key, "/")) < 3 {
 		return ErrInvalidKey
 	}
-	err := mw.client.Delete(key)
+	err := call(ctx, func() error {
+		return mw.do(key, func(c *memcache.Client) error {
+			return c.Delete(key)
+		})
+	})
 	if err == memcache.ErrCacheMiss {
 		return ErrCacheMiss
 	}
@@ -75,12 +136,101 @@ func (mw *MemcachedClient) Delete(key string) error {
 	return nil
 }
 
+func (mw *MemcachedClient) GetStream(ctx context.Context, key string) (io.ReadSeekCloser, *Object, error) {
+	var obj *Object
+	err := call(ctx, func() (err error) {
+		obj, err = mw.get(key)
+		return err
+	})
+	// Entries that cannot be decoded, for example written by an earlier version, are misses
+	if err == memcache.ErrCacheMiss || errors.Is(err, ErrDeserialization) {
+		return nil, nil, ErrCacheMiss
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	body, meta := newStreamedObject(obj)
+	return body, meta, nil
+}
+
+/*
+PutStream stores an object with the body read from r. Memcached stores items as a whole, so the
+body is read completely before the object is stored.
+*/
+func (mw *MemcachedClient) PutStream(ctx context.Context, meta *Object, r io.Reader, size int64) error {
+	obj, err := readStreamedObject(meta, r, size)
+	if err != nil {
+		return err
+	}
+	return mw.PutContext(ctx, obj)
+}
+
+// Flush removes all items from the servers, including ejected ones
 func (mw *MemcachedClient) Flush() error {
-	return mw.client.FlushAll()
+	var errs []error
+	for _, n := range mw.nodes {
+		if err := n.client.FlushAll(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", n.Addr, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
+// TestConnection checks that every server is reachable
 func (mw *MemcachedClient) TestConnection() error {
-	return mw.client.Ping()
+	var errs []error
+	for _, n := range mw.nodes {
+		if err := n.client.Ping(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", n.Addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Stats returns the requests and ejections of every server
+func (mw *MemcachedClient) Stats() []MemcachedNodeStats {
+	stats := make([]MemcachedNodeStats, len(mw.nodes))
+	for i, n := range mw.nodes {
+		stats[i] = n.stats()
+	}
+	return stats
+}
+
+// node returns the server of the key on the ring, or memcache.ErrNoServers if all servers are ejected
+func (mw *MemcachedClient) node(key string) (*memcachedNode, error) {
+	now := mw.Clock.now()
+	i, ok := mw.ring.lookup(key, func(i int) bool {
+		return mw.nodes[i].available(mw, now)
+	})
+	if !ok {
+		return nil, memcache.ErrNoServers
+	}
+	return mw.nodes[i], nil
+}
+
+// do runs a request for the key on its server and records the result for the health of the server
+func (mw *MemcachedClient) do(key string, request func(c *memcache.Client) error) error {
+	n, err := mw.node(key)
+	if err != nil {
+		return err
+	}
+	err = request(n.client)
+	n.record(mw, err)
+	return err
+}
+
+func (mw *MemcachedClient) failureLimit() int {
+	if mw.FailureLimit <= 0 {
+		return DefaultMemcachedFailureLimit
+	}
+	return mw.FailureLimit
+}
+
+func (mw *MemcachedClient) retryInterval() time.Duration {
+	if mw.RetryInterval <= 0 {
+		return DefaultMemcachedRetryInterval
+	}
+	return mw.RetryInterval
 }
 
 func (mw *MemcachedClient) set(obj *Object) error {
@@ -95,84 +245,132 @@ func (mw *MemcachedClient) set(obj *Object) error {
 		return ErrDataNil
 	}
 
+	expiration, expired := mw.expiration(obj)
+	if expired {
+		// An expiration of 0 seconds would keep the item forever
+		return nil
+	}
+
 	serialized, err := mw.serializeObj(*obj)
 	if err != nil {
 		return fmt.Errorf("%v: %w", ErrSerialization, err)
 	}
 
-	return mw.client.Set(&memcache.Item{
-		Key:        obj.Key,
-		Value:      serialized,
-		Expiration: mw.ttl,
+	return mw.do(obj.Key, func(c *memcache.Client) error {
+		return c.Set(&memcache.Item{
+			Key:        obj.Key,
+			Value:      serialized,
+			Expiration: expiration,
+		})
 	})
 }
 
+/*
+expiration returns the memcached expiration of an object: the default TTL, or the seconds until the
+object expires, or the Unix time it expires if that is further away than memcached accepts as
+seconds. expired is set if the object expires within the next second.
+*/
+func (mw *MemcachedClient) expiration(obj *Object) (int32, bool) {
+	if obj.ExpiresAt.IsZero() {
+		return mw.ttl, false
+	}
+	ttl := obj.ExpiresAt.Sub(mw.Clock.now())
+	if ttl < time.Second {
+		return 0, true
+	}
+	if ttl > memcachedMaxRelativeTTL*time.Second {
+		return int32(obj.ExpiresAt.Unix()), false
+	}
+	return int32(ttl / time.Second), false
+}
+
 func (mw *MemcachedClient) get(key string) (*Object, error) {
 
 	if key == "" || len(strings.Split(key, "/")) < 3 {
 		return nil, ErrInvalidKey
 	}
 
-	serialized, err := mw.client.Get(key)
-
+	n, err := mw.node(key)
+	if err != nil {
+		return nil, err
+	}
+	serialized, err := n.client.Get(key)
+	n.record(mw, err)
+	if err == memcache.ErrCacheMiss {
+		n.misses.Add(1)
+	}
 	if err != nil {
 		return nil, err
 	}
+	n.hits.Add(1)
 
 	obj, err := mw.deserializeObj(serialized.Value)
 	if err != nil {
-		return nil, fmt.Errorf("%v: %w", ErrDeserialization, err)
+		return nil, fmt.Errorf("%w: %w", ErrDeserialization, err)
+	}
+	// Memcached expires items with a resolution of seconds
+	if obj.IsExpired(mw.Clock.now()) {
+		return nil, memcache.ErrCacheMiss
 	}
 
 	return &obj, nil
 }
 
-func (mw *MemcachedClient) initialize(key string, initializer Initializer) (*Object, error) {
+func (mw *MemcachedClient) initialize(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
 
 	if initializer == nil {
 		return nil, ErrInitializerNil
 	}
 
-	// double check if the object was not initialized by another goroutine
-	obj, err := mw.get(key)
-
-	if err != nil {
-
-		// Initialize the object
-		obj, err := initializer()
+	lookup := func(ctx context.Context) (*Object, error) {
+		return mw.get(key)
+	}
+	put := func(ctx context.Context, obj *Object) error {
+		return mw.set(obj)
+	}
+	return initializeWith(ctx, &mw.flights, key, lookup, put, mw.logger, func(ctx context.Context) (*Object, error) {
+		obj, err := initializer(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("%v: %w", ErrInitializer, err)
 		}
-
-		err = mw.set(obj)
-		if err != nil {
-			return nil, err
-		}
 		return obj, nil
+	})
+}
+
+/*
+call runs a memcached operation and returns early with the context error when the context is done.
+The client does not support contexts, so the operation itself continues in the background until it
+completes or the timeout of the client expires.
+*/
+func call(ctx context.Context, op func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return op()
 	}
 
-	return obj, nil
+	result := make(chan error, 1)
+	go func() {
+		result <- op()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (bw *MemcachedClient) serializeObj(o Object) ([]byte, error) {
-	b := bytes.Buffer{}
-	e := gob.NewEncoder(&b)
-	err := e.Encode(o)
-	if err != nil {
-		return nil, err
-	}
-	return b.Bytes(), nil
-
+	return encodeObject(&o), nil
 }
 
+// deserializeObj returns ErrObjectFormat for entries written in another format, which are treated as misses
 func (bw *MemcachedClient) deserializeObj(serialized []byte) (Object, error) {
-	o := Object{}
-	b := bytes.Buffer{}
-	b.Write(serialized)
-	d := gob.NewDecoder(&b)
-	err := d.Decode(&o)
+	o, err := decodeObject(serialized)
 	if err != nil {
 		return Object{}, err
 	}
-	return o, nil
+	return *o, nil
 }
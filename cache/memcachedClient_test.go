@@ -1,12 +1,18 @@
 package cache
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/daangn/minimemcached"
 )
 
@@ -37,7 +43,7 @@ func TestInitialize(t *testing.T) {
 	}
 
 	// Test case: Object is not in cache and needs to be initialized
-	obj, err := memcachedClient.initialize("testKey", initializer)
+	obj, err := memcachedClient.initialize(context.Background(), "testKey", withoutContext(initializer))
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -49,7 +55,7 @@ func TestInitialize(t *testing.T) {
 	}
 
 	// Test case: Object is already in cache
-	obj, err = memcachedClient.initialize("testKey", initializer)
+	obj, err = memcachedClient.initialize(context.Background(), "testKey", withoutContext(initializer))
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -61,13 +67,13 @@ func TestInitialize(t *testing.T) {
 	errorInitializer := func() (*Object, error) {
 		return nil, ErrInitializer
 	}
-	_, err = memcachedClient.initialize("errorKey", errorInitializer)
+	_, err = memcachedClient.initialize(context.Background(), "errorKey", withoutContext(errorInitializer))
 	if err == nil || errors.Unwrap(err) != ErrInitializer {
 		t.Errorf("Expected 'initializer error', got %v", err)
 	}
 
 	// Test case :Initializer is nil
-	_, err = memcachedClient.initialize("nilKey", nil)
+	_, err = memcachedClient.initialize(context.Background(), "nilKey", withoutContext(nil))
 	if err == nil || err != ErrInitializerNil {
 		t.Errorf("Expected 'initializer is nil', got %v", err)
 	}
@@ -264,6 +270,54 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestExpiration(t *testing.T) {
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	memcachedClient := NewMemcachedClient(logger, 120, "localhost:11212")
+	memcachedClient.Clock = clock.Now
+
+	// Test case: Objects without expiry get the default TTL, the others their remaining time or expiry time
+	for _, test := range []struct {
+		expiresAt  time.Time
+		expiration int32
+		expired    bool
+	}{
+		{time.Time{}, 120, false},
+		{clock.now.Add(90 * time.Second), 90, false},
+		{clock.now.Add(60 * 24 * time.Hour), int32(clock.now.Add(60 * 24 * time.Hour).Unix()), false},
+		{clock.now.Add(time.Millisecond), 0, true},
+		{clock.now.Add(-time.Hour), 0, true},
+	} {
+		expiration, expired := memcachedClient.expiration(&Object{ExpiresAt: test.expiresAt})
+		if expiration != test.expiration || expired != test.expired {
+			t.Errorf("Expected expiration %d and expired %v, got %d and %v", test.expiration, test.expired, expiration, expired)
+		}
+	}
+
+	cfg := &minimemcached.Config{
+		Port: 11212,
+	}
+	mockMemcached, err := minimemcached.Run(cfg)
+	if err != nil {
+		t.Fatalf("Failed to start minimemcached: %v", err)
+	}
+	defer mockMemcached.Close()
+
+	// Test case: Expired objects are misses, even before memcached removes them
+	testData := []byte("testData")
+	err = memcachedClient.Put(&Object{Key: "testHost/testBucket/testKey", Data: &testData, ExpiresAt: clock.now.Add(time.Minute)})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := memcachedClient.Get("testHost/testBucket/testKey", nil); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if _, _, err := memcachedClient.GetStream(context.Background(), "testHost/testBucket/testKey"); err != ErrCacheMiss {
+		t.Errorf("Expected %v, got %v", ErrCacheMiss, err)
+	}
+}
+
 // func TestTestConnection(t *testing.T) {
 // 	cfg := &minimemcached.Config{
 // 		Port: 11212,
@@ -295,3 +349,163 @@ func TestDelete(t *testing.T) {
 // 		t.Errorf("Expected error, got nil")
 // 	}
 // }
+
+func TestCluster(t *testing.T) {
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+
+	// The third node is down until it is started later
+	ports := []uint16{0, 0, freePort(t)}
+	var servers []*minimemcached.MiniMemcached
+	defer func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	}()
+	for i := range ports[:2] {
+		server, err := minimemcached.Run(&minimemcached.Config{Port: ports[i]})
+		if err != nil {
+			t.Fatalf("Failed to start minimemcached: %v", err)
+		}
+		ports[i] = server.Port()
+		servers = append(servers, server)
+	}
+
+	memcachedClient := NewWeightedMemcachedClient(logger, 120,
+		MemcachedServer{Addr: fmt.Sprintf("localhost:%d", ports[0]), Weight: 1},
+		MemcachedServer{Addr: fmt.Sprintf("localhost:%d", ports[1]), Weight: 1},
+		MemcachedServer{Addr: fmt.Sprintf("localhost:%d", ports[2]), Weight: 2},
+	)
+	memcachedClient.Clock = clock.Now
+	memcachedClient.FailureLimit = 2
+	memcachedClient.RetryInterval = time.Minute
+
+	keys := make([]string, 200)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("testHost/testBucket/key%d", i)
+	}
+	owner := func(key string) int {
+		node, _ := memcachedClient.ring.lookup(key, nil)
+		return node
+	}
+
+	// Test case: A failing node is ejected, its keys move to the other nodes and the others stay
+	failed := 0
+	for _, key := range keys {
+		err := memcachedClient.Put(newClusterObject(key))
+		if err != nil && owner(key) != 2 {
+			t.Fatalf("Expected no error for a key of a healthy node, got %v", err)
+		}
+		if err != nil {
+			failed++
+		}
+	}
+	stats := memcachedClient.Stats()
+	if failed != 2 || !stats[2].Ejected || stats[2].Ejections != 1 || stats[2].Errors != 2 {
+		t.Fatalf("Expected the node to be ejected after 2 errors, got %d errors and %+v", failed, stats[2])
+	}
+	for _, key := range keys {
+		if _, err := memcachedClient.Get(key, nil); err != nil && owner(key) != 2 {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	}
+	if stats := memcachedClient.Stats(); stats[0].Hits+stats[1].Hits != uint64(len(keys)-failed) {
+		t.Errorf("Expected %d hits on the healthy nodes, got %+v", len(keys)-failed, stats)
+	}
+
+	// Test case: All nodes ejected
+	down := NewMemcachedClient(logger, 120, fmt.Sprintf("localhost:%d", freePort(t)))
+	down.FailureLimit = 1
+	down.Get(keys[0], nil)
+	if _, err := down.get(keys[0]); err != memcache.ErrNoServers {
+		t.Errorf("Expected %v, got %v", memcache.ErrNoServers, err)
+	}
+
+	// Test case: The node is probed after the retry interval and reinserted once it answers
+	server, err := minimemcached.Run(&minimemcached.Config{Port: ports[2]})
+	if err != nil {
+		t.Fatalf("Failed to start minimemcached: %v", err)
+	}
+	servers = append(servers, server)
+	clock.now = clock.now.Add(time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for memcachedClient.Stats()[2].Ejected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the node to be reinserted")
+		}
+		for _, key := range keys {
+			if owner(key) == 2 {
+				memcachedClient.Get(key, nil)
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Test case: Objects are spread over all nodes, the heavier node gets more of them
+	for _, key := range keys {
+		if err := memcachedClient.Put(newClusterObject(key)); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	before := memcachedClient.Stats()
+	for _, key := range keys {
+		if _, err := memcachedClient.Get(key, nil); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	stats = memcachedClient.Stats()
+	hits := make([]uint64, len(stats))
+	for i := range stats {
+		hits[i] = stats[i].Hits - before[i].Hits
+	}
+	if hits[0] == 0 || hits[1] == 0 || hits[2] <= hits[0] || hits[2] <= hits[1] {
+		t.Errorf("Expected hits on all nodes and most on the heaviest, got %v", hits)
+	}
+	if total := hits[0] + hits[1] + hits[2]; total != uint64(len(keys)) {
+		t.Errorf("Expected %d hits, got %d", len(keys), total)
+	}
+}
+
+func TestNewlineValues(t *testing.T) {
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	server, err := minimemcached.Run(&minimemcached.Config{Port: 0})
+	if err != nil {
+		t.Fatalf("Failed to start minimemcached: %v", err)
+	}
+	defer server.Close()
+	memcachedClient := NewMemcachedClient(logger, 120, fmt.Sprintf("localhost:%d", server.Port()))
+
+	// Test case: minimemcached rejects values with a newline, which memcached stores by their length.
+	// Once this fails, newClusterObject is no longer needed.
+	data := []byte("test\nData")
+	if err := memcachedClient.Put(&Object{Key: "testHost/testBucket/newline", Data: &data}); err == nil {
+		t.Errorf("Expected minimemcached to reject a value with a newline")
+	}
+}
+
+/*
+newClusterObject returns an object whose encoding contains no newline. minimemcached reads the
+values of set commands up to the next newline instead of by their length, so it rejects values
+with a newline, see TestNewlineValues. The client sends values as memcached expects them, the
+checksum and lengths of the encoding make a newline depend on the key.
+*/
+func newClusterObject(key string) *Object {
+	for i := 0; ; i++ {
+		data := []byte(fmt.Sprintf("testData%d", i))
+		obj := &Object{Key: key, Data: &data}
+		if !bytes.Contains(encodeObject(obj), []byte("\n")) {
+			return obj
+		}
+	}
+}
+
+// freePort returns a port nothing listens on, for a node that is started later or never
+func freePort(t *testing.T) uint16 {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
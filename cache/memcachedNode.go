@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	DefaultMemcachedFailureLimit  = 3                // Consecutive failures after which a node is ejected
+	DefaultMemcachedRetryInterval = 30 * time.Second // Time an ejected node stays out of the ring before it is probed
+)
+
+// MemcachedServer is a memcached node and its weight, a node of weight 2 gets twice the keys of a node of weight 1
+type MemcachedServer struct {
+	Addr   string
+	Weight int
+}
+
+// MemcachedNodeStats counts the requests to a memcached node and its ejections from the ring
+type MemcachedNodeStats struct {
+	Addr      string
+	Weight    int
+	Hits      uint64
+	Misses    uint64
+	Errors    uint64 // Requests that failed because the node was unreachable or did not answer
+	Ejections uint64
+	Ejected   bool
+}
+
+/*
+memcachedNode is a server of a MemcachedClient with its own connections. After a number of
+consecutive failures it is ejected, so its keys go to the next nodes on the ring instead of waiting
+for the timeout on every request. Once the retry interval has passed, the next request that would
+go to the node probes it in the background, and the node is reinserted if it answers.
+*/
+type memcachedNode struct {
+	MemcachedServer
+	client *memcache.Client
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	errors    atomic.Uint64
+	ejections atomic.Uint64
+
+	lock         sync.Mutex
+	failures     int       // Consecutive failures
+	ejectedUntil time.Time // Zero while the node is in the ring
+	probing      bool
+}
+
+func newMemcachedNode(server MemcachedServer) *memcachedNode {
+	return &memcachedNode{MemcachedServer: server, client: memcache.New(server.Addr)}
+}
+
+/*
+available reports if requests can go to the node. It starts a probe of an ejected node once its
+retry interval has passed, the node stays unavailable until the probe succeeds.
+*/
+func (n *memcachedNode) available(mw *MemcachedClient, now time.Time) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.ejectedUntil.IsZero() {
+		return true
+	}
+	if !n.probing && !now.Before(n.ejectedUntil) {
+		n.probing = true
+		go n.probe(mw)
+	}
+	return false
+}
+
+func (n *memcachedNode) probe(mw *MemcachedClient) {
+	err := n.client.Ping()
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.probing = false
+	if err != nil {
+		n.ejectedUntil = mw.Clock.now().Add(mw.retryInterval())
+		return
+	}
+	n.ejectedUntil = time.Time{}
+	n.failures = 0
+	mw.logger.Printf("Memcached node %s is reachable again, reinserting it", n.Addr)
+}
+
+// record counts the result of a request, failures of the node itself can eject it
+func (n *memcachedNode) record(mw *MemcachedClient, err error) {
+	failed := isNodeFailure(err)
+	if failed {
+		n.errors.Add(1)
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if !failed {
+		n.failures = 0
+		return
+	}
+	n.failures++
+	if n.failures >= mw.failureLimit() && n.ejectedUntil.IsZero() {
+		n.ejectedUntil = mw.Clock.now().Add(mw.retryInterval())
+		n.ejections.Add(1)
+		mw.logger.Printf("Warning: ejecting memcached node %s after %d failures: %v", n.Addr, n.failures, err)
+	}
+}
+
+func (n *memcachedNode) stats() MemcachedNodeStats {
+	n.lock.Lock()
+	ejected := !n.ejectedUntil.IsZero()
+	n.lock.Unlock()
+	return MemcachedNodeStats{
+		Addr:      n.Addr,
+		Weight:    n.Weight,
+		Hits:      n.hits.Load(),
+		Misses:    n.misses.Load(),
+		Errors:    n.errors.Load(),
+		Ejections: n.ejections.Load(),
+		Ejected:   ejected,
+	}
+}
+
+/*
+isNodeFailure reports if an error means the node could not be reached or did not answer. Misses
+and errors the node answered with, like rejected items, say nothing about its health.
+*/
+func isNodeFailure(err error) bool {
+	var netErr net.Error
+	var timeoutErr *memcache.ConnectTimeoutError
+	return errors.As(err, &netErr) || errors.As(err, &timeoutErr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,294 @@
+package cache
+
+import (
+	"context"
+	"hash/maphash"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMemoryShards is the number of shards of a MemoryCache large enough to be split
+	DefaultMemoryShards = 16
+	// minShardBytes is the smallest budget of a shard, smaller caches have fewer shards
+	minShardBytes = 4 << 20
+	// memoryEntryOverhead approximates the memory taken by an entry besides its key, headers and body
+	memoryEntryOverhead = 128
+)
+
+/*
+MemoryCache keeps objects in memory within a byte budget and evicts them with a selectable policy.
+The keys are split over shards with a lock, a budget and a policy each, so concurrent requests for
+different keys rarely wait for each other. Objects are stored as they are passed to Put and
+returned as they are, they must not be modified afterwards. Expired objects are removed when they
+are looked up.
+*/
+type MemoryCache struct {
+	Clock Clock // Time against which the expiry of objects is checked
+
+	shards  []*memoryShard
+	seed    maphash.Seed
+	logger  *log.Logger
+	flights FlightGroup
+}
+
+type memoryShard struct {
+	entries  map[string]*memoryEntry
+	policy   evictionPolicy
+	size     int64
+	maxBytes int64
+	stats    MemoryCacheStats
+	lock     sync.Mutex
+}
+
+// MemoryCacheStats counts the lookups and evictions of a MemoryCache
+type MemoryCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions map[EvictionReason]uint64
+	Entries   int
+	Bytes     int64
+}
+
+/*
+NewMemoryCache creates a cache whose objects take at most maxBytes, evicted with the given policy.
+*/
+func NewMemoryCache(logger *log.Logger, maxBytes int64, policy EvictionPolicy) (*MemoryCache, error) {
+	shards := DefaultMemoryShards
+	for shards > 1 && maxBytes/int64(shards) < minShardBytes {
+		shards /= 2
+	}
+
+	mc := &MemoryCache{seed: maphash.MakeSeed(), logger: logger}
+	for i := 0; i < shards; i++ {
+		p, err := newEvictionPolicy(policy, maxBytes/int64(shards))
+		if err != nil {
+			return nil, err
+		}
+		mc.shards = append(mc.shards, &memoryShard{
+			entries:  make(map[string]*memoryEntry),
+			policy:   p,
+			maxBytes: maxBytes / int64(shards),
+			stats:    MemoryCacheStats{Evictions: make(map[EvictionReason]uint64)},
+		})
+	}
+	return mc, nil
+}
+
+func (mc *MemoryCache) Get(key string, initializer Initializer) (*Object, error) {
+	return mc.GetContext(context.Background(), key, withoutContext(initializer))
+}
+
+func (mc *MemoryCache) GetContext(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	obj, exists := mc.shard(key).get(key, mc.Clock.now())
+	if !exists {
+		return mc.initialize(ctx, key, initializer)
+	}
+	return obj, nil
+}
+
+func (mc *MemoryCache) GetTimed(key string, initializer Initializer) (*Object, int64, int64, error) {
+	start := time.Now()
+	obj, exists := mc.shard(key).get(key, mc.Clock.now())
+	elapsed := time.Since(start).Nanoseconds()
+
+	if !exists {
+		start := time.Now()
+		obj, err := mc.initialize(context.Background(), key, withoutContext(initializer))
+		initElapsed := time.Since(start).Nanoseconds()
+		return obj, elapsed, initElapsed, err
+	}
+	return obj, elapsed, 0, nil
+}
+
+/*
+Put stores the object and evicts other objects if it does not fit into the budget of the shard of its key.
+ErrEntryTooLarge is returned for objects larger than a shard.
+*/
+func (mc *MemoryCache) Put(o *Object) error {
+	if o == nil {
+		return ErrObjectNil
+	}
+	return mc.shard(o.Key).put(o)
+}
+
+func (mc *MemoryCache) PutContext(ctx context.Context, o *Object) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mc.Put(o)
+}
+
+/*
+Delete removes the object from the cache. ErrCacheMiss is returned if the object is not cached.
+*/
+func (mc *MemoryCache) Delete(key string) error {
+	return mc.shard(key).delete(key)
+}
+
+func (mc *MemoryCache) DeleteContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return mc.Delete(key)
+}
+
+func (mc *MemoryCache) GetStream(ctx context.Context, key string) (io.ReadSeekCloser, *Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	obj, exists := mc.shard(key).get(key, mc.Clock.now())
+	if !exists {
+		return nil, nil, ErrCacheMiss
+	}
+	body, meta := newStreamedObject(obj)
+	return body, meta, nil
+}
+
+/*
+PutStream stores an object with the body read from r. The object is kept in memory, so the body
+is read completely before the object is stored.
+*/
+func (mc *MemoryCache) PutStream(ctx context.Context, meta *Object, r io.Reader, size int64) error {
+	o, err := readStreamedObject(meta, r, size)
+	if err != nil {
+		return err
+	}
+	return mc.PutContext(ctx, o)
+}
+
+// Stats returns the lookup and eviction counts of all shards and the current size of the cache
+func (mc *MemoryCache) Stats() MemoryCacheStats {
+	stats := MemoryCacheStats{Evictions: make(map[EvictionReason]uint64)}
+	for _, s := range mc.shards {
+		s.lock.Lock()
+		stats.Hits += s.stats.Hits
+		stats.Misses += s.stats.Misses
+		for reason, n := range s.stats.Evictions {
+			stats.Evictions[reason] += n
+		}
+		stats.Entries += len(s.entries)
+		stats.Bytes += s.size
+		s.lock.Unlock()
+	}
+	return stats
+}
+
+func (mc *MemoryCache) shard(key string) *memoryShard {
+	if len(mc.shards) == 1 {
+		return mc.shards[0]
+	}
+	return mc.shards[maphash.String(mc.seed, key)%uint64(len(mc.shards))]
+}
+
+func (mc *MemoryCache) initialize(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+
+	lookup := func(ctx context.Context) (*Object, error) {
+		if obj, exists := mc.shard(key).peek(key, mc.Clock.now()); exists {
+			return obj, nil
+		}
+		return nil, ErrCacheMiss
+	}
+	put := func(ctx context.Context, obj *Object) error {
+		return mc.Put(obj)
+	}
+	return initializeWith(ctx, &mc.flights, key, lookup, put, mc.logger, initializer)
+}
+
+func (s *memoryShard) get(key string, now time.Time) (*Object, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, exists := s.entries[key]
+	if exists && e.obj.IsExpired(now) {
+		s.removeLocked(e)
+		s.stats.Evictions[EvictionExpired]++
+		exists = false
+	}
+	if !exists {
+		s.stats.Misses++
+		return nil, false
+	}
+	s.stats.Hits++
+	s.policy.accessed(e)
+	return e.obj, true
+}
+
+// peek returns the object without counting the lookup as an access
+func (s *memoryShard) peek(key string, now time.Time) (*Object, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, exists := s.entries[key]
+	if !exists || e.obj.IsExpired(now) {
+		return nil, false
+	}
+	return e.obj, true
+}
+
+func (s *memoryShard) put(o *Object) error {
+	size := objectMemorySize(o)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if old, exists := s.entries[o.Key]; exists {
+		s.removeLocked(old)
+	}
+	if size > s.maxBytes {
+		s.stats.Evictions[EvictionTooLarge]++
+		return ErrEntryTooLarge
+	}
+
+	// Room is made before the object is added, so a new object is not evicted right away
+	for s.size+size > s.maxBytes {
+		victim, reason := s.policy.evict()
+		if victim == nil {
+			break
+		}
+		delete(s.entries, victim.key)
+		s.size -= victim.size
+		s.stats.Evictions[reason]++
+	}
+
+	e := &memoryEntry{key: o.Key, obj: o, size: size}
+	s.entries[o.Key] = e
+	s.size += size
+	s.policy.added(e)
+	return nil
+}
+
+func (s *memoryShard) delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, exists := s.entries[key]
+	if !exists {
+		return ErrCacheMiss
+	}
+	s.removeLocked(e)
+	return nil
+}
+
+func (s *memoryShard) removeLocked(e *memoryEntry) {
+	s.policy.removed(e)
+	delete(s.entries, e.key)
+	s.size -= e.size
+}
+
+// objectMemorySize approximates the memory taken by a cached object
+func objectMemorySize(o *Object) int64 {
+	size := int64(memoryEntryOverhead + len(o.Key) + len(o.Codec))
+	if o.Data != nil {
+		size += int64(len(*o.Data))
+	}
+	for name, values := range o.OriginalHeaders {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size
+}
@@ -0,0 +1,210 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var testPolicies = []EvictionPolicy{PolicyLRU, PolicyLFU, PolicyARC, PolicyWTinyLFU, PolicyS3FIFO}
+
+// newTestObject creates an object that takes 1000 bytes of the budget of a MemoryCache
+func newTestObject(key string) *Object {
+	data := []byte(strings.Repeat("x", 1000-memoryEntryOverhead-len(key)))
+	return &Object{Key: key, Data: &data}
+}
+
+func newTestMemoryCache(t *testing.T, maxBytes int64, policy EvictionPolicy) *MemoryCache {
+	mc, err := NewMemoryCache(log.New(io.Discard, "", log.LstdFlags), maxBytes, policy)
+	if err != nil {
+		t.Fatalf("Failed to create memory cache: %v", err)
+	}
+	return mc
+}
+
+func TestMemoryCache_PutGet(t *testing.T) {
+	if _, err := NewMemoryCache(log.New(io.Discard, "", log.LstdFlags), 1<<20, "unknown"); err == nil {
+		t.Errorf("Expected an error for an unknown policy")
+	}
+
+	for _, policy := range testPolicies {
+		mc := newTestMemoryCache(t, 10000, policy)
+
+		// Test case: Objects are stored within the budget
+		for i := 0; i < 50; i++ {
+			if err := mc.Put(newTestObject(fmt.Sprintf("key%02d", i))); err != nil {
+				t.Fatalf("%s: Expected no error, but got %v", policy, err)
+			}
+		}
+		stats := mc.Stats()
+		if stats.Bytes > 10000 || stats.Entries != 10 {
+			t.Errorf("%s: Expected 10 entries within the budget, but got %d entries of %d bytes", policy, stats.Entries, stats.Bytes)
+		}
+		if evicted := stats.Evictions[EvictionCapacity] + stats.Evictions[EvictionAdmission]; evicted != 40 {
+			t.Errorf("%s: Expected 40 evictions, but got %v", policy, stats.Evictions)
+		}
+
+		// Test case: Objects larger than the budget are rejected
+		large := []byte(strings.Repeat("x", 20000))
+		if err := mc.Put(&Object{Key: "large", Data: &large}); err != ErrEntryTooLarge {
+			t.Errorf("%s: Expected %v, but got %v", policy, ErrEntryTooLarge, err)
+		}
+		if stats := mc.Stats(); stats.Evictions[EvictionTooLarge] != 1 {
+			t.Errorf("%s: Expected 1 object rejected as too large, but got %v", policy, stats.Evictions)
+		}
+
+		// Test case: Replaced and deleted objects release their budget
+		mc.Put(newTestObject("key"))
+		mc.Put(newTestObject("key"))
+		if _, err := mc.Get("key", nil); err != nil {
+			t.Errorf("%s: Expected no error, but got %v", policy, err)
+		}
+		for i := 0; i < 50; i++ {
+			mc.Delete(fmt.Sprintf("key%02d", i))
+		}
+		mc.Delete("key")
+		if stats := mc.Stats(); stats.Bytes != 0 || stats.Entries != 0 {
+			t.Errorf("%s: Expected an empty cache, but got %d entries of %d bytes", policy, stats.Entries, stats.Bytes)
+		}
+		if err := mc.Delete("key"); err != ErrCacheMiss {
+			t.Errorf("%s: Expected %v, but got %v", policy, ErrCacheMiss, err)
+		}
+	}
+}
+
+func TestMemoryCache_Policies(t *testing.T) {
+	hot := []string{"hot0", "hot1", "hot2"}
+
+	for policy, keepsHot := range map[EvictionPolicy]bool{
+		PolicyLRU:      false,
+		PolicyLFU:      true,
+		PolicyARC:      true,
+		PolicyWTinyLFU: true,
+		PolicyS3FIFO:   true,
+	} {
+		mc := newTestMemoryCache(t, 10000, policy)
+
+		// The hot objects are requested repeatedly
+		for round := 0; round < 5; round++ {
+			for _, key := range hot {
+				mc.Get(key, func() (*Object, error) {
+					return newTestObject(key), nil
+				})
+			}
+		}
+
+		// Test case: A scan of objects requested once evicts the hot objects only from an LRU cache
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("scan%02d", i)
+			mc.Get(key, func() (*Object, error) {
+				return newTestObject(key), nil
+			})
+		}
+		kept := 0
+		for _, key := range hot {
+			if _, err := mc.Get(key, nil); err == nil {
+				kept++
+			}
+		}
+		if (kept == len(hot)) != keepsHot {
+			t.Errorf("%s: Expected hot objects kept %v, but %d of %d were kept", policy, keepsHot, kept, len(hot))
+		}
+	}
+
+	// Test case: LRU evicts the least recently used object
+	mc := newTestMemoryCache(t, 2000, PolicyLRU)
+	mc.Put(newTestObject("a"))
+	mc.Put(newTestObject("b"))
+	mc.Get("a", nil)
+	mc.Put(newTestObject("c"))
+	if _, err := mc.Get("b", nil); err != ErrInitializerNil {
+		t.Errorf("Expected b to be evicted, but got %v", err)
+	}
+
+	// Test case: LFU evicts the least frequently used object
+	mc = newTestMemoryCache(t, 2000, PolicyLFU)
+	mc.Put(newTestObject("a"))
+	mc.Put(newTestObject("b"))
+	mc.Get("a", nil)
+	mc.Get("a", nil)
+	mc.Get("b", nil)
+	mc.Put(newTestObject("c"))
+	if _, err := mc.Get("b", nil); err != ErrInitializerNil {
+		t.Errorf("Expected b to be evicted, but got %v", err)
+	}
+
+	// Test case: W-TinyLFU rejects new objects accessed less often than the objects they would replace
+	mc = newTestMemoryCache(t, 10000, PolicyWTinyLFU)
+	for i := 0; i < 20; i++ {
+		mc.Put(newTestObject(fmt.Sprintf("key%02d", i)))
+	}
+	if stats := mc.Stats(); stats.Evictions[EvictionAdmission] == 0 {
+		t.Errorf("Expected rejected objects, but got %v", stats.Evictions)
+	}
+}
+
+func TestMemoryCache_Concurrency(t *testing.T) {
+	for _, policy := range testPolicies {
+		mc := newTestMemoryCache(t, 16<<20, policy)
+		var wg sync.WaitGroup
+		for w := 0; w < 32; w++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed))
+				for i := 0; i < 1000; i++ {
+					key := fmt.Sprintf("localhost/testBucket/%d", r.Intn(500))
+					switch r.Intn(10) {
+					case 0:
+						mc.Delete(key)
+					case 1, 2:
+						data := make([]byte, r.Intn(256<<10))
+						mc.Put(&Object{Key: key, Data: &data})
+					default:
+						if obj, err := mc.Get(key, nil); err == nil && obj.Key != key {
+							t.Errorf("%s: Expected object %s, but got %s", policy, key, obj.Key)
+						}
+					}
+				}
+			}(int64(w))
+		}
+		wg.Wait()
+
+		stats := mc.Stats()
+		if stats.Bytes > 16<<20 {
+			t.Errorf("%s: Expected at most %d bytes, but got %d", policy, 16<<20, stats.Bytes)
+		}
+		var bytes int64
+		for _, s := range mc.shards {
+			for _, e := range s.entries {
+				bytes += e.size
+			}
+		}
+		if bytes != stats.Bytes {
+			t.Errorf("%s: Expected the entries to add up to %d bytes, but got %d", policy, stats.Bytes, bytes)
+		}
+	}
+}
+
+func TestFrequencySketch(t *testing.T) {
+	s := newFrequencySketch(1024)
+	for i := 0; i < 5; i++ {
+		s.increment("popular")
+	}
+	s.increment("rare")
+
+	// Test case: Estimates follow the number of occurrences
+	if popular, rare, unseen := s.estimate("popular"), s.estimate("rare"), s.estimate("unseen"); popular != 5 || rare != 1 || unseen > 0 {
+		t.Errorf("Expected estimates 5, 1 and 0, but got %d, %d and %d", popular, rare, unseen)
+	}
+
+	// Test case: Aging halves the estimates
+	s.reset()
+	if popular := s.estimate("popular"); popular != 2 {
+		t.Errorf("Expected estimate 2 after aging, but got %d", popular)
+	}
+}
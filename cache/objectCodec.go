@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+var (
+	ErrObjectFormat     = errors.New("unknown object format")
+	ErrObjectVersion    = errors.New("unsupported object format version")
+	ErrObjectTruncated  = errors.New("object is truncated")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+const (
+	objectMagic   = "OBJC"
+	objectVersion = 3
+
+	objectFlagData   = 1 << 0
+	objectFlagChunks = 1 << 1
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+/*
+encodeObject serializes an object for the backends that store objects as a whole. All integers
+are big endian, strings and the body are prefixed with their length:
+
+	magic "OBJC" | version uint8 | flags uint8
+	key string | stored at int64 (Unix nanoseconds, 0 if not set) | max age int64 | expires at int64 (Unix nanoseconds, 0 if not set)
+	status uint32 | codec string
+	headers uint32 count, each: name string | uint32 count of values, each: value string
+	chunk manifest, if flagged: generation int64 | size int64 | chunk size uint32 | uint32 count of checksums, each: uint32
+	body uint64 length | raw bytes
+	CRC-32C (Castagnoli) of everything before it, uint32
+
+Strings are a uint32 length and the bytes. The flags record whether the object has a body, so a
+nil Data is kept apart from an empty one, and whether it has a chunk manifest.
+*/
+func encodeObject(o *Object) []byte {
+	var flags uint8
+	size := len(objectMagic) + 2 + 4 + len(o.Key) + 8 + 8 + 8 + 4 + 4 + len(o.Codec) + 4 + 8 + 4
+	for name, values := range o.OriginalHeaders {
+		size += 4 + len(name) + 4
+		for _, value := range values {
+			size += 4 + len(value)
+		}
+	}
+	if o.Chunks != nil {
+		flags |= objectFlagChunks
+		size += 8 + 8 + 4 + 4 + 4*len(o.Chunks.Checksums)
+	}
+	if o.Data != nil {
+		flags |= objectFlagData
+		size += len(*o.Data)
+	}
+	b := make([]byte, 0, size)
+	b = append(b, objectMagic...)
+	b = append(b, objectVersion, flags)
+	b = appendString(b, o.Key)
+	b = binary.BigEndian.AppendUint64(b, uint64(unixNano(o.StoredAt)))
+	b = binary.BigEndian.AppendUint64(b, uint64(o.MaxAge))
+	b = binary.BigEndian.AppendUint64(b, uint64(unixNano(o.ExpiresAt)))
+	b = binary.BigEndian.AppendUint32(b, uint32(o.StatusCode))
+	b = appendString(b, o.Codec)
+
+	b = binary.BigEndian.AppendUint32(b, uint32(len(o.OriginalHeaders)))
+	for name, values := range o.OriginalHeaders {
+		b = appendString(b, name)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(values)))
+		for _, value := range values {
+			b = appendString(b, value)
+		}
+	}
+
+	if o.Chunks != nil {
+		b = binary.BigEndian.AppendUint64(b, uint64(o.Chunks.Generation))
+		b = binary.BigEndian.AppendUint64(b, uint64(o.Chunks.Size))
+		b = binary.BigEndian.AppendUint32(b, uint32(o.Chunks.ChunkSize))
+		b = binary.BigEndian.AppendUint32(b, uint32(len(o.Chunks.Checksums)))
+		for _, checksum := range o.Chunks.Checksums {
+			b = binary.BigEndian.AppendUint32(b, checksum)
+		}
+	}
+
+	var data []byte
+	if o.Data != nil {
+		data = *o.Data
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(len(data)))
+	b = append(b, data...)
+
+	return binary.BigEndian.AppendUint32(b, crc32.Checksum(b, castagnoli))
+}
+
+/*
+decodeObject parses an object serialized by encodeObject. Entries in another format, like the gob
+encoded objects of earlier versions, return ErrObjectFormat, and entries of another version of this
+format return ErrObjectVersion. The body of the object shares the memory of b.
+*/
+func decodeObject(b []byte) (*Object, error) {
+	if len(b) < len(objectMagic)+2 || string(b[:len(objectMagic)]) != objectMagic {
+		return nil, ErrObjectFormat
+	}
+	if version := b[len(objectMagic)]; version != objectVersion {
+		return nil, ErrObjectVersion
+	}
+	if len(b) < len(objectMagic)+2+4 {
+		return nil, ErrObjectTruncated
+	}
+	content, checksum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.Checksum(content, castagnoli) != checksum {
+		return nil, ErrChecksumMismatch
+	}
+
+	d := objectDecoder{b: content[len(objectMagic)+1:]}
+	flags := d.uint8()
+	o := &Object{Key: d.string()}
+	o.StoredAt = fromUnixNano(int64(d.uint64()))
+	o.MaxAge = time.Duration(d.uint64())
+	o.ExpiresAt = fromUnixNano(int64(d.uint64()))
+	o.StatusCode = int(d.uint32())
+	o.Codec = d.string()
+
+	if n := d.uint32(); n > 0 && d.err == nil {
+		o.OriginalHeaders = make(map[string][]string, min(n, 64))
+		for i := uint32(0); i < n && d.err == nil; i++ {
+			name := d.string()
+			count := d.uint32()
+			values := make([]string, 0, min(count, 16))
+			for j := uint32(0); j < count && d.err == nil; j++ {
+				values = append(values, d.string())
+			}
+			o.OriginalHeaders[name] = values
+		}
+	}
+
+	if flags&objectFlagChunks != 0 {
+		o.Chunks = &ChunkManifest{
+			Generation: int64(d.uint64()),
+			Size:       int64(d.uint64()),
+			ChunkSize:  int(d.uint32()),
+		}
+		for i, count := uint32(0), d.uint32(); i < count && d.err == nil; i++ {
+			o.Chunks.Checksums = append(o.Chunks.Checksums, d.uint32())
+		}
+	}
+
+	data := d.bytes(d.uint64())
+	if flags&objectFlagData != 0 && d.err == nil {
+		o.Data = &data
+	}
+	if d.err == nil && len(d.b) != 0 {
+		return nil, ErrObjectFormat
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return o, nil
+}
+
+// unixNano returns the time in Unix nanoseconds, or 0 for the zero time
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// objectDecoder reads the fields of an encoded object, after the first error all reads return zero values
+type objectDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *objectDecoder) bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.b)) < n {
+		d.err = ErrObjectTruncated
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *objectDecoder) uint8() uint8 {
+	if b := d.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *objectDecoder) uint32() uint32 {
+	if b := d.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *objectDecoder) uint64() uint64 {
+	if b := d.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *objectDecoder) string() string {
+	return string(d.bytes(uint64(d.uint32())))
+}
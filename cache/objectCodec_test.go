@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestObjectCodec(t *testing.T) {
+	data := []byte("testData")
+	empty := []byte{}
+	objects := []*Object{
+		{
+			Key:             "localhost/testBucket/testKey",
+			Data:            &data,
+			OriginalHeaders: map[string][]string{"Etag": {"\"1\""}, "X-Amz-Meta-List": {"a", "b"}},
+			StoredAt:        time.Unix(1700000000, 123),
+			MaxAge:          time.Minute,
+			ExpiresAt:       time.Unix(1700003600, 456),
+		},
+		{Key: "localhost/testBucket/missing", Data: &empty, StatusCode: 404},
+		{Key: "localhost/testBucket/compressed", Data: &data, Codec: "gzip"},
+		{Key: "localhost/testBucket/head", OriginalHeaders: map[string][]string{}},
+		{
+			Key:    "localhost/testBucket/chunked",
+			Data:   &empty,
+			Chunks: &ChunkManifest{Generation: 42, Size: 300, ChunkSize: 100, Checksums: []uint32{1, 2, 3}},
+		},
+	}
+
+	// Test case: Objects are decoded as they were encoded
+	for _, obj := range objects {
+		decoded, err := decodeObject(encodeObject(obj))
+		if err != nil {
+			t.Errorf("%s: Expected no error, but got %v", obj.Key, err)
+			continue
+		}
+		if len(obj.OriginalHeaders) == 0 {
+			// An empty header map is decoded as nil
+			decoded.OriginalHeaders = obj.OriginalHeaders
+		}
+		if !decoded.StoredAt.Equal(obj.StoredAt) {
+			t.Errorf("%s: Expected stored at %v, but got %v", obj.Key, obj.StoredAt, decoded.StoredAt)
+		}
+		if !decoded.ExpiresAt.Equal(obj.ExpiresAt) {
+			t.Errorf("%s: Expected expires at %v, but got %v", obj.Key, obj.ExpiresAt, decoded.ExpiresAt)
+		}
+		decoded.StoredAt, decoded.ExpiresAt = obj.StoredAt, obj.ExpiresAt
+		if !reflect.DeepEqual(decoded, obj) {
+			t.Errorf("%s: Expected %+v, but got %+v", obj.Key, obj, decoded)
+		}
+	}
+
+	// Test case: Damaged entries are rejected
+	encoded := encodeObject(objects[0])
+	corrupted := bytes.Clone(encoded)
+	corrupted[len(corrupted)-10] ^= 0xff
+	future := bytes.Clone(encoded)
+	future[len(objectMagic)] = objectVersion + 1
+
+	var gobEncoded bytes.Buffer
+	gob.NewEncoder(&gobEncoded).Encode(objects[0])
+
+	for name, test := range map[string]struct {
+		entry    []byte
+		expected error
+	}{
+		"corrupted": {corrupted, ErrChecksumMismatch},
+		"truncated": {encoded[:len(encoded)-1], ErrChecksumMismatch},
+		"short":     {encoded[:len(objectMagic)+3], ErrObjectTruncated},
+		"version":   {future, ErrObjectVersion},
+		"gob":       {gobEncoded.Bytes(), ErrObjectFormat},
+		"empty":     {nil, ErrObjectFormat},
+	} {
+		if _, err := decodeObject(test.entry); err != test.expected {
+			t.Errorf("%s: Expected %v, but got %v", name, test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrSizeMismatch = errors.New("body size does not match")
+
+/*
+StreamCache is implemented by cache backends that store and serve object bodies as streams, so
+objects do not have to be held in memory as a whole. The objects returned and accepted by the
+stream methods only carry the metadata, their Data is nil. Objects stored with Put can be read
+with GetStream and the other way round.
+*/
+type StreamCache interface {
+	Cache
+
+	// GetStream returns the body and the metadata of a cached object, or ErrCacheMiss. The body has to be closed.
+	GetStream(ctx context.Context, key string) (io.ReadSeekCloser, *Object, error)
+	/*
+		PutStream stores an object with the body read from r. size is the length of the body, or -1
+		if it is not known. Nothing is stored if r fails or the body does not match the size.
+	*/
+	PutStream(ctx context.Context, meta *Object, r io.Reader, size int64) error
+}
+
+// bytesBody is the body of an object held in memory
+type bytesBody struct {
+	*bytes.Reader
+}
+
+func (bytesBody) Close() error {
+	return nil
+}
+
+// newStreamedObject splits an object held in memory into its body and its metadata
+func newStreamedObject(o *Object) (io.ReadSeekCloser, *Object) {
+	meta := *o
+	meta.Data = nil
+	return bytesBody{bytes.NewReader(*o.Data)}, &meta
+}
+
+// readStreamedObject reads the body of a streamed object into memory, for backends that store objects as a whole
+func readStreamedObject(meta *Object, r io.Reader, size int64) (*Object, error) {
+	var data []byte
+	var err error
+	if size < 0 {
+		data, err = io.ReadAll(r)
+	} else {
+		data = make([]byte, size)
+		_, err = io.ReadFull(r, data)
+		if err == io.ErrUnexpectedEOF || err == io.EOF && size > 0 {
+			err = ErrSizeMismatch
+		} else if err == nil {
+			// The body must end after size bytes
+			if _, extraErr := io.ReadFull(r, make([]byte, 1)); extraErr == nil {
+				err = ErrSizeMismatch
+			} else if extraErr != io.EOF {
+				err = extraErr
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object body: %w", err)
+	}
+
+	o := *meta
+	o.Data = &data
+	return &o, nil
+}
+
+/*
+AsStreamCache returns c if it is a StreamCache. Other caches are wrapped, their objects are held in
+memory as a whole, so bodies are read completely before they are stored.
+*/
+func AsStreamCache(c Cache) StreamCache {
+	if sc, ok := c.(StreamCache); ok {
+		return sc
+	}
+	return wholeObjectCache{c}
+}
+
+// wholeObjectCache streams the objects of a cache that only stores complete objects
+type wholeObjectCache struct {
+	Cache
+}
+
+func (wc wholeObjectCache) GetStream(ctx context.Context, key string) (io.ReadSeekCloser, *Object, error) {
+	obj, err := wc.GetContext(ctx, key, func(context.Context) (*Object, error) {
+		return nil, ErrCacheMiss
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	body, meta := newStreamedObject(obj)
+	return body, meta, nil
+}
+
+func (wc wholeObjectCache) PutStream(ctx context.Context, meta *Object, r io.Reader, size int64) error {
+	o, err := readStreamedObject(meta, r, size)
+	if err != nil {
+		return err
+	}
+	return wc.PutContext(ctx, o)
+}
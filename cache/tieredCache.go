@@ -0,0 +1,426 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tier is a cache backend of a TieredCache, named in the stats
+type Tier struct {
+	Name  string
+	Cache Cache
+}
+
+/*
+TieredCache stacks cache backends, the fastest first, for example memory over a local disk over
+a shared memcached pool. A lookup checks the tiers in order, and a hit is copied to the tiers in
+front of the one that had the object, so the next lookup finds it earlier. On a miss the object is
+written through to all tiers.
+
+Writes to the tiers happen before the call returns, or in the background if Background is set.
+Streamed bodies can only be read once, so PutStream writes them to all tiers at the same time
+regardless of Background. A write that fails in one tier does not keep the object out of the others.
+Until a background write has finished, lookups can still miss the object.
+*/
+type TieredCache struct {
+	Background bool // Write fills and promotions to the tiers without waiting for them
+
+	tiers   []*tier
+	logger  *log.Logger
+	flights FlightGroup
+	misses  atomic.Uint64
+	writes  sync.WaitGroup // Background writes in progress
+}
+
+type tier struct {
+	Tier
+	hits       atomic.Uint64
+	promotions atomic.Uint64
+	failures   atomic.Uint64
+}
+
+// TieredCacheStats counts the lookups of a TieredCache, a lookup is either a hit in one tier or a miss
+type TieredCacheStats struct {
+	Tiers  []TierStats
+	Misses uint64
+}
+
+// TierStats counts the hits of a tier, the objects promoted to it and its failed writes, objects it did not admit are not failures
+type TierStats struct {
+	Name       string
+	Hits       uint64
+	Promotions uint64
+	Failures   uint64
+}
+
+/*
+NewTieredCache creates a cache over the given tiers, which are checked in the given order.
+*/
+func NewTieredCache(logger *log.Logger, tiers ...Tier) *TieredCache {
+	tc := &TieredCache{logger: logger}
+	for _, t := range tiers {
+		tc.tiers = append(tc.tiers, &tier{Tier: t})
+	}
+	return tc
+}
+
+func (tc *TieredCache) Get(key string, initializer Initializer) (*Object, error) {
+	return tc.GetContext(context.Background(), key, withoutContext(initializer))
+}
+
+func (tc *TieredCache) GetContext(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+	obj, err := tc.get(ctx, key)
+	if err == ErrCacheMiss {
+		return tc.initialize(ctx, key, initializer)
+	}
+	return obj, err
+}
+
+func (tc *TieredCache) GetTimed(key string, initializer Initializer) (*Object, int64, int64, error) {
+	start := time.Now()
+	obj, err := tc.get(context.Background(), key)
+	elapsed := time.Since(start).Nanoseconds()
+
+	if err == ErrCacheMiss {
+		start := time.Now()
+		obj, err := tc.initialize(context.Background(), key, withoutContext(initializer))
+		initElapsed := time.Since(start).Nanoseconds()
+		return obj, elapsed, initElapsed, err
+	}
+	return obj, elapsed, 0, err
+}
+
+func (tc *TieredCache) Put(o *Object) error {
+	return tc.PutContext(context.Background(), o)
+}
+
+// PutContext writes the object to all tiers. An error is only returned if no tier stored the object.
+func (tc *TieredCache) PutContext(ctx context.Context, o *Object) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return tc.write(ctx, tc.tiers, o)
+}
+
+/*
+Delete removes the object from all tiers. ErrCacheMiss is returned if no tier had the object.
+*/
+func (tc *TieredCache) Delete(key string) error {
+	return tc.DeleteContext(context.Background(), key)
+}
+
+func (tc *TieredCache) DeleteContext(ctx context.Context, key string) error {
+	deleted := false
+	var failed error
+	for _, t := range tc.tiers {
+		err := t.Cache.DeleteContext(ctx, key)
+		switch {
+		case err == nil:
+			deleted = true
+		case err == ErrCacheMiss:
+		case failed == nil:
+			// An object left in a tier would still be served, so the failure is reported
+			failed = err
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+	if !deleted {
+		return ErrCacheMiss
+	}
+	return nil
+}
+
+/*
+GetStream returns the body of the object from the first tier that has it. Tiers that do not
+implement StreamCache are read as a whole.
+*/
+func (tc *TieredCache) GetStream(ctx context.Context, key string) (io.ReadSeekCloser, *Object, error) {
+	for i, t := range tc.tiers {
+		body, meta, err := getTierStream(ctx, t.Cache, key)
+		if err == ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, nil, ctxErr
+			}
+			tc.logger.Printf("Failed to read object %s from tier %s: %v", key, t.Name, err)
+			continue
+		}
+		t.hits.Add(1)
+		if i > 0 {
+			tc.background(ctx, func(ctx context.Context) {
+				tc.promoteStream(ctx, key, i)
+			})
+		}
+		return body, meta, nil
+	}
+	tc.misses.Add(1)
+	return nil, nil, ErrCacheMiss
+}
+
+/*
+PutStream writes the body to all tiers at the same time. An error is only returned if no tier
+stored the object.
+*/
+func (tc *TieredCache) PutStream(ctx context.Context, meta *Object, r io.Reader, size int64) error {
+	return tc.writeStream(ctx, tc.tiers, meta, r, size)
+}
+
+// Wait blocks until the background writes have finished
+func (tc *TieredCache) Wait() {
+	tc.writes.Wait()
+}
+
+// Stats returns the hits of every tier and the lookups that missed all tiers
+func (tc *TieredCache) Stats() TieredCacheStats {
+	stats := TieredCacheStats{Misses: tc.misses.Load()}
+	for _, t := range tc.tiers {
+		stats.Tiers = append(stats.Tiers, TierStats{
+			Name:       t.Name,
+			Hits:       t.hits.Load(),
+			Promotions: t.promotions.Load(),
+			Failures:   t.failures.Load(),
+		})
+	}
+	return stats
+}
+
+// get looks the object up in the tiers, counts the lookup and promotes a hit
+func (tc *TieredCache) get(ctx context.Context, key string) (*Object, error) {
+	obj, i, err := tc.lookup(ctx, key)
+	if err == ErrCacheMiss {
+		tc.misses.Add(1)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	tc.tiers[i].hits.Add(1)
+	if i > 0 {
+		tc.background(ctx, func(ctx context.Context) {
+			if tc.write(ctx, tc.tiers[:i], obj) == nil {
+				countPromotions(tc.tiers[:i])
+			}
+		})
+	}
+	return obj, nil
+}
+
+// lookup returns the object and the index of the first tier that has it
+func (tc *TieredCache) lookup(ctx context.Context, key string) (*Object, int, error) {
+	for i, t := range tc.tiers {
+		obj, err := t.Cache.GetContext(ctx, key, nil)
+		if err == nil {
+			return obj, i, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, 0, ctxErr
+		}
+		if !errors.Is(err, ErrInitializerNil) && !errors.Is(err, ErrCacheMiss) {
+			tc.logger.Printf("Failed to read object %s from tier %s: %v", key, t.Name, err)
+		}
+	}
+	return nil, 0, ErrCacheMiss
+}
+
+func (tc *TieredCache) initialize(ctx context.Context, key string, initializer ContextInitializer) (*Object, error) {
+
+	lookup := func(ctx context.Context) (*Object, error) {
+		obj, _, err := tc.lookup(ctx, key)
+		return obj, err
+	}
+	// Failures of the tiers are counted by write
+	put := func(ctx context.Context, obj *Object) error {
+		tc.background(ctx, func(ctx context.Context) {
+			tc.write(ctx, tc.tiers, obj)
+		})
+		return nil
+	}
+	return initializeWith(ctx, &tc.flights, key, lookup, put, tc.logger, initializer)
+}
+
+/*
+background runs the write now, or in a goroutine if Background is set. The write does not end
+with the request that caused it.
+*/
+func (tc *TieredCache) background(ctx context.Context, write func(ctx context.Context)) {
+	ctx = context.WithoutCancel(ctx)
+	if !tc.Background {
+		write(ctx)
+		return
+	}
+	tc.writes.Add(1)
+	go func() {
+		defer tc.writes.Done()
+		write(ctx)
+	}()
+}
+
+// write stores the object in the tiers, an error is only returned if no tier stored it
+func (tc *TieredCache) write(ctx context.Context, tiers []*tier, o *Object) error {
+	var first error
+	stored := false
+	for _, t := range tiers {
+		err := t.Cache.PutContext(ctx, o)
+		if err != nil {
+			if err != ErrNotAdmitted {
+				t.failures.Add(1)
+				tc.logger.Printf("Failed to store object %s in tier %s: %v", o.Key, t.Name, err)
+			}
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		stored = true
+	}
+	if stored {
+		return nil
+	}
+	return first
+}
+
+// promoteStream copies the body of an object from the tier at index from to the tiers in front of it
+func (tc *TieredCache) promoteStream(ctx context.Context, key string, from int) {
+	body, meta, err := getTierStream(ctx, tc.tiers[from].Cache, key)
+	if err != nil {
+		// Evicted in the meantime
+		return
+	}
+	defer body.Close()
+
+	size, err := body.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = body.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return
+	}
+	if tc.writeStream(ctx, tc.tiers[:from], meta, body, size) == nil {
+		countPromotions(tc.tiers[:from])
+	}
+}
+
+/*
+writeStream writes the body to the tiers at the same time, every tier reads it from its own pipe.
+A tier that fails stops receiving the body, the others continue. An error is only returned if no
+tier stored the object.
+*/
+func (tc *TieredCache) writeStream(ctx context.Context, tiers []*tier, meta *Object, r io.Reader, size int64) error {
+	if len(tiers) == 0 {
+		return nil
+	}
+
+	writers := make([]*io.PipeWriter, len(tiers))
+	errs := make([]error, len(tiers))
+	var wg sync.WaitGroup
+	for i, t := range tiers {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = putTierStream(ctx, t.Cache, meta, pr, size)
+			// Unblocks the writer if the tier returned before reading the whole body
+			pr.CloseWithError(errTierDone)
+		}()
+	}
+
+	buf := make([]byte, 32*1024)
+	var readErr error
+	for active := len(writers); active > 0; {
+		n, err := r.Read(buf)
+		if n > 0 {
+			for i, pw := range writers {
+				if pw == nil {
+					continue
+				}
+				if _, err := pw.Write(buf[:n]); err != nil {
+					writers[i] = nil
+					active--
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+	for _, pw := range writers {
+		if pw != nil {
+			pw.CloseWithError(readErr)
+		}
+	}
+	wg.Wait()
+
+	if readErr != nil {
+		return readErr
+	}
+	var first error
+	stored := false
+	for i, t := range tiers {
+		if errs[i] != nil {
+			if errs[i] != ErrNotAdmitted {
+				t.failures.Add(1)
+				tc.logger.Printf("Failed to store object %s in tier %s: %v", meta.Key, t.Name, errs[i])
+			}
+			if first == nil {
+				first = errs[i]
+			}
+			continue
+		}
+		stored = true
+	}
+	if stored {
+		return nil
+	}
+	return first
+}
+
+// errTierDone is returned to the writer of a pipe whose tier stopped reading
+var errTierDone = errors.New("tier stopped reading the body")
+
+func countPromotions(tiers []*tier) {
+	for _, t := range tiers {
+		t.promotions.Add(1)
+	}
+}
+
+// getTierStream reads the body of an object from a tier, as a whole if the tier does not stream
+func getTierStream(ctx context.Context, c Cache, key string) (io.ReadSeekCloser, *Object, error) {
+	if sc, ok := c.(StreamCache); ok {
+		return sc.GetStream(ctx, key)
+	}
+	obj, err := c.GetContext(ctx, key, nil)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, ctxErr
+		}
+		return nil, nil, ErrCacheMiss
+	}
+	body, meta := newStreamedObject(obj)
+	return body, meta, nil
+}
+
+// putTierStream stores a streamed object in a tier, read into memory if the tier does not stream
+func putTierStream(ctx context.Context, c Cache, meta *Object, r io.Reader, size int64) error {
+	if sc, ok := c.(StreamCache); ok {
+		return sc.PutStream(ctx, meta, r, size)
+	}
+	obj, err := readStreamedObject(meta, r, size)
+	if err != nil {
+		return err
+	}
+	return c.PutContext(ctx, obj)
+}
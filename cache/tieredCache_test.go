@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+)
+
+// failingCache is a tier whose writes fail
+type failingCache struct {
+	*DummyPrinterCache
+}
+
+func (failingCache) PutContext(ctx context.Context, o *Object) error {
+	return errors.New("put failed")
+}
+
+func (failingCache) PutStream(ctx context.Context, meta *Object, r io.Reader, size int64) error {
+	return errors.New("put failed")
+}
+
+func newTestTieredCache(t *testing.T) (*TieredCache, *DummyPrinterCache, *DiskCache) {
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	memory := NewDummyPrinterCache(logger, 1024)
+	disk := newTestDiskCache(t, t.TempDir(), 1<<20)
+	t.Cleanup(func() { disk.Close() })
+	return NewTieredCache(logger, Tier{"memory", memory}, Tier{"disk", disk}), memory, disk
+}
+
+func TestTieredCache_Get(t *testing.T) {
+	tc, memory, disk := newTestTieredCache(t)
+	key := "localhost/testBucket/testKey"
+
+	calls := 0
+	initializer := func() (*Object, error) {
+		calls++
+		data := []byte("testData")
+		return &Object{Key: key, Data: &data}, nil
+	}
+
+	// Test case: A miss is written through to all tiers
+	if _, err := tc.Get(key, initializer); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if _, exists := memory.get(key); !exists {
+		t.Errorf("Expected object in the memory tier")
+	}
+	if _, err := disk.Get(key, nil); err != nil {
+		t.Errorf("Expected object in the disk tier, but got %v", err)
+	}
+
+	// Test case: A hit in a lower tier is promoted
+	memory.Delete(key)
+	obj, err := tc.Get(key, initializer)
+	if err != nil || string(*obj.Data) != "testData" {
+		t.Fatalf("Expected object with data 'testData', but got %v, %v", obj, err)
+	}
+	if _, exists := memory.get(key); !exists {
+		t.Errorf("Expected object to be promoted to the memory tier")
+	}
+	tc.Get(key, initializer)
+
+	if calls != 1 {
+		t.Errorf("Expected 1 initializer call, but got %d", calls)
+	}
+	stats := tc.Stats()
+	if stats.Misses != 1 || stats.Tiers[0].Hits != 1 || stats.Tiers[1].Hits != 1 || stats.Tiers[0].Promotions != 1 {
+		t.Errorf("Expected 1 miss, 1 hit in each tier and 1 promotion, but got %+v", stats)
+	}
+
+	// Test case: Objects are deleted from all tiers
+	if err := tc.Delete(key); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+	if err := tc.Delete(key); err != ErrCacheMiss {
+		t.Errorf("Expected %v, but got %v", ErrCacheMiss, err)
+	}
+	if _, err := tc.Get(key, nil); err != ErrInitializerNil {
+		t.Errorf("Expected %v, but got %v", ErrInitializerNil, err)
+	}
+}
+
+func TestTieredCache_Stream(t *testing.T) {
+	tc, memory, disk := newTestTieredCache(t)
+	tc.Background = true
+	key := "localhost/testBucket/testKey"
+	body := strings.Repeat("0123456789", 10000)
+
+	// Test case: Streamed bodies are written to all tiers
+	if err := tc.PutStream(context.Background(), &Object{Key: key}, strings.NewReader(body), int64(len(body))); err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	for name, c := range map[string]StreamCache{"memory": memory, "disk": disk} {
+		r, _, err := c.GetStream(context.Background(), key)
+		if err != nil {
+			t.Errorf("Expected object in the %s tier, but got %v", name, err)
+			continue
+		}
+		data, _ := io.ReadAll(r)
+		r.Close()
+		if string(data) != body {
+			t.Errorf("Expected body of %d bytes in the %s tier, but got %d bytes", len(body), name, len(data))
+		}
+	}
+
+	// Test case: A streamed hit in a lower tier is promoted in the background
+	memory.Delete(key)
+	r, _, err := tc.GetStream(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	r.Close()
+	tc.Wait()
+	if _, exists := memory.get(key); !exists {
+		t.Errorf("Expected object to be promoted to the memory tier")
+	}
+
+	// Test case: A body that does not match its size is not stored in any tier
+	err = tc.PutStream(context.Background(), &Object{Key: "localhost/testBucket/short"}, strings.NewReader("short"), 10)
+	if err == nil {
+		t.Errorf("Expected an error for a short body")
+	}
+	if _, _, err := tc.GetStream(context.Background(), "localhost/testBucket/short"); err != ErrCacheMiss {
+		t.Errorf("Expected %v, but got %v", ErrCacheMiss, err)
+	}
+}
+
+func TestTieredCache_FailingTier(t *testing.T) {
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	failing := failingCache{NewDummyPrinterCache(logger, 1024)}
+	memory := NewDummyPrinterCache(logger, 1024)
+	tc := NewTieredCache(logger, Tier{"failing", failing}, Tier{"memory", memory})
+
+	// Test case: A failing tier does not keep the object out of the others
+	data := []byte("testData")
+	if err := tc.Put(&Object{Key: "a", Data: &data}); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+	if err := tc.PutStream(context.Background(), &Object{Key: "b"}, strings.NewReader("testData"), -1); err != nil {
+		t.Errorf("Expected no error, but got %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, exists := memory.get(key); !exists {
+			t.Errorf("Expected object %s in the memory tier", key)
+		}
+	}
+	if stats := tc.Stats(); stats.Tiers[0].Failures != 2 {
+		t.Errorf("Expected 2 failures of the failing tier, but got %+v", stats)
+	}
+
+	// Test case: The object is reported as not stored if every tier fails
+	tc = NewTieredCache(logger, Tier{"failing", failing})
+	if err := tc.Put(&Object{Key: "a", Data: &data}); err == nil {
+		t.Errorf("Expected an error")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"net"
 	"os"
+	"sort"
 	"sync"
 	"syscall"
 	"time"
@@ -35,6 +36,40 @@ const (
 	MAX_BUFFER_SIZE = 100000           // Maximum buffer size for reading data from the connection
 	MAX_WORKERS     = 1000             // Maximum number of workers in the worker pool
 	TIMED           = false
+	OBJECT_MAX_AGE  = 0 * time.Second  // Time a cached object is served before it is revalidated with the origin, 0 disables revalidation
+	UPSTREAM_IDLE   = 64               // Maximum number of idle connections kept to each object storage endpoint
+	UPSTREAM_TTL    = 90 * time.Second // Time an idle connection to an object storage endpoint is kept
+	WARM_HEAD       = false            // Cache only the metadata of objects requested with HEAD on a miss
+	NEGATIVE_TTL    = 0 * time.Second  // Time a 404 NoSuchKey response is served from the cache, 0 disables negative caching
+	NEGATIVE_BYTES  = 1 << 20          // Total size of the cached 404 responses
+	STALE_IF_ERROR  = true             // Serve stale objects when the object storage fails to revalidate them
+	OFFLINE         = false            // Serve only from the cache, the object storage is never contacted
+	UPSTREAM_WAIT   = 30 * time.Second // Maximum time to wait for the response headers of the object storage
+	REQUEST_TIMEOUT = 0 * time.Second  // Maximum time to answer a request, 0 means no limit
+)
+
+// Expiry of cached objects, independent of their revalidation
+const (
+	OBJECT_TTL = 0 * time.Second        // Time after which cached objects are dropped, unless the origin sets TTL_HEADER, 0 means they are kept until evicted
+	TTL_HEADER = "X-Amz-Meta-Cache-Ttl" // Object metadata with the TTL of an object in seconds
+)
+
+// Snapshots of the bigcache memory tier, restored on start so a restart does not empty the cache
+const (
+	SNAPSHOT_PATH     = "/var/lib/object-storage-proxy/memory.snapshot" // File of the snapshot, written on SIGTERM
+	SNAPSHOT_INTERVAL = 5 * time.Minute                                 // Time between two periodic snapshots, 0 disables them
+)
+
+// Cache tiers, the disk cache is on a local NVMe drive
+const (
+	DISK_CACHE_DIR  = "/var/cache/object-storage-proxy" // Directory of the object files and the index
+	DISK_CACHE_SIZE = 200 << 30                         // Total size of the object files
+	TIER_BACKGROUND = false                             // Write objects to the cache tiers in the background instead of before answering
+	CACHE_CODEC     = "gzip"                            // Codec that compresses the bodies in the memory tier
+	MEMORY_SIZE     = 512 << 20                         // Total size of the objects in the in-process memory cache
+	MEMORY_POLICY   = cache.PolicyWTinyLFU              // Eviction policy of the in-process memory cache
+	ADMISSION_WIDTH = 1 << 16                           // Counters per row of the frequency sketch of the memory tier, about the number of objects it holds
+	ADMISSION_MAX   = 64 << 20                          // Largest object stored in the memory tier
 )
 
 var bypassHttpHandler bool = false
@@ -50,7 +85,8 @@ type SockAddrIn struct {
 
 type ConnectionCounter struct {
 	connections    int
-	collectedStats []proxy.ProxyStatsEntry
+	collectedStats []proxy.ProxyStatsEntry // Only collected in TIMED mode
+	decisions      map[string]int          // Requests per cache decision, kept in every mode
 	sync.Mutex
 }
 
@@ -62,6 +98,10 @@ type ProxyTask struct {
 var proxyModule proxy.HttpProxy
 var timedProxyModule proxy.HttpTimedProxy
 var cacheModule *cache.BigcacheWrapper
+var tieredCache *cache.TieredCache
+var compressedCache *cache.CompressedCache
+var admissionCache *cache.AdmissionCache
+var upstreamPool *proxy.UpstreamPool
 var connectionCounter ConnectionCounter
 
 // helper function for getsockopt
@@ -203,19 +243,74 @@ func run(w io.Writer) error {
 	//objectStorage1 := objectStorage.NewDummyObjectStorageAdapter("host.lima.internal")
 	minioObjStorage := objectStorage.NewMinIOAdapter("host.lima.internal:9000")
 
+	// The proxy is wired to a stack of cache tiers, the fastest first
+
+	//Bigcache client
+	cacheModule = cache.NewBigcacheWrapper(log.New(w, "Cache: ", log.LstdFlags), 1000)
+	if restored, err := cacheModule.LoadSnapshot(SNAPSHOT_PATH); err != nil {
+		color.HiYellow("Starting with an empty memory cache: %v", err)
+	} else if restored > 0 {
+		color.HiBlue("Restored %d entries of the memory cache from %s", restored, SNAPSHOT_PATH)
+	}
+	// Objects larger than a bigcache shard are stored in chunks, bodies are compressed before they are split
+	var err error
+	compressedCache, err = cache.NewCompressedCache(
+		log.New(w, "Cache: ", log.LstdFlags),
+		cache.NewChunkedCache(log.New(w, "Cache: ", log.LstdFlags), cacheModule, cache.DefaultChunkSize),
+		CACHE_CODEC,
+	)
+	if err != nil {
+		log.Fatalf("Failed to create compressed cache: %v", err)
+	}
+	// Objects are stored in the memory tier once they were requested twice, so a scan does not evict the hot objects
+	admissionFilter := cache.AllFilters(
+		&cache.SizeFilter{MaxSize: ADMISSION_MAX},
+		cache.NewFrequencyFilter(ADMISSION_WIDTH),
+	)
+	admissionCache = cache.NewAdmissionCache(log.New(w, "Cache: ", log.LstdFlags), compressedCache, admissionFilter)
+	tiers := []cache.Tier{{Name: "memory", Cache: admissionCache}}
+	// Largest object stored by the tiers, the proxy passes larger objects through without filling the cache
+	var maxObjectSize int64 = ADMISSION_MAX
+
+	// In-process cache with a selectable eviction policy instead of bigcache, it has no entry size limit
+
+	/* memoryCache, err := cache.NewMemoryCache(log.New(w, "Cache: ", log.LstdFlags), MEMORY_SIZE, MEMORY_POLICY)
+	if err != nil {
+		log.Fatalf("Failed to create memory cache: %v", err)
+	}
+	compressedCache, err = cache.NewCompressedCache(log.New(w, "Cache: ", log.LstdFlags), memoryCache, CACHE_CODEC)
+	if err != nil {
+		log.Fatalf("Failed to create compressed cache: %v", err)
+	}
+	admissionCache = cache.NewAdmissionCache(log.New(w, "Cache: ", log.LstdFlags), compressedCache, admissionFilter)
+	tiers[0] = cache.Tier{Name: "memory", Cache: admissionCache} */
+
+	// Disk cache, objects are streamed from and to their files, so the proxy stores objects of any size
+
+	/* diskCache, err := cache.NewDiskCache(log.New(w, "Cache: ", log.LstdFlags), DISK_CACHE_DIR, DISK_CACHE_SIZE)
+	if err != nil {
+		log.Fatalf("Failed to open disk cache: %v", err)
+	}
+	defer diskCache.Close()
+
+	tiers = append(tiers, cache.Tier{Name: "disk", Cache: diskCache})
+	maxObjectSize = 0 */
+
 	// Memcached client
 
 	/* memcachedClient := cache.NewMemcachedClient(log.New(w, "Cache: ", log.LstdFlags), 120, "localhost:11211")
 
-	err := memcachedClient.TestConnection()
+	err = memcachedClient.TestConnection()
 	if err != nil {
 		log.Fatalf("Failed to connect to memcached: %v", err)
 	}
 
-	cacheModule = memcachedClient */
+	// Objects larger than the memcached item limit are stored in chunks
+	tiers = append(tiers, cache.Tier{Name: "memcached", Cache: cache.NewChunkedCache(log.New(w, "Cache: ", log.LstdFlags), memcachedClient, cache.DefaultChunkSize)})
+	maxObjectSize = 0 */
 
-	//Bigcache client
-	cacheModule = cache.NewBigcacheWrapper(log.New(w, "Cache: ", log.LstdFlags), 1000)
+	tieredCache = cache.NewTieredCache(log.New(w, "Cache: ", log.LstdFlags), tiers...)
+	tieredCache.Background = TIER_BACKGROUND
 
 	go func() {
 		for {
@@ -224,6 +319,17 @@ func run(w io.Writer) error {
 		}
 	}()
 
+	if SNAPSHOT_INTERVAL > 0 {
+		go func() {
+			for {
+				time.Sleep(SNAPSHOT_INTERVAL)
+				if _, err := cacheModule.SaveSnapshot(SNAPSHOT_PATH); err != nil {
+					log.Printf("%v", err)
+				}
+			}
+		}()
+	}
+
 	args := os.Args[1:]
 	if len(args) > 0 {
 		if args[0] == "--bypass" {
@@ -299,15 +405,20 @@ func run(w io.Writer) error {
 
 	log.Printf("Proxy server with PID %d listening on %s", os.Getpid(), proxyAddr)
 
+	// Connections to the object storage are shared by all workers
+	upstreamPool = proxy.NewUpstreamPool(UPSTREAM_IDLE, UPSTREAM_TTL)
+	upstreamPool.ResponseTimeout = UPSTREAM_WAIT
+
 	if TIMED {
 
 		proxyModule := proxy.NewHttpCachingTimedProxy(
-			cacheModule,
+			tieredCache,
 			[]objectStorage.ObjectStorage{
 				//&objectStorage1,
 				&minioObjStorage,
 			},
 		)
+		proxyModule.Upstream = upstreamPool
 
 		// Setup worker pool
 		jobQueue := make(chan ProxyTask, MAX_BUFFER_SIZE)
@@ -350,12 +461,31 @@ func run(w io.Writer) error {
 	} else {
 
 		proxyModule := proxy.NewHttpCachingProxy(
-			cacheModule,
+			tieredCache,
 			[]objectStorage.ObjectStorage{
 				//&objectStorage1,
 				&minioObjStorage,
 			},
 		)
+		proxyModule.MaxAge = OBJECT_MAX_AGE
+		proxyModule.MaxObjectSize = maxObjectSize
+		proxyModule.Upstream = upstreamPool
+		proxyModule.WarmHeadMetadata = WARM_HEAD
+		proxyModule.NegativeTTL = NEGATIVE_TTL
+		proxyModule.NegativeMaxBytes = NEGATIVE_BYTES
+		proxyModule.StaleIfError = STALE_IF_ERROR
+		proxyModule.Offline = OFFLINE
+		proxyModule.RequestTimeout = REQUEST_TIMEOUT
+		proxyModule.TTL = &proxy.TTLRules{Header: TTL_HEADER, Default: OBJECT_TTL}
+		proxyModule.StatsHandler = func(stats proxy.ProxyStatsEntry) {
+			// The server runs indefinitely, so only running counters are kept per request
+			connectionCounter.Lock()
+			if connectionCounter.decisions == nil {
+				connectionCounter.decisions = make(map[string]int)
+			}
+			connectionCounter.decisions[stats.CacheDecision]++
+			connectionCounter.Unlock()
+		}
 
 		// Setup worker pool
 		jobQueue := make(chan ProxyTask, MAX_BUFFER_SIZE)
@@ -411,6 +541,15 @@ func main() {
 	go func() {
 		<-sigt
 
+		if cacheModule != nil {
+			color.HiBlue("Writing memory cache snapshot to %s", SNAPSHOT_PATH)
+			if saved, err := cacheModule.SaveSnapshot(SNAPSHOT_PATH); err != nil {
+				color.HiRed("%v", err)
+			} else {
+				color.HiBlue("Saved %d entries", saved)
+			}
+		}
+
 		color.HiBlue("Writing cache stats to file")
 		stats, err := os.Create(fmt.Sprintf("cache-stats-%s.csv", time.Now().Format("2006-01-02--15-04-05")))
 		if err != nil {
@@ -420,7 +559,10 @@ func main() {
 		defer stats.Close()
 		cacheModule.GetStats().WriteCSV(stats)
 
-		if TIMED {
+		connectionCounter.Lock()
+		defer connectionCounter.Unlock()
+
+		if len(connectionCounter.collectedStats) > 0 {
 			color.HiBlue("Writing proxy stats to file")
 			pStats, err := os.Create(fmt.Sprintf("proxy-stats-%s.csv", time.Now().Format("2006-01-02--15-04-05")))
 			if err != nil {
@@ -429,12 +571,46 @@ func main() {
 
 			defer pStats.Close()
 
-			pStats.WriteString("total, cacheRetrieve, initialize, readRequest, dialRemote, writeRequest, readResponse, writeResponse, cacheMiss, forwarded, failed, objectKey, workerID\n")
+			pStats.WriteString("total, cacheRetrieve, initialize, readRequest, dialRemote, writeRequest, readResponse, writeResponse, connReused, cacheMiss, forwarded, failed, cacheDecision, objectKey, workerID\n")
 			for _, s := range connectionCounter.collectedStats {
-				pStats.WriteString(fmt.Sprintf("%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v\n", s.Total, s.CacheRetrieve, s.Initialize, s.ReadRequest, s.DialRemote, s.WriteRequest, s.ReadResponse, s.WriteResponse, s.CacheMiss, s.Forwarded, s.Failed, s.ObjectKey, s.WorkerID))
+				pStats.WriteString(fmt.Sprintf("%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v\n", s.Total, s.CacheRetrieve, s.Initialize, s.ReadRequest, s.DialRemote, s.WriteRequest, s.ReadResponse, s.WriteResponse, s.ConnReused, s.CacheMiss, s.Forwarded, s.Failed, s.CacheDecision, s.ObjectKey, s.WorkerID))
 			}
 		}
 
+		if len(connectionCounter.decisions) > 0 {
+			decisions := make([]string, 0, len(connectionCounter.decisions))
+			for decision := range connectionCounter.decisions {
+				decisions = append(decisions, decision)
+			}
+			sort.Strings(decisions)
+			for _, decision := range decisions {
+				color.HiBlue("Cache decision %q: %d requests", decision, connectionCounter.decisions[decision])
+			}
+		}
+
+		if tieredCache != nil {
+			tierStats := tieredCache.Stats()
+			for _, t := range tierStats.Tiers {
+				color.HiBlue("Cache tier %s: %d hits, %d promotions, %d failed writes", t.Name, t.Hits, t.Promotions, t.Failures)
+			}
+			color.HiBlue("Cache misses: %d", tierStats.Misses)
+		}
+
+		if compressedCache != nil {
+			compression := compressedCache.Stats()
+			color.HiBlue("Cache compression: %d compressed, %d stored as they are, ratio %.2f", compression.Compressed, compression.Skipped, compression.Ratio())
+		}
+
+		if admissionCache != nil {
+			admission := admissionCache.Stats()
+			color.HiBlue("Cache admission: %d admitted, %d rejected", admission.Admitted, admission.Rejected)
+		}
+
+		if upstreamPool != nil {
+			poolStats := upstreamPool.Stats()
+			color.HiBlue("Upstream connections: %d reused, %d dialed, %d idle", poolStats.Hits, poolStats.Misses, poolStats.Idle)
+		}
+
 		fmt.Println("Exiting...")
 		os.Exit(0)
 	}()
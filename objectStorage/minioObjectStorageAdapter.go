@@ -3,6 +3,7 @@ package objectStorage
 import (
 	"automatic-cache-object-storage/cache"
 	"bytes"
+	"encoding/xml"
 	"io"
 	"net/http"
 	"strings"
@@ -19,11 +20,16 @@ func (mosa *MinioObjectStorageAdapter) ExtractObjectKey(req *http.Request) strin
 }
 
 func (mosa *MinioObjectStorageAdapter) CreateLocalResponse(object *cache.Object) (*http.Response, error) {
+	status := http.StatusOK
+	if object.StatusCode != 0 {
+		// Negative entry, the cached error response of the storage
+		status = object.StatusCode
+	}
 	response := &http.Response{
 		Proto:         "HTTP/1.1",
 		ProtoMajor:    1,
 		ProtoMinor:    1,
-		StatusCode:    http.StatusOK,
+		StatusCode:    status,
 		ContentLength: int64(len(*object.Data)),
 		Header:        object.OriginalHeaders,
 		Body:          io.NopCloser(bytes.NewReader(*object.Data)),
@@ -31,6 +37,106 @@ func (mosa *MinioObjectStorageAdapter) CreateLocalResponse(object *cache.Object)
 	return response, nil
 }
 
+// deleteObjectsRequest is the body of a S3 DeleteObjects (multi-object delete) request
+type deleteObjectsRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+// Multi-object delete requests are limited to 1000 keys, which fits well into this size
+const maxDeleteObjectsBodySize = 2 << 20
+
+/*
+ExtractInvalidatedKeys returns the cache keys of the objects that are changed by a mutating request:
+PutObject, CopyObject (the destination), DeleteObject, CompleteMultipartUpload and DeleteObjects.
+Other requests, including uploads of single parts, return no keys. The body of a DeleteObjects
+request is read to find the deleted keys and replaced, so the request can still be forwarded.
+*/
+func (mosa *MinioObjectStorageAdapter) ExtractInvalidatedKeys(req *http.Request) ([]string, error) {
+	if !strings.Contains(req.Host, mosa.Host) {
+		return nil, nil
+	}
+
+	path := strings.SplitN(req.URL.Path, "/", 3)
+	if len(path) < 2 || !validateBucketName(path[1]) {
+		return nil, nil
+	}
+	bucket := path[1]
+	objectKey := ""
+	if len(path) == 3 {
+		objectKey = path[2]
+	}
+
+	query := req.URL.Query()
+	_, multipart := query["uploadId"]
+
+	switch req.Method {
+	case http.MethodPut:
+		// PutObject and CopyObject, parts of a multipart upload are not visible before completion
+		if objectKey != "" && !multipart {
+			return []string{mosa.cacheKey(req, bucket, objectKey)}, nil
+		}
+	case http.MethodDelete:
+		// DeleteObject, aborting a multipart upload does not change the object
+		if objectKey != "" && !multipart {
+			return []string{mosa.cacheKey(req, bucket, objectKey)}, nil
+		}
+	case http.MethodPost:
+		if objectKey != "" && multipart {
+			// CompleteMultipartUpload
+			return []string{mosa.cacheKey(req, bucket, objectKey)}, nil
+		}
+		if _, isDelete := query["delete"]; objectKey == "" && isDelete {
+			return mosa.extractDeletedKeys(req, bucket)
+		}
+	}
+	return nil, nil
+}
+
+// extractDeletedKeys reads the keys of a DeleteObjects request and restores the request body
+func (mosa *MinioObjectStorageAdapter) extractDeletedKeys(req *http.Request, bucket string) ([]string, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+
+	original := req.Body
+	body, err := io.ReadAll(io.LimitReader(original, maxDeleteObjectsBodySize))
+
+	// The remainder of an oversized body is still forwarded after the part that was read
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), original), original}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var deleteReq deleteObjectsRequest
+	err = xml.Unmarshal(body, &deleteReq)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(deleteReq.Objects))
+	for _, o := range deleteReq.Objects {
+		if o.Key != "" {
+			keys = append(keys, mosa.cacheKey(req, bucket, o.Key))
+		}
+	}
+	return keys, nil
+}
+
+/*
+cacheKey returns the key of the plain (unversioned, query-less) GET request for an object,
+in the same format as ExtractObjectKey.
+*/
+func (mosa *MinioObjectStorageAdapter) cacheKey(req *http.Request, bucket string, objectKey string) string {
+	return req.URL.Host + "/" + bucket + "/" + objectKey + "?"
+}
+
 func minIoisObjectKey(key string) bool {
 	return key != ""
 }
@@ -40,13 +146,14 @@ func (mosa *MinioObjectStorageAdapter) ShouldIntercept(req *http.Request) bool {
 		return false
 	}
 
-	if req.Method != http.MethodGet {
+	// HeadObject is answered from the metadata of the cached object
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
 		return false
 	}
 	path := strings.Split(req.URL.Path, "/")
 
 	hostOk := strings.Contains(req.Host, mosa.Host)
-	requestOk := req.Method == http.MethodGet && len(path) >= 3 && validateBucketName(path[1]) && minIoisObjectKey(getObjectPathFromURL(req.URL.String()))
+	requestOk := len(path) >= 3 && validateBucketName(path[1]) && minIoisObjectKey(getObjectPathFromURL(req.URL.String()))
 
 	return hostOk && requestOk
 }
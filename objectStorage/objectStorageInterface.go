@@ -9,4 +9,5 @@ type ObjectStorage interface {
 	ShouldIntercept(req *http.Request) bool
 	ExtractObjectKey(req *http.Request) string
 	CreateLocalResponse(object *cache.Object) (*http.Response, error)
+	ExtractInvalidatedKeys(req *http.Request) ([]string, error)
 }
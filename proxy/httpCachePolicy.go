@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"automatic-cache-object-storage/cache"
+)
+
+// Cache decisions recorded in ProxyStatsEntry.CacheDecision
+const (
+	DecisionHit          = "hit"            // Fresh cached object served
+	DecisionNegativeHit  = "negative-hit"   // Cached error response served for an object that does not exist
+	DecisionStale        = "stale"          // Stale cached object served, accepted by the client with max-stale or in offline mode
+	DecisionStaleIfError = "stale-if-error" // Stale cached object served, as the origin failed to revalidate it
+	DecisionMiss         = "miss"           // Object retrieved from the origin and stored
+	DecisionRevalidated  = "revalidated"    // Cached object revalidated with the origin before it was served
+	DecisionNotStored    = "not-stored"     // Origin response served without being stored (no-store, private, too large, not admitted)
+	DecisionOnlyIfCached = "only-if-cached" // Object not cached or not usable, the client or the offline mode do not allow a request to the origin
+	DecisionOriginError  = "origin-error"   // Origin answered without the object, its response was passed to the client
+	DecisionForwarded    = "forwarded"      // Request forwarded to the origin, the cache was not used
+	DecisionCanceled     = "canceled"       // Client went away or RequestTimeout expired before the request was answered
+)
+
+// Warning headers of stale responses (RFC 7234, section 5.5)
+const (
+	warningStale              = "110 - \"Response is Stale\""
+	warningRevalidationFailed = "111 - \"Revalidation Failed\""
+	warningDisconnected       = "112 - \"Disconnected Operation\""
+)
+
+// errNotCached is returned by initializers that only look up the cache and must not fill it
+var errNotCached = errors.New("object is not cached")
+
+/*
+notStorableError is returned by a cache fill when the origin response must not be stored. It carries
+the retrieved object, so the client that triggered the fill can still be answered without a second
+request to the origin.
+*/
+type notStorableError struct {
+	obj    *cache.Object
+	reason string
+}
+
+func (e *notStorableError) Error() string {
+	return "response must not be stored: " + e.reason
+}
+
+// cacheControl holds the directives of the Cache-Control headers, directive names are lower case
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range splitHeaderList(value) {
+			name, arg, _ := strings.Cut(directive, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if _, exists := cc[name]; !exists {
+				cc[name] = strings.Trim(strings.TrimSpace(arg), "\"")
+			}
+		}
+	}
+	return cc
+}
+
+// parseRequestCacheControl also honors "Pragma: no-cache" of HTTP/1.0 clients (RFC 9111, section 5.4)
+func parseRequestCacheControl(header http.Header) cacheControl {
+	cc := parseCacheControl(header)
+	if len(cc) == 0 {
+		for _, value := range header.Values("Pragma") {
+			for _, directive := range splitHeaderList(value) {
+				if strings.EqualFold(directive, "no-cache") {
+					cc["no-cache"] = ""
+				}
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, exists := cc[name]
+	return exists
+}
+
+/*
+seconds returns the delta-seconds argument of a directive. An invalid argument is treated as 0,
+so the response is considered stale rather than fresh for too long.
+*/
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	arg, exists := cc[name]
+	if !exists {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		if errors.Is(err, strconv.ErrRange) {
+			return math.MaxInt32 * time.Second, true
+		}
+		return 0, true
+	}
+	if n > math.MaxInt32 {
+		n = math.MaxInt32
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+/*
+notStorableReason returns why an origin response must not be stored in a shared cache, or an empty
+string if it may be stored (RFC 9111, section 3). Requests to object storages always carry an
+Authorization header, so it does not prevent storing the response.
+*/
+func notStorableReason(reqCC cacheControl, resCC cacheControl) string {
+	switch {
+	case resCC.has("no-store"):
+		return "origin no-store"
+	case resCC.has("private"):
+		return "origin private"
+	case reqCC.has("no-store"):
+		return "client no-store"
+	}
+	return ""
+}
+
+/*
+freshnessLifetime returns the time a cached object is fresh after it was retrieved, from the s-maxage,
+max-age or Expires headers of the origin, in this order (RFC 9111, section 4.2.1). Without
+these headers the MaxAge of the object applies. Negative entries always use their own MaxAge.
+It also reports whether the lifetime is limited, objects without any lifetime never become stale.
+*/
+func freshnessLifetime(obj *cache.Object, resCC cacheControl) (time.Duration, bool) {
+
+	if obj.StatusCode != 0 {
+		return obj.MaxAge, true
+	}
+
+	// Origin no-cache: the object has to be revalidated before every use
+	if resCC.has("no-cache") {
+		return 0, true
+	}
+	if lifetime, ok := resCC.seconds("s-maxage"); ok {
+		return lifetime, true
+	}
+	if lifetime, ok := resCC.seconds("max-age"); ok {
+		return lifetime, true
+	}
+
+	header := http.Header(obj.OriginalHeaders)
+	if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			// Invalid dates, like "0", represent a time in the past
+			return 0, true
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = obj.StoredAt
+		}
+		if expiresAt.Before(date) {
+			return 0, true
+		}
+		return expiresAt.Sub(date), true
+	}
+
+	return obj.MaxAge, obj.MaxAge > 0
+}
+
+// currentAge returns the age of a cached object, including the age reported by the origin
+func currentAge(obj *cache.Object, now time.Time) time.Duration {
+	age := now.Sub(obj.StoredAt)
+	if age < 0 {
+		age = 0
+	}
+	originAge, err := strconv.ParseUint(http.Header(obj.OriginalHeaders).Get("Age"), 10, 32)
+	if err == nil {
+		age += time.Duration(originAge) * time.Second
+	}
+	return age
+}
+
+/*
+evaluateCachedObject decides whether a cached object can be served to the client without
+contacting the origin (RFC 9111, section 4). The freshness of the object is checked against the
+no-cache, max-age, min-fresh and max-stale directives of the client. Stale objects are only served
+if the client accepts them with max-stale and the origin did not require revalidation.
+It returns the decision for the stats if the object can be served.
+*/
+func evaluateCachedObject(reqCC cacheControl, obj *cache.Object, now time.Time) (string, bool) {
+
+	resCC := parseCacheControl(obj.OriginalHeaders)
+	if reqCC.has("no-cache") || resCC.has("no-cache") {
+		return "", false
+	}
+
+	lifetime, limited := freshnessLifetime(obj, resCC)
+	age := currentAge(obj, now)
+
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return "", false
+	}
+	if !limited {
+		return DecisionHit, true
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok && lifetime-age < minFresh {
+		return "", false
+	}
+	if age <= lifetime {
+		return DecisionHit, true
+	}
+
+	// The object is stale. s-maxage implies proxy-revalidate (RFC 9111, section 5.2.2.10)
+	if resCC.has("must-revalidate") || resCC.has("proxy-revalidate") || resCC.has("s-maxage") {
+		return "", false
+	}
+	if maxStaleArg, exists := reqCC["max-stale"]; exists {
+		maxStale, _ := reqCC.seconds("max-stale")
+		if maxStaleArg == "" || age-lifetime <= maxStale {
+			return DecisionStale, true
+		}
+	}
+	return "", false
+}
+
+/*
+staleIfErrorAllowed reports whether a stale object may be served when the origin fails to revalidate it.
+Objects the origin requires to be revalidated are never served stale, the stale-if-error directive
+of the origin or the client limits the staleness (RFC 5861, section 4).
+*/
+func staleIfErrorAllowed(reqCC cacheControl, obj *cache.Object, now time.Time) bool {
+
+	resCC := parseCacheControl(obj.OriginalHeaders)
+	if resCC.has("must-revalidate") || resCC.has("proxy-revalidate") || resCC.has("s-maxage") {
+		return false
+	}
+
+	lifetime, _ := freshnessLifetime(obj, resCC)
+	staleness := currentAge(obj, now) - lifetime
+	for _, cc := range []cacheControl{resCC, reqCC} {
+		if limit, ok := cc.seconds("stale-if-error"); ok && staleness > limit {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+isOriginFailure reports whether a revalidation failed because the origin is unreachable, timed out,
+or answered with a server error. Other error responses of the origin are valid answers.
+*/
+func isOriginFailure(err error) bool {
+	var originErr *originResponseError
+	if errors.As(err, &originErr) {
+		return originErr.res.StatusCode >= http.StatusInternalServerError
+	}
+	return !errors.Is(err, errObjectTooLarge)
+}
+
+// withWarning returns a copy of a cached object with a Warning header added
+func withWarning(obj *cache.Object, warning string) *cache.Object {
+	warned := *obj
+	header := http.Header(obj.OriginalHeaders).Clone()
+	header.Add("Warning", warning)
+	warned.OriginalHeaders = header
+	return &warned
+}
+
+// newGatewayTimeoutResponse answers an only-if-cached request that can not be served from the cache
+func newGatewayTimeoutResponse(req *http.Request) *http.Response {
+	return &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		StatusCode:    http.StatusGatewayTimeout,
+		Header:        http.Header{},
+		ContentLength: 0,
+		Body:          http.NoBody,
+		Request:       req,
+	}
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"automatic-cache-object-storage/cache"
+)
+
+func TestEvaluateCachedObject(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		origin   string // Cache-Control of the origin response
+		expires  string
+		age      time.Duration
+		maxAge   time.Duration // MaxAge configured in the proxy
+		client   string        // Cache-Control of the client request
+		decision string
+		ok       bool
+	}{
+		{"no lifetime never stale", "", "", time.Hour, 0, "", DecisionHit, true},
+		{"proxy max-age fresh", "", "", time.Minute, time.Hour, "", DecisionHit, true},
+		{"proxy max-age stale", "", "", 2 * time.Hour, time.Hour, "", "", false},
+		{"origin max-age overrides proxy", "max-age=60", "", 2 * time.Minute, time.Hour, "", "", false},
+		{"origin s-maxage overrides max-age", "max-age=60, s-maxage=600", "", 2 * time.Minute, 0, "", DecisionHit, true},
+		{"origin no-cache", "no-cache", "", 0, 0, "", "", false},
+		{"expires in the future", "", now.Add(time.Hour).UTC().Format(http.TimeFormat), time.Minute, 0, "", DecisionHit, true},
+		{"invalid expires", "", "0", time.Minute, 0, "", "", false},
+		{"client no-cache", "max-age=600", "", 0, 0, "no-cache", "", false},
+		{"client max-age exceeded", "max-age=600", "", 2 * time.Minute, 0, "max-age=60", "", false},
+		{"client max-age satisfied", "max-age=600", "", 2 * time.Minute, 0, "max-age=300", DecisionHit, true},
+		{"client min-fresh", "max-age=600", "", 5 * time.Minute, 0, "min-fresh=400", "", false},
+		{"client max-stale", "max-age=60", "", 2 * time.Minute, 0, "max-stale=120", DecisionStale, true},
+		{"client max-stale exceeded", "max-age=60", "", 5 * time.Minute, 0, "max-stale=120", "", false},
+		{"client max-stale without limit", "max-age=60", "", time.Hour, 0, "max-stale", DecisionStale, true},
+		{"must-revalidate ignores max-stale", "max-age=60, must-revalidate", "", 2 * time.Minute, 0, "max-stale", "", false},
+	}
+
+	for _, test := range tests {
+		header := http.Header{}
+		if test.origin != "" {
+			header.Set("Cache-Control", test.origin)
+		}
+		if test.expires != "" {
+			header.Set("Expires", test.expires)
+			header.Set("Date", now.UTC().Format(http.TimeFormat))
+		}
+		obj := &cache.Object{OriginalHeaders: header, StoredAt: now.Add(-test.age), MaxAge: test.maxAge}
+
+		reqHeader := http.Header{}
+		if test.client != "" {
+			reqHeader.Set("Cache-Control", test.client)
+		}
+
+		decision, ok := evaluateCachedObject(parseRequestCacheControl(reqHeader), obj, now)
+		if decision != test.decision || ok != test.ok {
+			t.Errorf("%s: Expected (%q, %v), but got (%q, %v)", test.name, test.decision, test.ok, decision, ok)
+		}
+	}
+}
+
+func TestNotStorableReason(t *testing.T) {
+	tests := []struct {
+		client, origin string
+		storable       bool
+	}{
+		{"", "max-age=60", true},
+		{"", "public", true},
+		{"", "no-store", false},
+		{"", "private", false},
+		{"", "Private=\"Set-Cookie\"", false},
+		{"no-store", "", false},
+	}
+
+	for _, test := range tests {
+		reqCC := parseCacheControl(http.Header{"Cache-Control": {test.client}})
+		resCC := parseCacheControl(http.Header{"Cache-Control": {test.origin}})
+		if storable := notStorableReason(reqCC, resCC) == ""; storable != test.storable {
+			t.Errorf("client %q, origin %q: Expected storable %v, but got %v", test.client, test.origin, test.storable, storable)
+		}
+	}
+}
+
+func TestHttpCachingProxy_CacheControl(t *testing.T) {
+	decisions := make(chan string, 16)
+	_, origin, proxyAddr := newTestCachingProxy(t, func(p *HttpCachingProxy) {
+		p.StatsHandler = func(stats ProxyStatsEntry) {
+			decisions <- stats.CacheDecision
+		}
+	})
+	host := origin.addr().String()
+	origin.setHeader("/bucket/nostore", "Cache-Control", "no-store")
+	origin.setHeader("/bucket/private", "Cache-Control", "private, max-age=60")
+	origin.setHeader("/bucket/key", "Cache-Control", "max-age=3600")
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	send := func(path string, headers string, expectedStatus int, expectedDecision string) {
+		t.Helper()
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", path, host, headers)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		readBody(t, res)
+		if res.StatusCode != expectedStatus {
+			t.Errorf("%s %q: Expected status %d, but got %d", path, headers, expectedStatus, res.StatusCode)
+		}
+		if decision := <-decisions; decision != expectedDecision {
+			t.Errorf("%s %q: Expected decision %s, but got %s", path, headers, expectedDecision, decision)
+		}
+	}
+
+	// Test case: Responses that must not be stored are served to the client only
+	for _, path := range []string{"/bucket/nostore", "/bucket/private"} {
+		send(path, "", http.StatusOK, DecisionNotStored)
+		send(path, "Range: bytes=0-3\r\n", http.StatusPartialContent, DecisionNotStored)
+	}
+	if n := origin.requests.Load(); n != 4 {
+		t.Errorf("Expected 4 origin requests, but got %d", n)
+	}
+
+	// Test case: Fresh objects are served from the cache
+	send("/bucket/key", "", http.StatusOK, DecisionMiss)
+	send("/bucket/key", "", http.StatusOK, DecisionHit)
+
+	// Test case: Client no-cache revalidates the cached object
+	send("/bucket/key", "Cache-Control: no-cache\r\n", http.StatusOK, DecisionRevalidated)
+	send("/bucket/key", "Pragma: no-cache\r\n", http.StatusOK, DecisionRevalidated)
+	if n := origin.requests.Load(); n != 7 {
+		t.Errorf("Expected 7 origin requests, but got %d", n)
+	}
+
+	// Test case: only-if-cached is answered without contacting the origin
+	send("/bucket/key", "Cache-Control: only-if-cached\r\n", http.StatusOK, DecisionHit)
+	send("/bucket/other", "Cache-Control: only-if-cached\r\n", http.StatusGatewayTimeout, DecisionOnlyIfCached)
+	if n := origin.requests.Load(); n != 7 {
+		t.Errorf("Expected 7 origin requests, but got %d", n)
+	}
+}
+
+func TestHttpCachingProxy_StaleIfError(t *testing.T) {
+	for _, staleIfError := range []bool{false, true} {
+		_, origin, proxyAddr := newTestCachingProxy(t, func(p *HttpCachingProxy) {
+			p.StaleIfError = staleIfError
+		})
+		host := origin.addr().String()
+		// Every request revalidates the cached object
+		origin.setHeader("/bucket/key", "Cache-Control", "max-age=0")
+
+		get := func() *http.Response {
+			t.Helper()
+			conn, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				t.Fatalf("Failed to connect to proxy: %v", err)
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "GET /bucket/key HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+			res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			readBody(t, res)
+			return res
+		}
+
+		get()
+		time.Sleep(10 * time.Millisecond)
+
+		// Test case: Server errors of the origin
+		origin.failing.Store(true)
+		res := get()
+		if staleIfError {
+			if res.StatusCode != http.StatusOK || res.Header.Get("Warning") != warningRevalidationFailed {
+				t.Errorf("Expected stale object with warning, but got status %d and warning %q", res.StatusCode, res.Header.Get("Warning"))
+			}
+		} else if res.StatusCode != http.StatusInternalServerError {
+			t.Errorf("Expected status 500, but got %d", res.StatusCode)
+		}
+
+		// Test case: Unreachable origin
+		origin.server.Close()
+		res = get()
+		if staleIfError {
+			if res.StatusCode != http.StatusOK || res.Header.Get("Warning") != warningRevalidationFailed {
+				t.Errorf("Expected stale object with warning, but got status %d and warning %q", res.StatusCode, res.Header.Get("Warning"))
+			}
+		} else if res.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected status 503, but got %d", res.StatusCode)
+		}
+	}
+}
+
+func TestHttpCachingProxy_Offline(t *testing.T) {
+	p, origin, proxyAddr := newTestCachingProxy(t, func(p *HttpCachingProxy) {
+		p.Offline = true
+	})
+	host := origin.addr().String()
+
+	// Requests read by the proxy have no host in the URL, so the adapter creates keys without it
+	data := []byte("cached")
+	p.Cache.Put(&cache.Object{Key: "/bucket/fresh?", Data: &data, OriginalHeaders: http.Header{}, StoredAt: time.Now()})
+	p.Cache.Put(&cache.Object{Key: "/bucket/stale?", Data: &data, OriginalHeaders: http.Header{}, StoredAt: time.Now().Add(-time.Hour), MaxAge: time.Minute})
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	tests := []struct {
+		request string
+		status  int
+		warning string
+	}{
+		{"GET /bucket/fresh HTTP/1.1\r\nHost: %s\r\n\r\n", http.StatusOK, ""},
+		{"GET /bucket/stale HTTP/1.1\r\nHost: %s\r\n\r\n", http.StatusOK, warningDisconnected},
+		{"GET /bucket/missing HTTP/1.1\r\nHost: %s\r\n\r\n", http.StatusGatewayTimeout, ""},
+		{"HEAD /bucket/stale HTTP/1.1\r\nHost: %s\r\n\r\n", http.StatusOK, warningDisconnected},
+		{"PUT /bucket/fresh HTTP/1.1\r\nHost: %s\r\nContent-Length: 3\r\n\r\nnew", http.StatusGatewayTimeout, ""},
+	}
+
+	for _, test := range tests {
+		fmt.Fprintf(conn, test.request, host)
+		req, _ := http.ReadRequest(bufio.NewReader(strings.NewReader(fmt.Sprintf(test.request, host))))
+		res, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		readBody(t, res)
+		if res.StatusCode != test.status {
+			t.Errorf("%q: Expected status %d, but got %d", test.request, test.status, res.StatusCode)
+		}
+		if warning := res.Header.Get("Warning"); warning != test.warning {
+			t.Errorf("%q: Expected warning %q, but got %q", test.request, test.warning, warning)
+		}
+	}
+
+	// Test case: The origin is never contacted
+	if n := origin.requests.Load(); n != 0 {
+		t.Errorf("Expected no origin request, but got %d", n)
+	}
+}
@@ -3,74 +3,304 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"time"
 
 	"automatic-cache-object-storage/cache"
 	"automatic-cache-object-storage/objectStorage"
 )
 
+// DefaultIdleTimeout is the time a persistent client connection may stay idle
+// between two requests before the proxy closes it.
+const DefaultIdleTimeout = 30 * time.Second
+
+// DefaultMaxObjectSize is the largest object stored in the cache by default. It matches the
+// entry size of the bigcache configuration and the default item size limit of memcached.
+const DefaultMaxObjectSize = 1000000
+
+// Error responses of the origin are small XML documents, larger bodies are truncated in log messages
+const maxErrorBodySize = 4096
+
 type HttpCachingProxy struct {
 	Cache                 cache.Cache
 	ObjectStorageAdapters []objectStorage.ObjectStorage
+	IdleTimeout           time.Duration         // Maximum time to wait for the next request on a persistent client connection
+	MaxAge                time.Duration         // Time a cached object is served before it is revalidated, unless the origin sets Cache-Control or Expires, 0 disables revalidation
+	MaxObjectSize         int64                 // Largest object body stored in the cache, larger objects are passed through, 0 means no limit
+	Upstream              *UpstreamPool         // Keep-alive connections to the origins
+	WarmHeadMetadata      bool                  // Cache only the metadata of objects requested with HEAD on a miss, without the body
+	StatsHandler          func(ProxyStatsEntry) // Receives the stats of every handled request, may be nil
+	NegativeTTL           time.Duration         // Time a 404 NoSuchKey response is served from the cache, 0 disables negative caching
+	NegativeCache403      bool                  // Also cache 403 responses as negative entries
+	NegativeMaxBytes      int64                 // Total size of the negative entries, the oldest are removed first, 0 means no limit
+	StaleIfError          bool                  // Serve stale objects when the origin fails to revalidate them
+	Offline               bool                  // Serve only from the cache, the origin is never contacted
+	RequestTimeout        time.Duration         // Maximum time to answer a request, slower requests are answered with 504 Gateway Timeout, 0 means no limit
+	TTL                   TTLPolicy             // Time to live of cached objects, after which the cache drops them, nil means objects do not expire
+
+	negatives negativeIndex
+	fills     cache.FlightGroup // Fills of a cache.StreamCache, which are coalesced by the proxy
 }
 
 func (p *HttpCachingProxy) handleHttpInternal(conn net.Conn, targetAddr net.Addr) {
 
 	defer conn.Close()
 
-	request, err := http.ReadRequest(bufio.NewReader(conn))
+	// The reader is shared by all requests on the connection, so pipelined
+	// requests that were already buffered are not lost between iterations.
+	reader := bufio.NewReader(conn)
 
-	if err != nil {
-		log.Printf("Failed to read request: %v", err)
-		return
+	for {
+		if p.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(p.IdleTimeout))
+		}
+
+		request, err := http.ReadRequest(reader)
+
+		if err != nil {
+			if err != io.EOF && !isTimeout(err) {
+				log.Printf("Failed to read request: %v", err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		// Requests are handled one at a time, so responses to pipelined
+		// requests are written back in the order the requests arrived.
+		start := time.Now()
+		stats := ProxyStatsEntry{}
+		ctx, cancel := p.requestContext(conn, reader, request)
+		keepAlive := p.handleRequest(conn, targetAddr, request.WithContext(ctx), &stats)
+		cancel()
+		stats.Total = time.Since(start).Nanoseconds()
+		if p.StatsHandler != nil {
+			p.StatsHandler(stats)
+		}
+		if !keepAlive {
+			return
+		}
+
+		// Discard any unread request body before reading the next request.
+		// Forwarding closes the body, which already consumed it.
+		_, err = io.Copy(io.Discard, request.Body)
+		request.Body.Close()
+		if err != nil && err != http.ErrBodyReadAfterClose {
+			return
+		}
 	}
+}
+
+/*
+requestContext returns the context of a request. It is canceled when the client closes the connection
+while the request is handled, and after RequestTimeout. The cancel function has to be called once the
+request was answered, before the next request is read from the reader.
+*/
+func (p *HttpCachingProxy) requestContext(conn net.Conn, reader *bufio.Reader, request *http.Request) (context.Context, context.CancelFunc) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if p.RequestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), p.RequestTimeout)
+	}
+
+	// The body of the request is read from the same reader, so only requests without body are watched
+	if request.Body != http.NoBody {
+		return ctx, cancel
+	}
+	stopWatching := watchClient(conn, reader, cancel)
+	return ctx, func() {
+		stopWatching()
+		cancel()
+	}
+}
+
+/*
+handleRequest serves a single request read from the client connection and reports
+whether the connection can be reused for the next request.
+*/
+func (p *HttpCachingProxy) handleRequest(conn net.Conn, targetAddr net.Addr, request *http.Request, stats *ProxyStatsEntry) bool {
+
+	keepAlive := shouldKeepAlive(request)
 
 	shouldIntercept, adapterIndex := p.shouldIntercept(request)
 
 	if shouldIntercept {
 		adapter := p.ObjectStorageAdapters[adapterIndex]
 		objKey := adapter.ExtractObjectKey(request)
+		reqCC := parseRequestCacheControl(request.Header)
 
-		initializer := func() (*cache.Object, error) {
-			return p.retrieveObjectFromRemote(request, targetAddr, objKey)
+		stats.ObjectKey = objKey
+
+		if request.Method == http.MethodHead {
+			return p.handleHead(conn, targetAddr, request, adapter, objKey, reqCC, keepAlive, stats)
+		}
+		if reqCC.has("only-if-cached") || p.Offline {
+			return p.handleOnlyIfCached(conn, targetAddr, request, adapter, objKey, reqCC, keepAlive, stats)
 		}
+		// Caches that only store complete objects are filled through the same stream as the others
+		return p.handleStreamCache(conn, targetAddr, request, adapter, cache.AsStreamCache(p.Cache), objKey, reqCC, keepAlive, stats)
+	}
 
-		cachedObj, err := p.Cache.Get(objKey, initializer)
-		if err == nil {
-			// Cache hit - Serve from cache
-
-			response, err := adapter.CreateLocalResponse(cachedObj)
-			if err != nil {
-				// Log and forward
-				log.Printf("Failed to create local response, forwarding connection: %v", err)
-				p.forward(conn, targetAddr, request)
-				return
-			}
+	// Request should not be intercepted - Forward request
+
+	if p.Offline {
+		stats.CacheDecision = DecisionOnlyIfCached
+		return writeLocalResponse(conn, newGatewayTimeoutResponse(request), keepAlive)
+	}
 
-			err = response.Write(conn)
+	stats.Forwarded = true
 
-			if err != nil {
-				log.Printf("Failed to send local response, forwarding connection: %v", err)
-				p.forward(conn, targetAddr, request)
+	invalidatedKeys := p.extractInvalidatedKeys(request)
+	if len(invalidatedKeys) > 0 {
+		return p.forwardMutation(conn, targetAddr, request, keepAlive, invalidatedKeys)
+	}
+
+	return p.forward(conn, targetAddr, request, keepAlive)
+}
+
+/*
+handleOnlyIfCached answers a request with the only-if-cached directive, or any request in offline mode,
+without contacting the origin. Objects that are not cached, or are too stale for the client, are
+answered with 504 Gateway Timeout (RFC 9111, section 5.2.1.7). In offline mode stale objects are served
+with a Warning header instead.
+*/
+func (p *HttpCachingProxy) handleOnlyIfCached(conn net.Conn, targetAddr net.Addr, request *http.Request, adapter objectStorage.ObjectStorage, objKey string, reqCC cacheControl, keepAlive bool, stats *ProxyStatsEntry) bool {
+
+	body, cachedObj, err := p.lookup(request.Context(), objKey)
+	if err == nil {
+		defer body.Close()
+		decision, ok := evaluateCachedObject(reqCC, cachedObj, time.Now())
+		if ok && decision == DecisionHit {
+			stats.CacheDecision = decision
+			return p.serveStream(conn, targetAddr, request, adapter, cachedObj, body, keepAlive)
+		}
+		if ok || p.Offline {
+			stats.CacheDecision = DecisionStale
+			warning := warningStale
+			if p.Offline {
+				warning = warningDisconnected
 			}
+			return p.serveStream(conn, targetAddr, request, adapter, withWarning(cachedObj, warning), body, keepAlive)
+		}
+	}
 
-			return
-		} else {
+	stats.CacheDecision = DecisionOnlyIfCached
+	return writeLocalResponse(conn, newGatewayTimeoutResponse(request), keepAlive)
+}
+
+/*
+lookup returns a cached object without filling the cache, together with its body, which has to be
+closed. The returned object only carries the metadata, the body is read from the cache while it is
+served.
+*/
+func (p *HttpCachingProxy) lookup(ctx context.Context, key string) (io.ReadSeekCloser, *cache.Object, error) {
+	return cache.AsStreamCache(p.Cache).GetStream(ctx, key)
+}
+
+/*
+serveFromCache answers the request with the cached object. Conditional and range requests are
+evaluated against the cached copy, so the origin is not contacted.
+*/
+func (p *HttpCachingProxy) serveFromCache(conn net.Conn, targetAddr net.Addr, request *http.Request, adapter objectStorage.ObjectStorage, cachedObj *cache.Object, keepAlive bool) bool {
+	return p.serveStream(conn, targetAddr, request, adapter, cachedObj, bytes.NewReader(*cachedObj.Data), keepAlive)
+}
+
+/*
+serveStream answers the request with the metadata of a cached object and a body read from the cache.
+The body is not closed.
+*/
+func (p *HttpCachingProxy) serveStream(conn net.Conn, targetAddr net.Addr, request *http.Request, adapter objectStorage.ObjectStorage, meta *cache.Object, body io.ReadSeeker, keepAlive bool) bool {
+
+	var response *http.Response
+
+	if status := checkPreconditions(request, meta.OriginalHeaders); status != 0 {
+		response = newPreconditionResponse(request, status, meta.OriginalHeaders)
+	} else {
+		size, err := body.Seek(0, io.SeekEnd)
+		if err == nil {
+			_, err = body.Seek(0, io.SeekStart)
+		}
+		if err == nil {
+			// The adapter creates the response from the metadata, the body is read from the cache
+			headerOnly := *meta
+			headerOnly.Data = &[]byte{}
+			response, err = adapter.CreateLocalResponse(&headerOnly)
+		}
+		if err != nil {
 			// Log and forward
-			log.Printf("Failed to retrieve object from cache, forwarding connection: %v", err)
-			p.forward(conn, targetAddr, request)
-			return
+			log.Printf("Failed to create local response, forwarding connection: %v", err)
+			return p.forward(conn, targetAddr, request, keepAlive)
 		}
+		response.ContentLength = size
+		response.Body = io.NopCloser(body)
 
+		// Requests for byte ranges are answered from the fully cached object
+		response = createRangeResponse(request, response, body, size)
 	}
 
-	// Request should not be intercepted - Forward request
+	// HEAD requests get the headers of the object without the body
+	response.Request = request
+	return writeLocalResponse(conn, response, keepAlive)
+}
+
+/*
+finishStreamed records the decision for a fill that already sent the origin response to the client,
+and reports whether the client connection can be reused. decision is recorded if the object was stored.
+*/
+func finishStreamed(request *http.Request, stream *streamedResponse, decision string, err error, stats *ProxyStatsEntry) bool {
+	var notStorable *notStorableError
+	var originErr *originResponseError
+	switch {
+	case err == nil:
+		stats.CacheDecision = decision
+	case errors.As(err, &originErr):
+		stats.CacheDecision = DecisionOriginError
+	case errors.Is(err, errObjectTooLarge) || errors.Is(err, cache.ErrNotAdmitted) || errors.As(err, &notStorable):
+		stats.CacheDecision = DecisionNotStored
+	case request.Context().Err() != nil:
+		stats.CacheDecision = DecisionCanceled
+		return false
+	default:
+		stats.CacheDecision = DecisionNotStored
+		stats.Failed = true
+		log.Printf("Failed to store object in cache: %v", err)
+	}
+	return stream.keepAlive
+}
+
+/*
+answerCanceled ends a request whose context is done before it was answered. A request that exceeded
+RequestTimeout is answered with 504 Gateway Timeout, the connection of a client that went away is closed.
+*/
+func answerCanceled(conn net.Conn, request *http.Request, keepAlive bool, stats *ProxyStatsEntry) bool {
+	stats.CacheDecision = DecisionCanceled
+	stats.Failed = true
+	if request.Context().Err() != context.DeadlineExceeded {
+		return false
+	}
+	return writeLocalResponse(conn, newGatewayTimeoutResponse(request), keepAlive)
+}
+
+// writeLocalResponse sends a response created by the proxy to the client and closes its body
+func writeLocalResponse(conn net.Conn, response *http.Response, keepAlive bool) bool {
+
+	response.Close = !keepAlive
+	err := response.Write(conn)
+	response.Body.Close()
+
+	if err != nil {
+		// Part of the response may already be on the wire, so the
+		// connection can not be used anymore
+		log.Printf("Failed to send local response: %v", err)
+		return false
+	}
 
-	p.forward(conn, targetAddr, request)
+	return keepAlive
 }
 
 func (p *HttpCachingProxy) HandleHttp(conn net.Conn, targetAddr net.Addr) {
@@ -87,91 +317,238 @@ func (p *HttpCachingProxy) shouldIntercept(req *http.Request) (bool, int) {
 	return false, -1
 }
 
-func (p *HttpCachingProxy) retrieveObjectFromRemote(req *http.Request, targetAddr net.Addr, objectKey string) (*cache.Object, error) {
-
-	// Retrieve object from remote storage
+/*
+revalidate checks a stale cached object against the origin with a conditional request built from
+its ETag and Last-Modified headers. A 304 Not Modified response refreshes the cached entry, a 200
+response replaces it. Responses that must not be stored remove the entry instead.
+The object that should be served to the client is returned.
+*/
+func (p *HttpCachingProxy) revalidate(req *http.Request, targetAddr net.Addr, cachedObj *cache.Object) (*cache.Object, error) {
 
-	errChan := make(chan error)
-	objChan := make(chan *cache.Object)
+	cachedHeader := http.Header(cachedObj.OriginalHeaders)
 
-	go func() {
+	res, body, err := p.fetchFromRemote(newRevalidationRequest(req, cachedHeader), targetAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revalidate object: %w", err)
+	}
 
-		targetConn, err := net.Dial("tcp", targetAddr.String())
-		if err != nil {
-			errChan <- fmt.Errorf("failed to connect to target: %v", err)
-			return
+	var obj *cache.Object
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		obj = p.newCachedObject(cachedObj.Key, mergeNotModified(cachedHeader, res.Header), *cachedObj.Data)
+	case http.StatusOK:
+		obj = p.newCachedObject(cachedObj.Key, res.Header, body)
+	default:
+		if p.isNegativeCacheable(res.StatusCode, body) {
+			obj = p.newNegativeObject(cachedObj.Key, res, body)
+			break
 		}
-		defer targetConn.Close()
-
-		err = req.Write(targetConn)
-		if err != nil {
-			errChan <- fmt.Errorf("failed to send request to target: %v", err)
-			return
+		if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone {
+			// The object was deleted from the storage
+			p.delete(cachedObj.Key)
+			p.negatives.remove(cachedObj.Key)
 		}
+		return nil, &originResponseError{res: res, body: body}
+	}
 
-		res, err := http.ReadResponse(bufio.NewReader(targetConn), req)
-		if err != nil {
-			errChan <- fmt.Errorf("failed to read response from target: %v", err)
-			return
-		}
+	if reason := notStorableReason(parseRequestCacheControl(req.Header), parseCacheControl(obj.OriginalHeaders)); reason != "" {
+		p.delete(cachedObj.Key)
+		p.negatives.remove(cachedObj.Key)
+		return obj, nil
+	}
 
-		if res.StatusCode != http.StatusOK {
-			body, err := io.ReadAll(res.Body)
-			if err != nil {
-				errChan <- fmt.Errorf("could not read non-OK response body")
-				return
-			}
-			errChan <- fmt.Errorf("received non-OK HTTP status: %s : %s", res.Status, string(body))
-			return
-		}
+	err = p.Cache.Put(obj)
+	if err != nil {
+		log.Printf("Failed to update revalidated object in cache: %v", err)
+	} else {
+		p.trackNegative(obj)
+	}
+	return obj, nil
+}
 
-		var buffer bytes.Buffer
-		_, err = buffer.ReadFrom(res.Body)
+// newRevalidationRequest derives a conditional request from a client request and the headers of the cached object
+func newRevalidationRequest(req *http.Request, cachedHeader http.Header) *http.Request {
+	revalidationReq := newFillRequest(req)
+	if etag := cachedHeader.Get("ETag"); etag != "" {
+		revalidationReq.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := cachedHeader.Get("Last-Modified"); lastModified != "" {
+		revalidationReq.Header.Set("If-Modified-Since", lastModified)
+	}
+	return revalidationReq
+}
 
-		if err != nil {
-			errChan <- err
-			return
+// mergeNotModified updates the cached headers with the ones sent with a 304 response (RFC 9111, section 4.3.4)
+func mergeNotModified(cachedHeader http.Header, notModifiedHeader http.Header) http.Header {
+	header := cachedHeader.Clone()
+	for name, values := range removeHopHeaders(notModifiedHeader) {
+		if name != "Content-Length" {
+			header[name] = values
 		}
-		data := buffer.Bytes()
-		object := &cache.Object{
-			Key:             objectKey,
-			OriginalHeaders: res.Header,
-			Data:            &data,
-		}
-		errChan <- nil
-		objChan <- object
-	}()
+	}
+	return header
+}
 
-	if err := <-errChan; err != nil {
-		return nil, fmt.Errorf("failed to retrieve object from remote: %v", err)
+// newCachedObject creates a cache entry that is fresh for the configured max-age and expires after its TTL
+func (p *HttpCachingProxy) newCachedObject(key string, header http.Header, data []byte) *cache.Object {
+	now := time.Now()
+	return &cache.Object{
+		Key:             key,
+		OriginalHeaders: removeHopHeaders(header),
+		Data:            &data,
+		StoredAt:        now,
+		MaxAge:          p.MaxAge,
+		ExpiresAt:       p.expiresAt(key, header, now),
 	}
-	return <-objChan, nil
 }
 
-func (p *HttpCachingProxy) forward(conn net.Conn, targetAddr net.Addr, req *http.Request) {
+/*
+fetchFromRemote sends the request to the target and reads the complete response, the returned
+response body is already consumed. Bodies larger than MaxObjectSize are not read and
+errObjectTooLarge is returned instead.
+*/
+func (p *HttpCachingProxy) fetchFromRemote(req *http.Request, targetAddr net.Addr) (*http.Response, []byte, error) {
 
-	targetConn, err := net.Dial("tcp", targetAddr.String())
+	res, _, err := p.Upstream.RoundTrip(req, targetAddr)
 	if err != nil {
-		conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n\r\n"))
-		return
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	fill := newCacheFillBuffer(p.MaxObjectSize, res.ContentLength)
+	if fill.overflow {
+		return nil, nil, errObjectTooLarge
+	}
+	_, err = io.Copy(fill, res.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read response body from target: %v", err)
+	}
+	if fill.overflow {
+		return nil, nil, errObjectTooLarge
 	}
-	defer targetConn.Close()
+
+	return res, fill.buffer.Bytes(), nil
+}
+
+// Request headers that are evaluated by the proxy against the cached copy instead of the origin
+var fillRequestExcludeHeaders = []string{
+	"Range",
+	"If-Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+}
+
+/*
+newFillRequest derives the request used to fill the cache from a client request. The cache always
+stores complete objects, so range and conditional headers are removed and evaluated against the
+cached copy.
+*/
+func newFillRequest(req *http.Request) *http.Request {
+	fillReq := req.Clone(req.Context())
+	for _, name := range fillRequestExcludeHeaders {
+		fillReq.Header.Del(name)
+	}
+	return fillReq
+}
+
+/*
+forward sends the request to the target and relays the response to the client. It reports
+whether the client connection can be reused for the next request.
+*/
+func (p *HttpCachingProxy) forward(conn net.Conn, targetAddr net.Addr, req *http.Request, keepAlive bool) bool {
 
 	// Forward request
-	req.Write(targetConn)
+	res, _, err := p.Upstream.RoundTrip(req, targetAddr)
+	if err != nil {
+		log.Printf("Failed to forward request: %v", err)
+		conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n\r\n"))
+		return false
+	}
 
 	// Forward response
-	res, err := http.ReadResponse(bufio.NewReader(targetConn), req)
+	return relayResponse(conn, res, keepAlive)
+}
+
+/*
+forwardMutation forwards a request that changes objects in the storage. Once the origin reports
+success, the cached copies of the changed objects are removed, before the response is relayed,
+so the client can not read a stale copy after seeing its write succeed.
+*/
+func (p *HttpCachingProxy) forwardMutation(conn net.Conn, targetAddr net.Addr, req *http.Request, keepAlive bool, invalidatedKeys []string) bool {
+
+	res, _, err := p.Upstream.RoundTrip(req, targetAddr)
 	if err != nil {
+		log.Printf("Failed to forward request: %v", err)
 		conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n\r\n"))
-		return
+		return false
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		p.invalidate(invalidatedKeys)
+	}
+
+	return relayResponse(conn, res, keepAlive)
+}
+
+// extractInvalidatedKeys returns the cache keys of the objects changed by a mutating request
+func (p *HttpCachingProxy) extractInvalidatedKeys(req *http.Request) []string {
+	for _, adapter := range p.ObjectStorageAdapters {
+		keys, err := adapter.ExtractInvalidatedKeys(req)
+		if err != nil {
+			log.Printf("Failed to extract invalidated keys: %v", err)
+			continue
+		}
+		if len(keys) > 0 {
+			return keys
+		}
+	}
+	return nil
+}
+
+// invalidate removes the objects and their cached metadata from the cache
+func (p *HttpCachingProxy) invalidate(keys []string) {
+	for _, key := range keys {
+		// Negative entries share the key of the object
+		p.delete(key)
+		p.negatives.remove(key)
+		if p.WarmHeadMetadata {
+			p.delete(metadataKey(key))
+		}
+	}
+}
+
+func (p *HttpCachingProxy) delete(key string) {
+	err := p.Cache.Delete(key)
+	if err != nil && err != cache.ErrCacheMiss {
+		log.Printf("Failed to invalidate object %s: %v", key, err)
+	}
+}
+
+/*
+relayResponse writes a response of the origin to the client and closes its body. It reports
+whether the client connection can be reused for the next request.
+*/
+func relayResponse(conn net.Conn, res *http.Response, keepAlive bool) bool {
+	defer res.Body.Close()
+
+	res.Close = res.Close || !keepAlive
+	err := res.Write(conn)
+	if err != nil {
+		log.Printf("Failed to forward response: %v", err)
+		return false
 	}
-	res.Write(conn)
+	return !responseClosesConnection(res)
 }
 
 func NewHttpCachingProxy(cache cache.Cache, objectStorageAdapters []objectStorage.ObjectStorage) *HttpCachingProxy {
 	return &HttpCachingProxy{
 		Cache:                 cache,
 		ObjectStorageAdapters: objectStorageAdapters,
+		IdleTimeout:           DefaultIdleTimeout,
+		MaxObjectSize:         DefaultMaxObjectSize,
+		Upstream:              NewUpstreamPool(DefaultMaxIdleConns, DefaultIdleConnTimeout),
 	}
 }
@@ -0,0 +1,694 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"automatic-cache-object-storage/cache"
+	"automatic-cache-object-storage/objectStorage"
+)
+
+// mapCache is a minimal synchronous cache.Cache used to make the proxy tests deterministic
+type mapCache struct {
+	store map[string]*cache.Object
+	sync.Mutex
+}
+
+func newMapCache() *mapCache {
+	return &mapCache{store: make(map[string]*cache.Object)}
+}
+
+func (c *mapCache) Get(key string, initializer cache.Initializer) (*cache.Object, error) {
+	if initializer == nil {
+		return c.GetContext(context.Background(), key, nil)
+	}
+	return c.GetContext(context.Background(), key, func(context.Context) (*cache.Object, error) {
+		return initializer()
+	})
+}
+
+func (c *mapCache) GetContext(ctx context.Context, key string, initializer cache.ContextInitializer) (*cache.Object, error) {
+	c.Lock()
+	obj, exists := c.store[key]
+	c.Unlock()
+	if exists {
+		return obj, nil
+	}
+	if initializer == nil {
+		return nil, cache.ErrInitializerNil
+	}
+	obj, err := initializer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.Put(obj)
+	return obj, nil
+}
+
+func (c *mapCache) GetTimed(key string, initializer cache.Initializer) (*cache.Object, int64, int64, error) {
+	obj, err := c.Get(key, initializer)
+	return obj, 0, 0, err
+}
+
+func (c *mapCache) Put(o *cache.Object) error {
+	c.Lock()
+	defer c.Unlock()
+	c.store[o.Key] = o
+	return nil
+}
+
+func (c *mapCache) PutContext(ctx context.Context, o *cache.Object) error {
+	return c.Put(o)
+}
+
+func (c *mapCache) DeleteContext(ctx context.Context, key string) error {
+	return c.Delete(key)
+}
+
+func (c *mapCache) Delete(key string) error {
+	c.Lock()
+	defer c.Unlock()
+	if _, exists := c.store[key]; !exists {
+		return cache.ErrCacheMiss
+	}
+	delete(c.store, key)
+	return nil
+}
+
+// testOrigin is an object storage stand-in that serves the request path as object content,
+// unless the content of the object was replaced with setObject or a PUT request
+type testOrigin struct {
+	server   *httptest.Server
+	requests atomic.Int64
+	objects  map[string]string
+	headers  map[string]http.Header
+	failing  atomic.Bool  // Answer all requests with 500 Internal Server Error
+	stalled  atomic.Bool  // Do not answer requests until they are aborted by the proxy
+	delay    atomic.Int64 // Nanoseconds to wait before answering a request
+	aborted  chan string  // Paths of the stalled requests aborted by the proxy
+	lastReq  *http.Request
+	sync.Mutex
+}
+
+func newTestOrigin(t *testing.T) *testOrigin {
+	origin := &testOrigin{objects: make(map[string]string), headers: make(map[string]http.Header), aborted: make(chan string, 16)}
+	origin.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin.requests.Add(1)
+		if origin.stalled.Load() {
+			<-r.Context().Done()
+			origin.aborted <- r.URL.Path
+			return
+		}
+		time.Sleep(time.Duration(origin.delay.Load()))
+		if origin.failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		origin.Lock()
+		origin.lastReq = r
+		body, exists := origin.objects[r.URL.Path]
+		for name, values := range origin.headers[r.URL.Path] {
+			w.Header()[name] = values
+		}
+		origin.Unlock()
+
+		if strings.Contains(r.URL.RawQuery, "location") {
+			fmt.Fprint(w, "location")
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			origin.setObject(r.URL.Path, string(data))
+			return
+		case http.MethodDelete:
+			origin.Lock()
+			delete(origin.objects, r.URL.Path)
+			origin.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/bucket/missing") && !exists {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, noSuchKeyBody)
+			return
+		}
+		if !exists {
+			body = "data" + r.URL.Path
+		}
+		etag := etagOf(body)
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(origin.server.Close)
+	return origin
+}
+
+// Error response of the test origin for objects below /bucket/missing that were not uploaded
+const noSuchKeyBody = "<Error><Code>NoSuchKey</Code></Error>"
+
+func etagOf(body string) string {
+	return fmt.Sprintf("\"%x\"", md5.Sum([]byte(body)))
+}
+
+func (o *testOrigin) setObject(path string, body string) {
+	o.Lock()
+	defer o.Unlock()
+	o.objects[path] = body
+}
+
+// setHeader adds a header to the responses for an object
+func (o *testOrigin) setHeader(path string, name string, value string) {
+	o.Lock()
+	defer o.Unlock()
+	if o.headers[path] == nil {
+		o.headers[path] = http.Header{}
+	}
+	o.headers[path].Set(name, value)
+}
+
+func (o *testOrigin) lastRequest() *http.Request {
+	o.Lock()
+	defer o.Unlock()
+	return o.lastReq
+}
+
+func (o *testOrigin) addr() net.Addr {
+	return o.server.Listener.Addr()
+}
+
+// startTestProxy serves the proxy on a local listener and returns its address
+func startTestProxy(t *testing.T, p *HttpCachingProxy, targetAddr net.Addr) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start listener: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.HandleHttp(conn, targetAddr)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// newTestCachingProxy starts a caching proxy in front of a test origin, configure is applied before the proxy starts
+func newTestCachingProxy(t *testing.T, configure ...func(p *HttpCachingProxy)) (*HttpCachingProxy, *testOrigin, string) {
+	origin := newTestOrigin(t)
+	adapter := objectStorage.NewMinIOAdapter(origin.addr().String())
+	p := NewHttpCachingProxy(newMapCache(), []objectStorage.ObjectStorage{&adapter})
+	for _, c := range configure {
+		c(p)
+	}
+	return p, origin, startTestProxy(t, p, origin.addr())
+}
+
+func readBody(t *testing.T, res *http.Response) string {
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("Failed to read response body: %v", err)
+	}
+	return string(body)
+}
+
+func TestHttpCachingProxy_KeepAlive(t *testing.T) {
+	_, origin, proxyAddr := newTestCachingProxy(t)
+	host := origin.addr().String()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	paths := []string{"/bucket/a", "/bucket/a", "/bucket/b"}
+	for _, path := range paths {
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, host)
+
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response for %s: %v", path, err)
+		}
+		if body := readBody(t, res); body != "data"+path {
+			t.Errorf("Expected body %s, but got %s", "data"+path, body)
+		}
+		if res.Close {
+			t.Errorf("Expected persistent connection for %s", path)
+		}
+	}
+
+	// The second request for /bucket/a must be served from cache
+	if n := origin.requests.Load(); n != 2 {
+		t.Errorf("Expected 2 origin requests, but got %d", n)
+	}
+}
+
+func TestHttpCachingProxy_Pipelining(t *testing.T) {
+	_, origin, proxyAddr := newTestCachingProxy(t)
+	host := origin.addr().String()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	// Cache miss, cache hit, forwarded request and another miss, sent in a single write
+	paths := []string{"/bucket/a", "/bucket/a", "/bucket/?location", "/bucket/b"}
+	expected := []string{"data/bucket/a", "data/bucket/a", "location", "data/bucket/b"}
+
+	var pipeline strings.Builder
+	for _, path := range paths {
+		fmt.Fprintf(&pipeline, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, host)
+	}
+	_, err = conn.Write([]byte(pipeline.String()))
+	if err != nil {
+		t.Fatalf("Failed to write requests: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	for i := range paths {
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response %d: %v", i, err)
+		}
+		if body := readBody(t, res); body != expected[i] {
+			t.Errorf("Expected response %d to be %s, but got %s", i, expected[i], body)
+		}
+	}
+}
+
+func TestHttpCachingProxy_ConnectionClose(t *testing.T) {
+	_, origin, proxyAddr := newTestCachingProxy(t)
+	host := origin.addr().String()
+
+	for _, request := range []string{
+		"GET /bucket/a HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n",
+		"GET /bucket/a HTTP/1.0\r\nHost: %s\r\n\r\n",
+	} {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to proxy: %v", err)
+		}
+		fmt.Fprintf(conn, request, host)
+
+		reader := bufio.NewReader(conn)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		readBody(t, res)
+		if !res.Close {
+			t.Errorf("Expected response to close the connection")
+		}
+
+		// The proxy must close the connection after the response
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err = reader.ReadByte()
+		if err != io.EOF {
+			t.Errorf("Expected EOF, but got %v", err)
+		}
+		conn.Close()
+	}
+}
+
+func TestHttpCachingProxy_Revalidation(t *testing.T) {
+	for _, maxAge := range []time.Duration{time.Nanosecond, time.Hour} {
+		_, origin, proxyAddr := newTestCachingProxy(t, func(p *HttpCachingProxy) { p.MaxAge = maxAge })
+		host := origin.addr().String()
+
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to proxy: %v", err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		get := func() string {
+			fmt.Fprintf(conn, "GET /bucket/key HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+			res, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("Expected status 200, but got %d", res.StatusCode)
+			}
+			return readBody(t, res)
+		}
+
+		get()
+
+		if maxAge == time.Hour {
+			// Test case: Fresh object is served without contacting the origin
+			origin.setObject("/bucket/key", "new data")
+			if body := get(); body != "data/bucket/key" {
+				t.Errorf("Expected cached body 'data/bucket/key', but got %s", body)
+			}
+			if n := origin.requests.Load(); n != 1 {
+				t.Errorf("Expected 1 origin request, but got %d", n)
+			}
+			continue
+		}
+
+		// Test case: Stale object is revalidated and not modified
+		if body := get(); body != "data/bucket/key" {
+			t.Errorf("Expected body 'data/bucket/key', but got %s", body)
+		}
+		if inm := origin.lastRequest().Header.Get("If-None-Match"); inm != etagOf("data/bucket/key") {
+			t.Errorf("Expected revalidation with If-None-Match %s, but got %s", etagOf("data/bucket/key"), inm)
+		}
+
+		// Test case: Stale object was overwritten at the origin
+		origin.setObject("/bucket/key", "new data")
+		if body := get(); body != "new data" {
+			t.Errorf("Expected body 'new data', but got %s", body)
+		}
+		if body := get(); body != "new data" {
+			t.Errorf("Expected replaced body 'new data', but got %s", body)
+		}
+	}
+}
+
+// failingStoreCache fails to store every object, so every Get is a miss
+type failingStoreCache struct {
+	mapCache
+}
+
+func (c *failingStoreCache) Put(o *cache.Object) error {
+	return errors.New("store failed")
+}
+
+func (c *failingStoreCache) PutContext(ctx context.Context, o *cache.Object) error {
+	return c.Put(o)
+}
+
+func TestHttpCachingProxy_Streaming(t *testing.T) {
+	getTwice := func(proxyAddr string, host string) {
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to proxy: %v", err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		for i := 0; i < 2; i++ {
+			fmt.Fprintf(conn, "GET /bucket/large-object HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+			res, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if body := readBody(t, res); body != "data/bucket/large-object" {
+				t.Errorf("Expected body 'data/bucket/large-object', but got %s", body)
+			}
+			if res.Close {
+				t.Errorf("Expected persistent connection")
+			}
+		}
+	}
+
+	// Test case: Object larger than the limit is passed through without being stored
+	_, origin, proxyAddr := newTestCachingProxy(t, func(p *HttpCachingProxy) { p.MaxObjectSize = 10 })
+	getTwice(proxyAddr, origin.addr().String())
+	if n := origin.requests.Load(); n != 2 {
+		t.Errorf("Expected 2 origin requests, but got %d", n)
+	}
+
+	// Test case: Failing cache store does not affect the client
+	_, origin, proxyAddr = newTestCachingProxy(t, func(p *HttpCachingProxy) { p.Cache = &failingStoreCache{} })
+	getTwice(proxyAddr, origin.addr().String())
+	if n := origin.requests.Load(); n != 2 {
+		t.Errorf("Expected 2 origin requests, but got %d", n)
+	}
+}
+
+func TestHttpCachingProxy_Invalidation(t *testing.T) {
+	_, origin, proxyAddr := newTestCachingProxy(t)
+	host := origin.addr().String()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	send := func(request string) string {
+		fmt.Fprint(conn, request)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response to %q: %v", request, err)
+		}
+		return readBody(t, res)
+	}
+	get := "GET /bucket/key HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+
+	send(get)
+
+	// Test case: PutObject removes the cached copy
+	send("PUT /bucket/key HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: 8\r\n\r\nnew data")
+	if body := send(get); body != "new data" {
+		t.Errorf("Expected body 'new data', but got %s", body)
+	}
+
+	// Test case: DeleteObject removes the cached copy
+	send("DELETE /bucket/key HTTP/1.1\r\nHost: " + host + "\r\n\r\n")
+	if body := send(get); body != "data/bucket/key" {
+		t.Errorf("Expected body 'data/bucket/key', but got %s", body)
+	}
+
+	// Test case: DeleteObjects removes the cached copies of all listed keys
+	send("PUT /bucket/key HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: 7\r\n\r\nchanged")
+	send(get)
+	origin.setObject("/bucket/key", "data/bucket/key")
+	deleteBody := "<Delete><Object><Key>other</Key></Object><Object><Key>key</Key></Object></Delete>"
+	send(fmt.Sprintf("POST /bucket?delete HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\n\r\n%s", host, len(deleteBody), deleteBody))
+	if body := send(get); body != "data/bucket/key" {
+		t.Errorf("Expected body 'data/bucket/key', but got %s", body)
+	}
+
+	// Test case: Uploading a part does not remove the cached copy
+	send("PUT /bucket/key?partNumber=1&uploadId=1 HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: 4\r\n\r\npart")
+	if body := send(get); body != "data/bucket/key" {
+		t.Errorf("Expected cached body 'data/bucket/key', but got %s", body)
+	}
+}
+
+func TestHttpCachingProxy_Head(t *testing.T) {
+	for _, warm := range []bool{false, true} {
+		_, origin, proxyAddr := newTestCachingProxy(t, func(p *HttpCachingProxy) {
+			p.WarmHeadMetadata = warm
+		})
+		host := origin.addr().String()
+
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to proxy: %v", err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		send := func(method string, path string) *http.Response {
+			fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: %s\r\n\r\n", method, path, host)
+			req, _ := http.NewRequest(method, "http://"+host+path, nil)
+			res, err := http.ReadResponse(reader, req)
+			if err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			return res
+		}
+
+		// Test case: HEAD miss does not download the object
+		send(http.MethodHead, "/bucket/a")
+		res := send(http.MethodHead, "/bucket/a")
+		if res.ContentLength != int64(len("data/bucket/a")) {
+			t.Errorf("warm=%v: Expected Content-Length %d, but got %d", warm, len("data/bucket/a"), res.ContentLength)
+		}
+		if method := origin.lastRequest().Method; method != http.MethodHead {
+			t.Errorf("warm=%v: Expected origin request HEAD, but got %s", warm, method)
+		}
+		expected := int64(2)
+		if warm {
+			// The second request is answered from the cached metadata
+			expected = 1
+		}
+		if n := origin.requests.Load(); n != expected {
+			t.Errorf("warm=%v: Expected %d origin requests, but got %d", warm, expected, n)
+		}
+
+		// Test case: GET after a HEAD miss still retrieves the body
+		if body := readBody(t, send(http.MethodGet, "/bucket/a")); body != "data/bucket/a" {
+			t.Errorf("warm=%v: Expected body 'data/bucket/a', but got %s", warm, body)
+		}
+
+		// Test case: HEAD hit is answered from the cached object
+		requests := origin.requests.Load()
+		res = send(http.MethodHead, "/bucket/a")
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("warm=%v: Expected status 200, but got %d", warm, res.StatusCode)
+		}
+		if res.ContentLength != int64(len("data/bucket/a")) {
+			t.Errorf("warm=%v: Expected Content-Length %d, but got %d", warm, len("data/bucket/a"), res.ContentLength)
+		}
+		if res.Header.Get("ETag") != etagOf("data/bucket/a") {
+			t.Errorf("warm=%v: Expected ETag %s, but got %s", warm, etagOf("data/bucket/a"), res.Header.Get("ETag"))
+		}
+		if n := origin.requests.Load(); n != requests {
+			t.Errorf("warm=%v: Expected no origin request, but got %d", warm, n-requests)
+		}
+
+		// The connection is still in sync, so no body was sent for the HEAD responses
+		if body := readBody(t, send(http.MethodGet, "/bucket/a")); body != "data/bucket/a" {
+			t.Errorf("warm=%v: Expected body 'data/bucket/a', but got %s", warm, body)
+		}
+	}
+}
+
+func TestHttpCachingProxy_OriginError(t *testing.T) {
+	_, origin, proxyAddr := newTestCachingProxy(t)
+	host := origin.addr().String()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Streamed miss and non-streamed miss (range request)
+	for _, request := range []string{
+		"GET /bucket/missing HTTP/1.1\r\nHost: %s\r\n\r\n",
+		"GET /bucket/missing HTTP/1.1\r\nHost: %s\r\nRange: bytes=0-3\r\n\r\n",
+	} {
+		fmt.Fprintf(conn, request, host)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404, but got %d", res.StatusCode)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "application/xml" {
+			t.Errorf("Expected Content-Type application/xml, but got %s", ct)
+		}
+		if body := readBody(t, res); body != noSuchKeyBody {
+			t.Errorf("Expected body %s, but got %s", noSuchKeyBody, body)
+		}
+	}
+
+	// Test case: The origin is requested once per request, the error response is not requested again
+	if n := origin.requests.Load(); n != 2 {
+		t.Errorf("Expected 2 origin requests, but got %d", n)
+	}
+}
+
+func TestHttpCachingProxy_Cancellation(t *testing.T) {
+	decisions := make(chan string, 16)
+	_, origin, proxyAddr := newTestCachingProxy(t, func(p *HttpCachingProxy) {
+		p.RequestTimeout = 500 * time.Millisecond
+		p.StatsHandler = func(stats ProxyStatsEntry) {
+			decisions <- stats.CacheDecision
+		}
+	})
+	host := origin.addr().String()
+	origin.stalled.Store(true)
+
+	expectAborted := func(path string, within time.Duration) {
+		t.Helper()
+		select {
+		case aborted := <-origin.aborted:
+			if aborted != path {
+				t.Errorf("Expected aborted request for %s, but got %s", path, aborted)
+			}
+		case <-time.After(within):
+			t.Fatalf("Expected the origin request for %s to be aborted", path)
+		}
+		if decision := <-decisions; decision != DecisionCanceled {
+			t.Errorf("Expected decision %s, but got %s", DecisionCanceled, decision)
+		}
+	}
+
+	// Test case: A client that goes away during a miss aborts the fill, before the request times out
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	fmt.Fprintf(conn, "GET /bucket/disconnect HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+	time.Sleep(50 * time.Millisecond)
+	// Closing without lingering resets the connection instead of only ending the client's side
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+	expectAborted("/bucket/disconnect", 250*time.Millisecond)
+
+	// Test case: A request exceeding RequestTimeout is answered with 504 Gateway Timeout
+	conn, err = net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /bucket/timeout HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	readBody(t, res)
+	if res.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expected status 504, but got %d", res.StatusCode)
+	}
+	expectAborted("/bucket/timeout", time.Second)
+}
+
+func TestHttpCachingProxy_HalfClose(t *testing.T) {
+	decisions := make(chan string, 16)
+	_, origin, proxyAddr := newTestCachingProxy(t, func(p *HttpCachingProxy) {
+		p.StatsHandler = func(stats ProxyStatsEntry) {
+			decisions <- stats.CacheDecision
+		}
+	})
+	origin.delay.Store(int64(100 * time.Millisecond))
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /bucket/halfclose HTTP/1.1\r\nHost: %s\r\n\r\n", origin.addr())
+
+	// Test case: A client that shuts down its side of the connection after the request still gets the response
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf("Failed to close the write side of the connection: %v", err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if body := readBody(t, res); res.StatusCode != http.StatusOK || body != "data/bucket/halfclose" {
+		t.Errorf("Expected status 200 with body %q, but got %d with body %q", "data/bucket/halfclose", res.StatusCode, body)
+	}
+	if decision := <-decisions; decision == DecisionCanceled {
+		t.Errorf("Expected the request not to be canceled")
+	}
+}
@@ -3,6 +3,7 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -17,6 +18,7 @@ import (
 type HttpCachingTimedProxy struct {
 	Cache                 cache.Cache
 	ObjectStorageAdapters []objectStorage.ObjectStorage
+	Upstream              *UpstreamPool // Keep-alive connections to the origins
 }
 
 func (p *HttpCachingTimedProxy) handleHttpTimed(conn net.Conn, targetAddr net.Addr) ProxyStatsEntry {
@@ -60,6 +62,10 @@ func (p *HttpCachingTimedProxy) handleHttpTimed(conn net.Conn, targetAddr net.Ad
 		stats.CacheRetrieve = cacheRetrieveT
 		stats.Initialize = initT
 		stats.CacheMiss = initT > 0
+		stats.CacheDecision = DecisionHit
+		if stats.CacheMiss {
+			stats.CacheDecision = DecisionMiss
+		}
 
 		if err == nil {
 			// Cache hit - Serve from cache
@@ -88,10 +94,25 @@ func (p *HttpCachingTimedProxy) handleHttpTimed(conn net.Conn, targetAddr net.Ad
 			return stats
 		} else {
 
+			var originErr *originResponseError
+			if stats.CacheMiss && errors.As(err, &originErr) {
+				// The origin did not send the object, its response is passed to the client as is
+				stats.CacheDecision = DecisionOriginError
+				t = time.Now()
+				err = originErr.response(request).Write(conn)
+				stats.WriteResponse = time.Since(t).Nanoseconds()
+				if err != nil {
+					log.Printf("Failed to send origin response: %v", err)
+					stats.Failed = true
+				}
+				return stats
+			}
+
 			//DEPRECATED - REMOVE
 			// Log and forward
 			log.Printf("Failed to retrieve object from cache, forwarding connection: %v", err)
 			stats.Forwarded = true
+			stats.CacheDecision = DecisionForwarded
 			p.forwardTimed(conn, targetAddr, request, &stats.NetworkTimer)
 			return stats
 		}
@@ -111,6 +132,11 @@ func (p *HttpCachingTimedProxy) HandleHttp(conn net.Conn, targetAddr net.Addr) P
 
 func (p *HttpCachingTimedProxy) shouldIntercept(req *http.Request) (bool, int) {
 
+	// Only GET requests are measured against the cache, HEAD requests are forwarded
+	if req.Method != http.MethodGet {
+		return false, -1
+	}
+
 	for i, adapter := range p.ObjectStorageAdapters {
 		if adapter.ShouldIntercept(req) {
 			return true, i
@@ -121,40 +147,46 @@ func (p *HttpCachingTimedProxy) shouldIntercept(req *http.Request) (bool, int) {
 
 func (p *HttpCachingTimedProxy) retrieveObjectFromRemoteTimed(req *http.Request, targetAddr net.Addr, objectKey string, times *NetworkTimer) (*cache.Object, error) {
 
-	// Retrieve object from remote storage
-
-	//TODO: Think about changing to synchronous
+	// Retrieve object from remote storage, the fill runs synchronously in the initializer
 
 	localTimes := NetworkTimer{}
 
+	upstreamReq := newUpstreamRequest(req)
+
 	start := time.Now()
-	targetConn, err := net.Dial("tcp", targetAddr.String())
+	targetConn, reused, err := p.Upstream.get(req.Context(), targetAddr)
 	localTimes.DialRemote = time.Since(start).Nanoseconds()
+	localTimes.ConnReused = reused
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to target: %v", err)
 	}
-	defer targetConn.Close()
 
 	start = time.Now()
-	err = req.Write(targetConn)
+	err = targetConn.writeRequest(upstreamReq)
 	localTimes.WriteRequest = time.Since(start).Nanoseconds()
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request to target: %v", err)
+		targetConn.Close()
+		return nil, err
 	}
 
 	start = time.Now()
-	res, err := http.ReadResponse(bufio.NewReader(targetConn), req)
+	res, err := targetConn.readResponse(upstreamReq)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response from target: %v", err)
+		targetConn.Close()
+		return nil, err
 	}
+	res = p.Upstream.track(targetConn, res, nil)
+	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
 		body, err := io.ReadAll(res.Body)
 		if err != nil {
 			return nil, fmt.Errorf("could not read non-OK response body")
 		}
-		return nil, fmt.Errorf("received non-OK HTTP status: %s : %s", res.Status, string(body))
+		localTimes.ReadResponse = time.Since(start).Nanoseconds()
+		*times = localTimes
+		return nil, &originResponseError{res: res, body: body}
 	}
 
 	var buffer bytes.Buffer
@@ -170,11 +202,8 @@ func (p *HttpCachingTimedProxy) retrieveObjectFromRemoteTimed(req *http.Request,
 		OriginalHeaders: res.Header,
 		Data:            &data,
 	}
-	// errChan <- nil
-	// objChan <- object
-	// timerChan <- localTimes
-
 	times.DialRemote = localTimes.DialRemote
+	times.ConnReused = localTimes.ConnReused
 	times.WriteRequest = localTimes.WriteRequest
 	times.ReadRequest = localTimes.ReadRequest
 	times.ReadResponse = localTimes.ReadResponse
@@ -184,10 +213,13 @@ func (p *HttpCachingTimedProxy) retrieveObjectFromRemoteTimed(req *http.Request,
 
 func (p *HttpCachingTimedProxy) forwardTimed(conn net.Conn, targetAddr net.Addr, req *http.Request, times *NetworkTimer) {
 
+	upstreamReq := newUpstreamRequest(req)
+
 	//Dial remote
 	start := time.Now()
-	targetConn, err := net.Dial("tcp", targetAddr.String())
+	targetConn, reused, err := p.Upstream.get(req.Context(), targetAddr)
 	times.DialRemote = time.Since(start).Nanoseconds()
+	times.ConnReused = reused
 
 	if err != nil {
 		start = time.Now()
@@ -195,23 +227,26 @@ func (p *HttpCachingTimedProxy) forwardTimed(conn net.Conn, targetAddr net.Addr,
 		times.WriteResponse = time.Since(start).Nanoseconds()
 		return
 	}
-	defer targetConn.Close()
 
 	// Forward request
 	start = time.Now()
-	req.Write(targetConn)
+	targetConn.writeRequest(upstreamReq)
 	times.WriteRequest = time.Since(start).Nanoseconds()
 
 	// Forward response
 	start = time.Now()
-	res, err := http.ReadResponse(bufio.NewReader(targetConn), req)
+	res, err := targetConn.readResponse(upstreamReq)
 	times.ReadResponse = time.Since(start).Nanoseconds()
 	if err != nil {
+		targetConn.Close()
 		start = time.Now()
 		conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n\r\n"))
 		times.WriteResponse = time.Since(start).Nanoseconds()
 		return
 	}
+	res = p.Upstream.track(targetConn, res, nil)
+	defer res.Body.Close()
+
 	start = time.Now()
 	res.Write(conn)
 	times.WriteResponse = time.Since(start).Nanoseconds()
@@ -221,5 +256,6 @@ func NewHttpCachingTimedProxy(cache cache.Cache, objectStorageAdapters []objectS
 	return &HttpCachingTimedProxy{
 		Cache:                 cache,
 		ObjectStorageAdapters: objectStorageAdapters,
+		Upstream:              NewUpstreamPool(DefaultMaxIdleConns, DefaultIdleConnTimeout),
 	}
 }
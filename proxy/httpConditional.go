@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Headers that are kept on a 304 Not Modified response (RFC 9110, section 15.4.5)
+var notModifiedHeaders = []string{
+	"Cache-Control",
+	"Content-Location",
+	"Date",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Vary",
+}
+
+/*
+checkPreconditions evaluates the conditional headers of a request against the ETag and
+Last-Modified headers of the cached object, in the order defined by RFC 9110, section 13.2.2.
+It returns the status the proxy has to answer with instead of the object, 304 Not Modified or
+412 Precondition Failed, or 0 if the object should be sent.
+*/
+func checkPreconditions(req *http.Request, header http.Header) int {
+
+	etag := header.Get("ETag")
+	lastModified, lastModifiedErr := http.ParseTime(header.Get("Last-Modified"))
+
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		if !etagListMatches(ifMatch, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ifUnmodifiedSince := req.Header.Get("If-Unmodified-Since"); ifUnmodifiedSince != "" && lastModifiedErr == nil {
+		t, err := http.ParseTime(ifUnmodifiedSince)
+		if err == nil && lastModified.Truncate(time.Second).After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	readOnly := req.Method == http.MethodGet || req.Method == http.MethodHead
+
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagListMatches(ifNoneMatch, etag, true) {
+			if readOnly {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if ifModifiedSince := req.Header.Get("If-Modified-Since"); ifModifiedSince != "" && readOnly && lastModifiedErr == nil {
+		t, err := http.ParseTime(ifModifiedSince)
+		if err == nil && !lastModified.Truncate(time.Second).After(t) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+/*
+etagListMatches reports whether the ETag of the object matches one of the entity tags in an
+If-Match or If-None-Match header. "*" matches any existing object. If-Match uses the strong
+comparison, If-None-Match the weak comparison (RFC 9110, section 8.8.3.2).
+*/
+func etagListMatches(list string, etag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range splitETagList(list) {
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if !strings.HasPrefix(candidate, "W/") && !strings.HasPrefix(etag, "W/") && candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// splitETagList splits a list of entity tags, ignoring commas inside quoted tags
+func splitETagList(list string) []string {
+	var tags []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(list); i++ {
+		switch list[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				if tag := strings.TrimSpace(list[start:i]); tag != "" {
+					tags = append(tags, tag)
+				}
+				start = i + 1
+			}
+		}
+	}
+	if tag := strings.TrimSpace(list[start:]); tag != "" {
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+/*
+newPreconditionResponse creates the body-less response for a request whose preconditions
+were evaluated locally. A 304 response carries the validators of the cached object.
+*/
+func newPreconditionResponse(req *http.Request, status int, header http.Header) *http.Response {
+	h := http.Header{}
+	if status == http.StatusNotModified {
+		for _, name := range notModifiedHeaders {
+			if v := header.Values(name); len(v) > 0 {
+				h[http.CanonicalHeaderKey(name)] = append([]string(nil), v...)
+			}
+		}
+	}
+
+	return &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		StatusCode:    status,
+		Header:        h,
+		ContentLength: 0,
+		Body:          http.NoBody,
+		Request:       req,
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestCheckPreconditions(t *testing.T) {
+	header := http.Header{
+		"Etag":          {"\"v1\""},
+		"Last-Modified": {"Wed, 21 Oct 2015 07:28:00 GMT"},
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		status  int
+	}{
+		{"no preconditions", http.MethodGet, nil, 0},
+		{"If-None-Match matches", http.MethodGet, map[string]string{"If-None-Match": "\"v0\", \"v1\""}, http.StatusNotModified},
+		{"If-None-Match weak match", http.MethodGet, map[string]string{"If-None-Match": "W/\"v1\""}, http.StatusNotModified},
+		{"If-None-Match star", http.MethodGet, map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"If-None-Match differs", http.MethodGet, map[string]string{"If-None-Match": "\"v2\""}, 0},
+		{"If-None-Match on PUT", http.MethodPut, map[string]string{"If-None-Match": "*"}, http.StatusPreconditionFailed},
+		{"If-Modified-Since not modified", http.MethodGet, map[string]string{"If-Modified-Since": "Wed, 21 Oct 2015 07:28:00 GMT"}, http.StatusNotModified},
+		{"If-Modified-Since modified", http.MethodGet, map[string]string{"If-Modified-Since": "Tue, 20 Oct 2015 07:28:00 GMT"}, 0},
+		{"If-None-Match takes precedence", http.MethodGet, map[string]string{"If-None-Match": "\"v2\"", "If-Modified-Since": "Wed, 21 Oct 2015 07:28:00 GMT"}, 0},
+		{"If-Match matches", http.MethodGet, map[string]string{"If-Match": "\"v1\""}, 0},
+		{"If-Match weak never matches", http.MethodGet, map[string]string{"If-Match": "W/\"v1\""}, http.StatusPreconditionFailed},
+		{"If-Match differs", http.MethodGet, map[string]string{"If-Match": "\"v2\""}, http.StatusPreconditionFailed},
+		{"If-Unmodified-Since modified", http.MethodGet, map[string]string{"If-Unmodified-Since": "Tue, 20 Oct 2015 07:28:00 GMT"}, http.StatusPreconditionFailed},
+		{"If-Unmodified-Since not modified", http.MethodGet, map[string]string{"If-Unmodified-Since": "Wed, 21 Oct 2015 07:28:00 GMT"}, 0},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, "http://localhost/bucket/key", nil)
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		if status := checkPreconditions(req, header); status != test.status {
+			t.Errorf("%s: Expected status %d, but got %d", test.name, test.status, status)
+		}
+	}
+}
+
+func TestHttpCachingProxy_Conditional(t *testing.T) {
+	_, origin, proxyAddr := newTestCachingProxy(t)
+	host := origin.addr().String()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test case: Conditional request on a cache miss is answered after filling the cache
+	fmt.Fprintf(conn, "GET /bucket/key HTTP/1.1\r\nHost: %s\r\nIf-None-Match: %s\r\n\r\n", host, etagOf("data/bucket/key"))
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	readBody(t, res)
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected status 304, but got %d", res.StatusCode)
+	}
+	if etag := res.Header.Get("ETag"); etag != etagOf("data/bucket/key") {
+		t.Errorf("Expected ETag on 304 response, but got %s", etag)
+	}
+
+	// Test case: Failed If-Match on a cache hit
+	fmt.Fprintf(conn, "GET /bucket/key HTTP/1.1\r\nHost: %s\r\nIf-Match: \"other\"\r\n\r\n", host)
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	readBody(t, res)
+	if res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected status 412, but got %d", res.StatusCode)
+	}
+
+	// Test case: Stale validator gets the full object
+	fmt.Fprintf(conn, "GET /bucket/key HTTP/1.1\r\nHost: %s\r\nIf-None-Match: \"other\"\r\n\r\n", host)
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if body := readBody(t, res); res.StatusCode != http.StatusOK || body != "data/bucket/key" {
+		t.Errorf("Expected status 200 with the object, but got %d %s", res.StatusCode, body)
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Errorf("Expected 1 origin request, but got %d", n)
+	}
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Hop-by-hop headers are meaningful only for a single connection and must not be
+// stored in the cache or replayed to other clients (RFC 9110, section 7.6.1).
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+/*
+removeHopHeaders returns a copy of the headers without the hop-by-hop headers,
+including the ones listed in the Connection header.
+*/
+func removeHopHeaders(header http.Header) http.Header {
+	h := header.Clone()
+	if h == nil {
+		return http.Header{}
+	}
+	for _, v := range h["Connection"] {
+		for _, name := range splitHeaderList(v) {
+			h.Del(name)
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	return h
+}
+
+/*
+shouldKeepAlive reports whether the client connection may be reused after the request
+was answered. HTTP/1.1 connections are persistent unless the client sent "Connection: close",
+older protocol versions are closed after every response.
+*/
+func shouldKeepAlive(req *http.Request) bool {
+	return req.ProtoAtLeast(1, 1) && !req.Close
+}
+
+/*
+responseClosesConnection reports whether writing the response ends the connection, either
+because it was marked to close or because its body is delimited by closing the connection.
+*/
+func responseClosesConnection(res *http.Response) bool {
+	if res.Close {
+		return true
+	}
+	bodyAllowed := res.Request == nil || res.Request.Method != http.MethodHead
+	bodyAllowed = bodyAllowed && res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusNotModified
+	return bodyAllowed && res.ContentLength < 0 && !isChunked(res.TransferEncoding)
+}
+
+// splitHeaderList splits a comma separated header value into its trimmed, non-empty elements
+func splitHeaderList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func isChunked(te []string) bool {
+	return len(te) > 0 && te[0] == "chunked"
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+/*
+watchClient detects a client that closes its connection while a request is handled, by peeking at the
+connection in the background, and calls cancel when it does. Data of a pipelined request ends the
+watch without calling cancel. An EOF ends the watch without calling cancel as well, since a client
+may shut down its side of the connection after sending the request and still wait for the response.
+The returned function stops the watch and waits until the reader is no longer used, so the next
+request can be read from it.
+*/
+func watchClient(conn net.Conn, reader *bufio.Reader, cancel context.CancelFunc) func() {
+
+	var stopped atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := reader.Peek(1)
+		if err != nil && err != io.EOF && !stopped.Load() {
+			cancel()
+		}
+	}()
+
+	return func() {
+		stopped.Store(true)
+		// A deadline in the past interrupts the peek
+		conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		conn.SetReadDeadline(time.Time{})
+	}
+}
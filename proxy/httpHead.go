@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"automatic-cache-object-storage/cache"
+	"automatic-cache-object-storage/objectStorage"
+)
+
+// Suffix of the cache key under which the metadata of an object requested with HEAD is stored
+const headMetadataSuffix = "#head"
+
+// metadataKey returns the cache key of the metadata entry of an object
+func metadataKey(objectKey string) string {
+	return objectKey + headMetadataSuffix
+}
+
+/*
+handleHead answers a HEAD request from the cached object, without contacting the origin. A miss
+does not download the object: the request is forwarded, or, with WarmHeadMetadata, only the
+headers of the object are retrieved with a HEAD request and cached under a separate key.
+Stale objects are handled like for GET requests, including stale-if-error and offline mode, except
+that stale objects of a cache.StreamCache are not revalidated.
+*/
+func (p *HttpCachingProxy) handleHead(conn net.Conn, targetAddr net.Addr, request *http.Request, adapter objectStorage.ObjectStorage, objKey string, reqCC cacheControl, keepAlive bool, stats *ProxyStatsEntry) bool {
+
+	onlyIfCached := reqCC.has("only-if-cached") || p.Offline
+	var originErr *originResponseError
+
+	// A miss must not fill the cache with the object body
+	body, cachedObj, err := p.lookup(request.Context(), objKey)
+	if err == nil {
+		defer body.Close()
+		if decision, ok := evaluateCachedObject(reqCC, cachedObj, time.Now()); ok {
+			stats.CacheDecision = decision
+			if decision == DecisionStale {
+				cachedObj = withWarning(cachedObj, warningStale)
+			}
+			return p.serveStream(conn, targetAddr, request, adapter, cachedObj, body, keepAlive)
+		}
+		if p.Offline {
+			stats.CacheDecision = DecisionStale
+			return p.serveStream(conn, targetAddr, request, adapter, withWarning(cachedObj, warningDisconnected), body, keepAlive)
+		}
+		// Objects of a stream cache are not revalidated, as a changed object would be downloaded for a HEAD request
+		if _, streaming := p.Cache.(cache.StreamCache); !onlyIfCached && !streaming {
+			// Stale objects are revalidated with a GET request, as a 200 response replaces the cached body
+			getReq := request.Clone(request.Context())
+			getReq.Method = http.MethodGet
+			staleObj := cachedObj
+			cachedObj, err = p.revalidate(getReq, targetAddr, cachedObj)
+			if err == nil {
+				stats.CacheDecision = DecisionRevalidated
+				return p.serveFromCache(conn, targetAddr, request, adapter, cachedObj, keepAlive)
+			}
+			if p.StaleIfError && isOriginFailure(err) && staleIfErrorAllowed(reqCC, staleObj, time.Now()) {
+				stats.CacheDecision = DecisionStaleIfError
+				return p.serveFromCache(conn, targetAddr, request, adapter, withWarning(staleObj, warningRevalidationFailed), keepAlive)
+			}
+			if errors.As(err, &originErr) {
+				stats.CacheDecision = DecisionOriginError
+				return writeLocalResponse(conn, originErr.response(request), keepAlive)
+			}
+		}
+	}
+
+	if !p.WarmHeadMetadata {
+		if onlyIfCached {
+			stats.CacheDecision = DecisionOnlyIfCached
+			return writeLocalResponse(conn, newGatewayTimeoutResponse(request), keepAlive)
+		}
+		stats.CacheDecision = DecisionForwarded
+		stats.Forwarded = true
+		return p.forward(conn, targetAddr, request, keepAlive)
+	}
+
+	metaKey := metadataKey(objKey)
+	filled := false
+	metadata, err := p.Cache.GetContext(request.Context(), metaKey, func(ctx context.Context) (*cache.Object, error) {
+		if onlyIfCached {
+			return nil, errNotCached
+		}
+		filled = true
+		return p.retrieveMetadataFromRemote(request.WithContext(ctx), targetAddr, metaKey)
+	})
+	stats.CacheMiss = filled
+
+	var notStorable *notStorableError
+	switch {
+	case filled && errors.As(err, &originErr):
+		stats.CacheDecision = DecisionOriginError
+		return writeLocalResponse(conn, originErr.response(request), keepAlive)
+	case filled && errors.As(err, &notStorable):
+		stats.CacheDecision = DecisionNotStored
+		return p.serveMetadata(conn, request, notStorable.obj, keepAlive)
+	case err == nil && filled:
+		stats.CacheDecision = DecisionMiss
+		return p.serveMetadata(conn, request, metadata, keepAlive)
+	case err == nil:
+		if decision, ok := evaluateCachedObject(reqCC, metadata, time.Now()); ok {
+			stats.CacheDecision = decision
+			if decision == DecisionStale {
+				metadata = withWarning(metadata, warningStale)
+			}
+			return p.serveMetadata(conn, request, metadata, keepAlive)
+		}
+		if p.Offline {
+			stats.CacheDecision = DecisionStale
+			return p.serveMetadata(conn, request, withWarning(metadata, warningDisconnected), keepAlive)
+		}
+		if onlyIfCached {
+			break
+		}
+		staleMetadata := metadata
+		metadata, err = p.retrieveMetadataFromRemote(request, targetAddr, metaKey)
+		if err != nil && p.StaleIfError && isOriginFailure(err) && staleIfErrorAllowed(reqCC, staleMetadata, time.Now()) {
+			stats.CacheDecision = DecisionStaleIfError
+			return p.serveMetadata(conn, request, withWarning(staleMetadata, warningRevalidationFailed), keepAlive)
+		}
+		if errors.As(err, &originErr) {
+			p.delete(metaKey)
+			stats.CacheDecision = DecisionOriginError
+			return writeLocalResponse(conn, originErr.response(request), keepAlive)
+		}
+		if errors.As(err, &notStorable) {
+			p.delete(metaKey)
+			stats.CacheDecision = DecisionNotStored
+			return p.serveMetadata(conn, request, notStorable.obj, keepAlive)
+		}
+		if err == nil {
+			if err := p.Cache.Put(metadata); err != nil {
+				log.Printf("Failed to update object metadata in cache: %v", err)
+			}
+			stats.CacheDecision = DecisionRevalidated
+			return p.serveMetadata(conn, request, metadata, keepAlive)
+		}
+	}
+
+	if onlyIfCached {
+		stats.CacheDecision = DecisionOnlyIfCached
+		return writeLocalResponse(conn, newGatewayTimeoutResponse(request), keepAlive)
+	}
+	if request.Context().Err() != nil {
+		return answerCanceled(conn, request, keepAlive, stats)
+	}
+
+	log.Printf("Failed to retrieve object metadata, forwarding connection: %v", err)
+	stats.CacheDecision = DecisionForwarded
+	stats.Forwarded = true
+	return p.forward(conn, targetAddr, request, keepAlive)
+}
+
+/*
+retrieveMetadataFromRemote sends the HEAD request to the origin and creates a cache entry without
+body, the size of the object is kept in the Content-Length header.
+*/
+func (p *HttpCachingProxy) retrieveMetadataFromRemote(req *http.Request, targetAddr net.Addr, metaKey string) (*cache.Object, error) {
+
+	res, _, err := p.Upstream.RoundTrip(newFillRequest(req), targetAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve object metadata from remote: %v", err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &originResponseError{res: res}
+	}
+	if res.ContentLength < 0 {
+		return nil, fmt.Errorf("failed to retrieve object metadata from remote: unknown object size")
+	}
+
+	header := res.Header.Clone()
+	header.Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+	obj := p.newCachedObject(metaKey, header, []byte{})
+	if reason := notStorableReason(parseRequestCacheControl(req.Header), parseCacheControl(res.Header)); reason != "" {
+		return nil, &notStorableError{obj: obj, reason: reason}
+	}
+	return obj, nil
+}
+
+// serveMetadata answers a HEAD request from a cached metadata entry
+func (p *HttpCachingProxy) serveMetadata(conn net.Conn, request *http.Request, metadata *cache.Object, keepAlive bool) bool {
+
+	header := http.Header(metadata.OriginalHeaders)
+
+	if status := checkPreconditions(request, header); status != 0 {
+		return writeLocalResponse(conn, newPreconditionResponse(request, status, header), keepAlive)
+	}
+
+	size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	response := &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		StatusCode:    http.StatusOK,
+		Header:        header.Clone(),
+		ContentLength: size,
+		Body:          http.NoBody,
+		Request:       request,
+	}
+	return writeLocalResponse(conn, response, keepAlive)
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidRange = errors.New("invalid range")
+	errNoOverlap    = errors.New("invalid range: failed to overlap")
+)
+
+// httpRange is a byte range of an object requested by the client
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+/*
+parseRange parses a Range header value (RFC 9110, section 14.2) for an object of the given size.
+Ranges that start beyond the end of the object are dropped, errNoOverlap is returned if none of
+the ranges overlap with the object.
+*/
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const unit = "bytes="
+	if !strings.HasPrefix(s, unit) {
+		return nil, errInvalidRange
+	}
+
+	var ranges []httpRange
+	noOverlap := false
+
+	for _, spec := range strings.Split(s[len(unit):], ",") {
+		spec = textproto.TrimString(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		first, last = textproto.TrimString(first), textproto.TrimString(last)
+
+		var r httpRange
+		if first == "" {
+			// Suffix range: the last N bytes of the object
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 || last[0] == '-' {
+				return nil, errInvalidRange
+			}
+			if n == 0 {
+				noOverlap = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r.start = size - n
+			r.length = n
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			if start >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = start
+			r.length = size - start
+			if last != "" {
+				end, err := strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errInvalidRange
+				}
+				if end < size-1 {
+					r.length = end - start + 1
+				}
+			}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// rangesMIMESize returns the length of the multipart/byteranges body for the given ranges
+func rangesMIMESize(ranges []httpRange, contentType string, size int64) int64 {
+	var w countingWriter
+	var length int64
+	mw := multipart.NewWriter(&w)
+	for _, r := range ranges {
+		mw.CreatePart(r.mimeHeader(contentType, size))
+		length += r.length
+	}
+	mw.Close()
+	return length + int64(w)
+}
+
+/*
+createRangeResponse turns a full 200 response for an object into a 206 Partial Content or a
+416 Range Not Satisfiable response, according to the Range and If-Range headers of the request.
+The response is returned unchanged if the request does not ask for a (valid) range.
+*/
+func createRangeResponse(req *http.Request, res *http.Response, content io.ReadSeeker, size int64) *http.Response {
+
+	rangeHeader := req.Header.Get("Range")
+	if rangeHeader == "" || req.Method != http.MethodGet || res.StatusCode != http.StatusOK {
+		return res
+	}
+
+	if !ifRangeMatches(req.Header.Get("If-Range"), res.Header) {
+		return res
+	}
+
+	ranges, err := parseRange(rangeHeader, size)
+
+	if err == errNoOverlap {
+		return &http.Response{
+			Proto:         res.Proto,
+			ProtoMajor:    res.ProtoMajor,
+			ProtoMinor:    res.ProtoMinor,
+			StatusCode:    http.StatusRequestedRangeNotSatisfiable,
+			Header:        http.Header{"Content-Range": {fmt.Sprintf("bytes */%d", size)}},
+			ContentLength: 0,
+			Body:          http.NoBody,
+			Request:       req,
+		}
+	}
+
+	// Invalid range headers are ignored and the whole object is sent
+	if err != nil || len(ranges) == 0 {
+		return res
+	}
+
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	if total > size {
+		// Overlapping ranges that add up to more than the object itself
+		return res
+	}
+
+	partial := *res
+	partial.StatusCode = http.StatusPartialContent
+	partial.Status = ""
+	partial.Header = res.Header.Clone()
+	partial.Request = req
+
+	if len(ranges) == 1 {
+		r := ranges[0]
+		if _, err := content.Seek(r.start, io.SeekStart); err != nil {
+			return res
+		}
+		partial.Header.Set("Content-Range", r.contentRange(size))
+		partial.ContentLength = r.length
+		partial.Body = io.NopCloser(io.LimitReader(content, r.length))
+		return &partial
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	partial.Header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	partial.Header.Del("Content-Range")
+	partial.ContentLength = rangesMIMESize(ranges, contentType, size)
+	partial.Body = pr
+
+	go func() {
+		for _, r := range ranges {
+			part, err := mw.CreatePart(r.mimeHeader(contentType, size))
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := content.Seek(r.start, io.SeekStart); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.CopyN(part, content, r.length); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		mw.Close()
+		pw.Close()
+	}()
+
+	return &partial
+}
+
+/*
+ifRangeMatches evaluates the If-Range precondition against the headers of the cached object.
+An entity tag must match the ETag using the strong comparison, a date must be equal to
+Last-Modified. An empty If-Range always matches.
+*/
+func ifRangeMatches(ifRange string, header http.Header) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") || strings.HasPrefix(ifRange, "W/") {
+		etag := header.Get("ETag")
+		return etag != "" && !strings.HasPrefix(ifRange, "W/") && !strings.HasPrefix(etag, "W/") && etag == ifRange
+	}
+	t, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && t.Equal(lastModified)
+}
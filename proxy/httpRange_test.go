@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		ranges []httpRange
+		err    error
+	}{
+		{"bytes=0-4", 10, []httpRange{{0, 5}}, nil},
+		{"bytes=5-", 10, []httpRange{{5, 5}}, nil},
+		{"bytes=-3", 10, []httpRange{{7, 3}}, nil},
+		{"bytes=-20", 10, []httpRange{{0, 10}}, nil},
+		{"bytes=8-20", 10, []httpRange{{8, 2}}, nil},
+		{"bytes=0-0, 2-3,", 10, []httpRange{{0, 1}, {2, 2}}, nil},
+		{"bytes=10-", 10, nil, errNoOverlap},
+		{"bytes=20-30, 40-", 10, nil, errNoOverlap},
+		{"bytes=-0", 10, nil, errNoOverlap},
+		{"bytes=4-2", 10, nil, errInvalidRange},
+		{"bytes=a-b", 10, nil, errInvalidRange},
+		{"bytes=5", 10, nil, errInvalidRange},
+		{"items=0-4", 10, nil, errInvalidRange},
+	}
+
+	for _, test := range tests {
+		ranges, err := parseRange(test.header, test.size)
+		if err != test.err {
+			t.Errorf("%s: Expected error %v, but got %v", test.header, test.err, err)
+			continue
+		}
+		if fmt.Sprint(ranges) != fmt.Sprint(test.ranges) {
+			t.Errorf("%s: Expected ranges %v, but got %v", test.header, test.ranges, ranges)
+		}
+	}
+}
+
+func newRangeTestResponse(content []byte) *http.Response {
+	return &http.Response{
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"text/plain"}, "Etag": {"\"v1\""}},
+		ContentLength: int64(len(content)),
+		Body:          io.NopCloser(bytes.NewReader(content)),
+	}
+}
+
+func TestCreateRangeResponse(t *testing.T) {
+	content := []byte("0123456789")
+
+	// Test case: Single range
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost/bucket/key", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	res := createRangeResponse(req, newRangeTestResponse(content), bytes.NewReader(content), int64(len(content)))
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected status 206, but got %d", res.StatusCode)
+	}
+	if cr := res.Header.Get("Content-Range"); cr != "bytes 2-5/10" {
+		t.Errorf("Expected Content-Range 'bytes 2-5/10', but got %s", cr)
+	}
+	if body := readBody(t, res); body != "2345" {
+		t.Errorf("Expected body '2345', but got %s", body)
+	}
+
+	// Test case: Multiple ranges
+	req.Header.Set("Range", "bytes=0-1,-2")
+	res = createRangeResponse(req, newRangeTestResponse(content), bytes.NewReader(content), int64(len(content)))
+	if res.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected status 206, but got %d", res.StatusCode)
+	}
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Expected multipart/byteranges, but got %s (%v)", res.Header.Get("Content-Type"), err)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if int64(len(body)) != res.ContentLength {
+		t.Errorf("Expected body length %d, but got %d", res.ContentLength, len(body))
+	}
+	mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	expected := []struct{ contentRange, data string }{{"bytes 0-1/10", "01"}, {"bytes 8-9/10", "89"}}
+	for _, e := range expected {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("Expected part %s, but got %v", e.contentRange, err)
+		}
+		if cr := part.Header.Get("Content-Range"); cr != e.contentRange {
+			t.Errorf("Expected Content-Range %s, but got %s", e.contentRange, cr)
+		}
+		if ct := part.Header.Get("Content-Type"); ct != "text/plain" {
+			t.Errorf("Expected part Content-Type text/plain, but got %s", ct)
+		}
+		data, _ := io.ReadAll(part)
+		if string(data) != e.data {
+			t.Errorf("Expected part data %s, but got %s", e.data, string(data))
+		}
+	}
+
+	// Test case: Unsatisfiable range
+	req.Header.Set("Range", "bytes=100-")
+	res = createRangeResponse(req, newRangeTestResponse(content), bytes.NewReader(content), int64(len(content)))
+	if res.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected status 416, but got %d", res.StatusCode)
+	}
+	if cr := res.Header.Get("Content-Range"); cr != "bytes */10" {
+		t.Errorf("Expected Content-Range 'bytes */10', but got %s", cr)
+	}
+
+	// Test case: If-Range does not match, the whole object is sent
+	req.Header.Set("Range", "bytes=2-5")
+	req.Header.Set("If-Range", "\"v2\"")
+	res = createRangeResponse(req, newRangeTestResponse(content), bytes.NewReader(content), int64(len(content)))
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, but got %d", res.StatusCode)
+	}
+
+	// Test case: If-Range matches
+	req.Header.Set("If-Range", "\"v1\"")
+	res = createRangeResponse(req, newRangeTestResponse(content), bytes.NewReader(content), int64(len(content)))
+	if res.StatusCode != http.StatusPartialContent {
+		t.Errorf("Expected status 206, but got %d", res.StatusCode)
+	}
+}
+
+func TestHttpCachingProxy_Range(t *testing.T) {
+	_, origin, proxyAddr := newTestCachingProxy(t)
+	host := origin.addr().String()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test case: Range request on a cache miss fills the cache with the whole object
+	fmt.Fprintf(conn, "GET /bucket/key HTTP/1.1\r\nHost: %s\r\nRange: bytes=0-3\r\n\r\n", host)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		t.Errorf("Expected status 206, but got %d", res.StatusCode)
+	}
+	if body := readBody(t, res); body != "data" {
+		t.Errorf("Expected body 'data', but got %s", body)
+	}
+
+	// Test case: Range request on a cache hit
+	fmt.Fprintf(conn, "GET /bucket/key HTTP/1.1\r\nHost: %s\r\nRange: bytes=-3\r\n\r\n", host)
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if body := readBody(t, res); body != "key" {
+		t.Errorf("Expected body 'key', but got %s", body)
+	}
+
+	if n := origin.requests.Load(); n != 1 {
+		t.Errorf("Expected 1 origin request, but got %d", n)
+	}
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"automatic-cache-object-storage/cache"
+)
+
+var errObjectTooLarge = errors.New("object is too large to be cached")
+
+/*
+originResponseError is returned by a cache fill when the origin does not answer with the object.
+It carries the origin response, so the client can be answered with it instead of requesting the
+object from the origin a second time. The body of res is already consumed and kept in body.
+*/
+type originResponseError struct {
+	res  *http.Response
+	body []byte
+}
+
+func (e *originResponseError) Error() string {
+	body := e.body
+	if len(body) > maxErrorBodySize {
+		body = body[:maxErrorBodySize]
+	}
+	return fmt.Sprintf("received non-OK HTTP status: %s : %s", e.res.Status, string(body))
+}
+
+// response recreates the origin response for the client
+func (e *originResponseError) response(req *http.Request) *http.Response {
+	res := *e.res
+	res.Header = removeHopHeaders(e.res.Header)
+	res.TransferEncoding = nil
+	res.Trailer = nil
+	res.Request = req
+	res.Body = io.NopCloser(bytes.NewReader(e.body))
+	if req.Method != http.MethodHead {
+		res.ContentLength = int64(len(e.body))
+	}
+	return &res
+}
+
+/*
+streamedResponse records that a cache fill already answered the client while the object
+was read from the origin, so the proxy must not send another response.
+*/
+type streamedResponse struct {
+	sent      bool
+	keepAlive bool
+}
+
+/*
+clientWriter writes to the client connection and drops all data after the first failed write.
+Writes never fail, so a client that disconnects does not interrupt reading the origin response
+and the object can still be stored in the cache.
+*/
+type clientWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (cw *clientWriter) Write(p []byte) (int, error) {
+	if cw.err == nil {
+		_, cw.err = cw.w.Write(p)
+	}
+	return len(p), nil
+}
+
+/*
+cacheFillBuffer collects an object body for the cache while it is streamed to the client.
+Once the body exceeds the limit the collected data is released and further data is dropped.
+Writes never fail, so the stream to the client is not affected.
+*/
+type cacheFillBuffer struct {
+	buffer   bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func newCacheFillBuffer(limit int64, contentLength int64) *cacheFillBuffer {
+	b := &cacheFillBuffer{limit: limit}
+	if limit > 0 && contentLength > limit {
+		b.overflow = true
+	} else if contentLength > 0 {
+		b.buffer.Grow(int(contentLength))
+	}
+	return b
+}
+
+func (b *cacheFillBuffer) Write(p []byte) (int, error) {
+	if b.overflow {
+		return len(p), nil
+	}
+	if b.limit > 0 && int64(b.buffer.Len()+len(p)) > b.limit {
+		b.overflow = true
+		b.buffer = bytes.Buffer{}
+		return len(p), nil
+	}
+	return b.buffer.Write(p)
+}
+
+// admissionWindow is the part of a body kept while it is piped into a cache that may reject the object
+const admissionWindow = 64 << 10
+
+/*
+admissionBuffer pipes the body of a fill into the cache and keeps a copy of it as long as the cache
+read at most admissionWindow bytes. Caches decide on admission before or right after they start
+reading, so a rejected body is usually still complete. After a rejection with cache.ErrNotAdmitted
+the rest of the body is collected in body, up to its limit, and writes do not fail.
+*/
+type admissionBuffer struct {
+	w        io.Writer
+	body     *cacheFillBuffer
+	rejected bool
+}
+
+func newAdmissionBuffer(w io.Writer, limit int64, contentLength int64) *admissionBuffer {
+	// Only the window is reserved up front, most bodies are admitted and not kept
+	return &admissionBuffer{w: w, body: newCacheFillBuffer(limit, min(contentLength, admissionWindow))}
+}
+
+func (b *admissionBuffer) Write(p []byte) (int, error) {
+	if !b.rejected && !b.body.overflow && int64(b.body.buffer.Len()+len(p)) > admissionWindow {
+		// The cache read more than the window, it is not expected to reject the object anymore
+		b.body.overflow = true
+		b.body.buffer = bytes.Buffer{}
+	}
+	b.body.Write(p)
+	if b.rejected {
+		return len(p), nil
+	}
+	n, err := b.w.Write(p)
+	if errors.Is(err, cache.ErrNotAdmitted) && !b.body.overflow {
+		b.rejected = true
+		return len(p), nil
+	}
+	return n, err
+}
+
+// complete reports whether the body was kept as a whole
+func (b *admissionBuffer) complete() bool {
+	return !b.body.overflow
+}
+
+/*
+canStream reports whether the origin response to a cache fill can be sent to the client as is.
+Range and conditional requests are answered from the cached copy once it was stored.
+*/
+func canStream(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	for _, name := range fillRequestExcludeHeaders {
+		if req.Header.Get(name) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// nopSeekCloser is the body of an object that does not hold any resources
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
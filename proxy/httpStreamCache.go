@@ -0,0 +1,358 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"automatic-cache-object-storage/cache"
+	"automatic-cache-object-storage/objectStorage"
+)
+
+/*
+handleStreamCache answers a GET request with a cache.StreamCache. Object bodies are piped from the
+origin into the cache and from the cache to the client, so objects are never held in memory as a
+whole, unless the cache only stores complete objects. Freshness, revalidation, stale-if-error and
+negative entries are evaluated against the metadata of the cached object.
+*/
+func (p *HttpCachingProxy) handleStreamCache(conn net.Conn, targetAddr net.Addr, request *http.Request, adapter objectStorage.ObjectStorage, sc cache.StreamCache, objKey string, reqCC cacheControl, keepAlive bool, stats *ProxyStatsEntry) bool {
+
+	body, meta, err := sc.GetStream(request.Context(), objKey)
+	if err == nil {
+		defer body.Close()
+		decision, ok := evaluateCachedObject(reqCC, meta, time.Now())
+		if !ok {
+			return p.revalidateStream(conn, targetAddr, request, adapter, sc, meta, body, reqCC, keepAlive, stats)
+		}
+		stats.CacheDecision = decision
+		if meta.StatusCode != 0 && decision == DecisionHit {
+			stats.CacheDecision = DecisionNegativeHit
+		}
+		if decision == DecisionStale {
+			meta = withWarning(meta, warningStale)
+		}
+		return p.serveStream(conn, targetAddr, request, adapter, meta, body, keepAlive)
+	}
+	if !errors.Is(err, cache.ErrCacheMiss) {
+		return p.forwardStreamCacheFailure(conn, targetAddr, request, err, keepAlive, stats)
+	}
+
+	// Concurrent misses on the same key share a single fill, the other clients are served from the cache
+	stream := &streamedResponse{}
+	filled := false
+	_, err = p.fills.DoContext(request.Context(), objKey, func(ctx context.Context) (*cache.Object, error) {
+		filled = true
+		fillReq := request.WithContext(ctx)
+		res, _, err := p.Upstream.RoundTrip(newFillRequest(fillReq), targetAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve object from remote: %w", err)
+		}
+		return p.fillStream(conn, fillReq, res, sc, objKey, keepAlive, stream)
+	})
+	stats.CacheMiss = filled
+
+	decision := DecisionHit
+	if filled {
+		decision = DecisionMiss
+	}
+	return p.serveFilledStream(conn, targetAddr, request, adapter, sc, objKey, filled, decision, stream, err, keepAlive, stats)
+}
+
+/*
+revalidateStream checks a stale object of the stream cache against the origin. A 304 Not Modified
+response stores the updated metadata with the cached body, other responses are stored like a fill.
+*/
+func (p *HttpCachingProxy) revalidateStream(conn net.Conn, targetAddr net.Addr, request *http.Request, adapter objectStorage.ObjectStorage, sc cache.StreamCache, meta *cache.Object, body io.ReadSeeker, reqCC cacheControl, keepAlive bool, stats *ProxyStatsEntry) bool {
+
+	res, _, err := p.Upstream.RoundTrip(newRevalidationRequest(request, meta.OriginalHeaders), targetAddr)
+	if err == nil && res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		stats.CacheDecision = DecisionRevalidated
+		return p.serveStream(conn, targetAddr, request, adapter, p.refreshStream(request, sc, meta, res.Header, body), body, keepAlive)
+	}
+
+	failed := err != nil && isOriginFailure(err) || err == nil && res.StatusCode >= http.StatusInternalServerError
+	if failed && p.StaleIfError && staleIfErrorAllowed(reqCC, meta, time.Now()) {
+		if err == nil {
+			res.Body.Close()
+			err = fmt.Errorf("received non-OK HTTP status: %s", res.Status)
+		}
+		log.Printf("Failed to revalidate object, serving stale object: %v", err)
+		stats.CacheDecision = DecisionStaleIfError
+		return p.serveStream(conn, targetAddr, request, adapter, withWarning(meta, warningRevalidationFailed), body, keepAlive)
+	}
+	if err != nil {
+		return p.forwardStreamCacheFailure(conn, targetAddr, request, fmt.Errorf("failed to revalidate object: %w", err), keepAlive, stats)
+	}
+
+	reason := notStorableReason(parseRequestCacheControl(request.Header), parseCacheControl(res.Header))
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone || reason != "" {
+		// The object was deleted from the storage or must not be stored anymore
+		p.delete(meta.Key)
+		p.negatives.remove(meta.Key)
+	}
+
+	stream := &streamedResponse{}
+	_, err = p.fillStream(conn, request, res, sc, meta.Key, keepAlive, stream)
+	return p.serveFilledStream(conn, targetAddr, request, adapter, sc, meta.Key, true, DecisionRevalidated, stream, err, keepAlive, stats)
+}
+
+/*
+refreshStream stores the metadata of a cached object updated by a 304 response, together with the
+cached body. It returns the metadata that should be served to the client.
+*/
+func (p *HttpCachingProxy) refreshStream(request *http.Request, sc cache.StreamCache, meta *cache.Object, header http.Header, body io.ReadSeeker) *cache.Object {
+
+	refreshed := p.newCachedMetadata(meta.Key, mergeNotModified(meta.OriginalHeaders, header))
+	if reason := notStorableReason(parseRequestCacheControl(request.Header), parseCacheControl(refreshed.OriginalHeaders)); reason != "" {
+		p.delete(meta.Key)
+		p.negatives.remove(meta.Key)
+		return refreshed
+	}
+
+	size, err := body.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = body.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		err = sc.PutStream(request.Context(), refreshed, body, size)
+	}
+	if err != nil {
+		log.Printf("Failed to update revalidated object in cache: %v", err)
+	} else {
+		p.trackNegative(refreshed)
+	}
+	return refreshed
+}
+
+/*
+fillStream stores the origin response to a fill in the stream cache. The response is sent to the
+client at the same time if the request allows it, otherwise the client is answered from the cache
+afterwards. Objects are piped into the cache while they are read from the origin, only error
+responses, objects that must not be stored and objects the cache does not admit are collected in
+memory. It returns the metadata of the stored entry.
+*/
+func (p *HttpCachingProxy) fillStream(conn net.Conn, req *http.Request, res *http.Response, sc cache.StreamCache, objectKey string, keepAlive bool, stream *streamedResponse) (*cache.Object, error) {
+	defer res.Body.Close()
+
+	found := res.StatusCode == http.StatusOK
+	reason := notStorableReason(parseRequestCacheControl(req.Header), parseCacheControl(res.Header))
+	negative := !found && reason == "" && p.negativeCandidate(res.StatusCode)
+	tooLarge := p.MaxObjectSize > 0 && res.ContentLength > p.MaxObjectSize
+	storable := found && reason == "" && !tooLarge
+	streaming := canStream(req)
+
+	if !storable && !streaming {
+		if found && !tooLarge {
+			// The client is answered from the body, which is collected up to MaxObjectSize like a stored object
+			fill := newCacheFillBuffer(p.MaxObjectSize, res.ContentLength)
+			if _, err := io.Copy(fill, res.Body); err != nil {
+				return nil, fmt.Errorf("failed to retrieve object from remote: failed to read response body from target: %w", err)
+			}
+			if !fill.overflow {
+				return nil, &notStorableError{obj: p.newCachedObject(objectKey, res.Header, fill.buffer.Bytes()), reason: reason}
+			}
+		}
+		if found {
+			// Parts of objects that are not stored can not be served, the client is forwarded instead
+			if reason != "" {
+				return nil, &notStorableError{reason: reason}
+			}
+			return nil, errObjectTooLarge
+		}
+		body, err := io.ReadAll(io.LimitReader(res.Body, maxErrorBodySize+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve object from remote: failed to read response body from target: %w", err)
+		}
+		if len(body) > maxErrorBodySize {
+			return nil, errObjectTooLarge
+		}
+		if negative && p.isNegativeCacheable(res.StatusCode, body) {
+			return p.storeNegative(req.Context(), sc, p.newNegativeObject(objectKey, res, body))
+		}
+		return nil, &originResponseError{res: res, body: body}
+	}
+
+	var meta *cache.Object
+	var fill *cacheFillBuffer
+	var admission *admissionBuffer
+	var pw *io.PipeWriter
+	var put chan error
+	var cacheWriter io.Writer = io.Discard
+
+	if storable {
+		meta = p.newCachedMetadata(objectKey, res.Header)
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		put = make(chan error, 1)
+		go func() {
+			err := sc.PutStream(req.Context(), meta, newLimitedBody(pr, p.MaxObjectSize), res.ContentLength)
+			// Unblocks the writer if the cache stopped reading early
+			pr.CloseWithError(err)
+			put <- err
+		}()
+		if streaming {
+			// A failing cache does not interrupt the stream to the client
+			cacheWriter = &clientWriter{w: pw}
+		} else {
+			// The client is answered from the body if the cache does not admit the object
+			admission = newAdmissionBuffer(pw, p.MaxObjectSize, res.ContentLength)
+			cacheWriter = admission
+		}
+	} else if negative {
+		fill = newCacheFillBuffer(maxErrorBodySize, res.ContentLength)
+		cacheWriter = fill
+	}
+
+	var err error
+	if streaming {
+		client := &clientWriter{w: conn}
+
+		clientRes := *res
+		clientRes.Close = res.Close || !keepAlive
+		clientRes.Body = io.NopCloser(io.TeeReader(res.Body, cacheWriter))
+
+		stream.sent = true
+		err = clientRes.Write(client)
+
+		stream.keepAlive = client.err == nil && err == nil && !responseClosesConnection(&clientRes)
+		if client.err != nil {
+			log.Printf("Failed to stream response to client: %v", client.err)
+		}
+	} else {
+		_, err = io.Copy(cacheWriter, res.Body)
+	}
+
+	var putErr error
+	if put != nil {
+		// Closing without error ends the body for the cache
+		pw.CloseWithError(err)
+		putErr = <-put
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve object from remote: failed to read response body from target: %w", err)
+	}
+	if !found {
+		if negative && !fill.overflow && p.isNegativeCacheable(res.StatusCode, fill.buffer.Bytes()) {
+			return p.storeNegative(req.Context(), sc, p.newNegativeObject(objectKey, res, fill.buffer.Bytes()))
+		}
+		return nil, &originResponseError{res: res}
+	}
+	if reason != "" {
+		return nil, &notStorableError{reason: reason}
+	}
+	if tooLarge {
+		return nil, errObjectTooLarge
+	}
+	if errors.Is(putErr, cache.ErrNotAdmitted) && admission != nil && admission.complete() {
+		obj := *meta
+		body := admission.body.buffer.Bytes()
+		obj.Data = &body
+		return nil, &notStorableError{obj: &obj, reason: putErr.Error()}
+	}
+	if putErr != nil {
+		return nil, fmt.Errorf("failed to store object in cache: %w", putErr)
+	}
+
+	p.trackNegative(meta)
+	return meta, nil
+}
+
+// storeNegative stores a negative entry, which is small enough to be stored as a whole
+func (p *HttpCachingProxy) storeNegative(ctx context.Context, sc cache.StreamCache, obj *cache.Object) (*cache.Object, error) {
+	err := sc.PutContext(ctx, obj)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store object in cache: %w", err)
+	}
+	p.trackNegative(obj)
+	return obj, nil
+}
+
+/*
+serveFilledStream answers the client after a fill of the stream cache. Unless the fill already sent
+the origin response to the client, the stored object is served from the cache. decision is recorded
+if the object was stored.
+*/
+func (p *HttpCachingProxy) serveFilledStream(conn net.Conn, targetAddr net.Addr, request *http.Request, adapter objectStorage.ObjectStorage, sc cache.StreamCache, objKey string, filled bool, decision string, stream *streamedResponse, err error, keepAlive bool, stats *ProxyStatsEntry) bool {
+
+	if stream.sent {
+		return finishStreamed(request, stream, decision, err, stats)
+	}
+
+	var originErr *originResponseError
+	if filled && errors.As(err, &originErr) {
+		// The origin did not send the object, its response is passed to the client as is
+		stats.CacheDecision = DecisionOriginError
+		return writeLocalResponse(conn, originErr.response(request), keepAlive)
+	}
+
+	var notStorable *notStorableError
+	if filled && errors.As(err, &notStorable) && notStorable.obj != nil {
+		// Only the client that retrieved the object receives it, the other clients are forwarded
+		stats.CacheDecision = DecisionNotStored
+		return p.serveFromCache(conn, targetAddr, request, adapter, notStorable.obj, keepAlive)
+	}
+
+	if err == nil {
+		var body io.ReadSeekCloser
+		var meta *cache.Object
+		body, meta, err = sc.GetStream(request.Context(), objKey)
+		if err == nil {
+			defer body.Close()
+			stats.CacheDecision = decision
+			return p.serveStream(conn, targetAddr, request, adapter, meta, body, keepAlive)
+		}
+	}
+
+	return p.forwardStreamCacheFailure(conn, targetAddr, request, err, keepAlive, stats)
+}
+
+// forwardStreamCacheFailure forwards a request that could not be answered with the stream cache
+func (p *HttpCachingProxy) forwardStreamCacheFailure(conn net.Conn, targetAddr net.Addr, request *http.Request, err error, keepAlive bool, stats *ProxyStatsEntry) bool {
+	if request.Context().Err() != nil {
+		return answerCanceled(conn, request, keepAlive, stats)
+	}
+	log.Printf("Failed to retrieve object from cache, forwarding connection: %v", err)
+	stats.CacheDecision = DecisionForwarded
+	stats.Forwarded = true
+	return p.forward(conn, targetAddr, request, keepAlive)
+}
+
+// newCachedMetadata creates the metadata of an object stored in a cache.StreamCache
+func (p *HttpCachingProxy) newCachedMetadata(key string, header http.Header) *cache.Object {
+	meta := p.newCachedObject(key, header, nil)
+	meta.Data = nil
+	return meta
+}
+
+/*
+limitedBody reads the body of an object for the cache and fails with errObjectTooLarge once it
+exceeds the limit, so objects of unknown size larger than MaxObjectSize are not stored.
+*/
+type limitedBody struct {
+	r         io.Reader
+	remaining int64
+}
+
+// newLimitedBody limits the body to limit bytes, 0 means no limit
+func newLimitedBody(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &limitedBody{r: r, remaining: limit}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, errObjectTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"automatic-cache-object-storage/cache"
+)
+
+// streamMapCache is a mapCache that also implements cache.StreamCache
+type streamMapCache struct {
+	mapCache
+	streamed atomic.Int64 // Bodies stored with PutStream
+}
+
+func newStreamMapCache() *streamMapCache {
+	return &streamMapCache{mapCache: mapCache{store: make(map[string]*cache.Object)}}
+}
+
+func (c *streamMapCache) GetStream(ctx context.Context, key string) (io.ReadSeekCloser, *cache.Object, error) {
+	c.Lock()
+	obj, exists := c.store[key]
+	c.Unlock()
+	if !exists {
+		return nil, nil, cache.ErrCacheMiss
+	}
+	meta := *obj
+	meta.Data = nil
+	return nopSeekCloser{bytes.NewReader(*obj.Data)}, &meta, nil
+}
+
+func (c *streamMapCache) PutStream(ctx context.Context, meta *cache.Object, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && int64(len(data)) != size {
+		return cache.ErrSizeMismatch
+	}
+	obj := *meta
+	obj.Data = &data
+	c.streamed.Add(1)
+	return c.Put(&obj)
+}
+
+func TestHttpCachingProxy_StreamCache(t *testing.T) {
+	sc := newStreamMapCache()
+	decisions := make(chan string, 16)
+	_, origin, proxyAddr := newTestCachingProxy(t, func(p *HttpCachingProxy) {
+		p.Cache = sc
+		p.MaxObjectSize = 0
+		p.NegativeTTL = time.Minute
+		p.StatsHandler = func(stats ProxyStatsEntry) {
+			decisions <- stats.CacheDecision
+		}
+	})
+	host := origin.addr().String()
+
+	// Larger than the default object size limit
+	large := strings.Repeat("0123456789", DefaultMaxObjectSize/5)
+	origin.setObject("/bucket/large", large)
+	origin.setHeader("/bucket/revalidated", "Cache-Control", "max-age=0")
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	send := func(path string, headers string, expectedStatus int, expectedBody string, expectedDecision string) {
+		t.Helper()
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", path, host, headers)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		body := readBody(t, res)
+		if res.StatusCode != expectedStatus {
+			t.Errorf("%s %q: Expected status %d, but got %d", path, headers, expectedStatus, res.StatusCode)
+		}
+		if body != expectedBody {
+			t.Errorf("%s %q: Expected body of %d bytes, but got %d bytes", path, headers, len(expectedBody), len(body))
+		}
+		if decision := <-decisions; decision != expectedDecision {
+			t.Errorf("%s %q: Expected decision %s, but got %s", path, headers, expectedDecision, decision)
+		}
+	}
+
+	// Test case: Objects are streamed into the cache and served from it
+	send("/bucket/large", "", http.StatusOK, large, DecisionMiss)
+	send("/bucket/large", "", http.StatusOK, large, DecisionHit)
+	send("/bucket/large", "Range: bytes=10-19\r\n", http.StatusPartialContent, "0123456789", DecisionHit)
+
+	// Test case: Range requests on a miss are answered from the stored object
+	send("/bucket/part", "Range: bytes=0-3\r\n", http.StatusPartialContent, "data", DecisionMiss)
+
+	// Test case: Stale objects are revalidated
+	send("/bucket/revalidated", "", http.StatusOK, "data/bucket/revalidated", DecisionMiss)
+	send("/bucket/revalidated", "", http.StatusOK, "data/bucket/revalidated", DecisionRevalidated)
+
+	if n := sc.streamed.Load(); n != 4 {
+		t.Errorf("Expected 4 bodies stored with PutStream, but got %d", n)
+	}
+	if n := origin.requests.Load(); n != 4 {
+		t.Errorf("Expected 4 origin requests, but got %d", n)
+	}
+
+	// Test case: Missing objects are stored as negative entries
+	send("/bucket/missing", "", http.StatusNotFound, noSuchKeyBody, DecisionMiss)
+	send("/bucket/missing", "", http.StatusNotFound, noSuchKeyBody, DecisionNegativeHit)
+}
+
+func TestHttpCachingProxy_StreamAdmission(t *testing.T) {
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	admission := cache.NewAdmissionCache(logger, cache.NewDummyPrinterCache(logger, 1<<20), cache.NewFrequencyFilter(1024))
+	decisions := make(chan string, 16)
+	_, origin, proxyAddr := newTestCachingProxy(t, func(p *HttpCachingProxy) {
+		p.Cache = cache.NewTieredCache(logger, cache.Tier{Name: "memory", Cache: admission})
+		p.StatsHandler = func(stats ProxyStatsEntry) {
+			decisions <- stats.CacheDecision
+		}
+	})
+	host := origin.addr().String()
+
+	// Larger than the part of the body the tiered cache reads before the tier rejects it
+	object := strings.Repeat("0123456789", 5000)
+	origin.setObject("/bucket/range", object)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	send := func(expectedDecision string, expectedRequests int64) {
+		t.Helper()
+		fmt.Fprintf(conn, "GET /bucket/range HTTP/1.1\r\nHost: %s\r\nRange: bytes=10-19\r\n\r\n", host)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if body := readBody(t, res); res.StatusCode != http.StatusPartialContent || body != "0123456789" {
+			t.Errorf("Expected status 206 with body %q, but got %d with body %q", "0123456789", res.StatusCode, body)
+		}
+		if decision := <-decisions; decision != expectedDecision {
+			t.Errorf("Expected decision %s, but got %s", expectedDecision, decision)
+		}
+		if n := origin.requests.Load(); n != expectedRequests {
+			t.Errorf("Expected %d origin requests, but got %d", expectedRequests, n)
+		}
+	}
+
+	// Test case: A Range request for an object that is not admitted is answered from the fill
+	send(DecisionNotStored, 1)
+
+	// Test case: The object is stored once it was requested often enough
+	send(DecisionMiss, 2)
+	send(DecisionHit, 2)
+}
+
+func TestHttpCachingProxy_ChunkedCache(t *testing.T) {
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	backend := newMapCache()
+	decisions := make(chan string, 16)
+	_, origin, proxyAddr := newTestCachingProxy(t, func(p *HttpCachingProxy) {
+		p.Cache = cache.NewTieredCache(logger, cache.Tier{Name: "memory", Cache: cache.NewChunkedCache(logger, backend, cache.DefaultChunkSize)})
+		// The size limit of the tiers instead of the default, as main.go configures it
+		p.MaxObjectSize = 64 << 20
+		p.StatsHandler = func(stats ProxyStatsEntry) {
+			decisions <- stats.CacheDecision
+		}
+	})
+	host := origin.addr().String()
+
+	// Larger than the default object size limit
+	large := strings.Repeat("0123456789", DefaultMaxObjectSize/5)
+	origin.setObject("/bucket/large", large)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	send := func(expectedDecision string) {
+		t.Helper()
+		fmt.Fprintf(conn, "GET /bucket/large HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if body := readBody(t, res); body != large {
+			t.Errorf("Expected body of %d bytes, but got %d bytes", len(large), len(body))
+		}
+		if decision := <-decisions; decision != expectedDecision {
+			t.Errorf("Expected decision %s, but got %s", expectedDecision, decision)
+		}
+	}
+
+	// Test case: Objects larger than the default limit are stored in chunks and served from the cache
+	send(DecisionMiss)
+	send(DecisionHit)
+	if n := origin.requests.Load(); n != 1 {
+		t.Errorf("Expected 1 origin request, but got %d", n)
+	}
+	// A manifest and the chunks of the object
+	if n, expected := len(backend.store), len(large)/cache.DefaultChunkSize+2; n != expected {
+		t.Errorf("Expected %d entries in the backend, but got %d", expected, n)
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sync"
+
+	"automatic-cache-object-storage/cache"
+)
+
+// Error code of the S3 API for objects that do not exist
+const noSuchKeyCode = "<Code>NoSuchKey</Code>"
+
+/*
+negativeIndex keeps track of the negative entries stored in the cache, so their total size stays
+within NegativeMaxBytes. The cache backends do not distinguish negative entries from objects, so
+the oldest entries are removed from the cache once the budget is exceeded. The zero value is an
+empty index.
+*/
+type negativeIndex struct {
+	entries map[string]*list.Element
+	order   list.List // Oldest entry first
+	size    int64
+	lock    sync.Mutex
+}
+
+type negativeEntry struct {
+	key  string
+	size int64
+}
+
+// add records a stored negative entry and returns the keys of the entries that exceed the budget
+func (ni *negativeIndex) add(key string, size int64, maxBytes int64) []string {
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+
+	if ni.entries == nil {
+		ni.entries = make(map[string]*list.Element)
+	}
+	ni.removeLocked(key)
+	ni.entries[key] = ni.order.PushBack(&negativeEntry{key: key, size: size})
+	ni.size += size
+
+	var evicted []string
+	for maxBytes > 0 && ni.size > maxBytes {
+		e := ni.order.Front().Value.(*negativeEntry)
+		ni.removeLocked(e.key)
+		evicted = append(evicted, e.key)
+	}
+	return evicted
+}
+
+// remove forgets a negative entry that was deleted or replaced by an object
+func (ni *negativeIndex) remove(key string) {
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+	ni.removeLocked(key)
+}
+
+func (ni *negativeIndex) removeLocked(key string) {
+	if e, exists := ni.entries[key]; exists {
+		ni.size -= e.Value.(*negativeEntry).size
+		ni.order.Remove(e)
+		delete(ni.entries, key)
+	}
+}
+
+// totalSize returns the total size of the negative entries
+func (ni *negativeIndex) totalSize() int64 {
+	ni.lock.Lock()
+	defer ni.lock.Unlock()
+	return ni.size
+}
+
+// negativeCandidate reports whether a response with this status may become a negative entry
+func (p *HttpCachingProxy) negativeCandidate(status int) bool {
+	if p.NegativeTTL <= 0 {
+		return false
+	}
+	return status == http.StatusNotFound || status == http.StatusForbidden && p.NegativeCache403
+}
+
+/*
+isNegativeCacheable reports whether an error response of the origin is stored as negative entry.
+404 responses are only stored for missing objects, not for missing buckets.
+*/
+func (p *HttpCachingProxy) isNegativeCacheable(status int, body []byte) bool {
+	if !p.negativeCandidate(status) {
+		return false
+	}
+	return status != http.StatusNotFound || bytes.Contains(body, []byte(noSuchKeyCode))
+}
+
+// newNegativeObject creates a negative entry that is fresh for NegativeTTL
+func (p *HttpCachingProxy) newNegativeObject(key string, res *http.Response, body []byte) *cache.Object {
+	obj := p.newCachedObject(key, res.Header, body)
+	obj.StatusCode = res.StatusCode
+	obj.MaxAge = p.NegativeTTL
+	return obj
+}
+
+/*
+trackNegative updates the negative index after an entry was stored in the cache. Negative entries
+that exceed the budget are removed from the cache, objects replace negative entries of their key.
+*/
+func (p *HttpCachingProxy) trackNegative(obj *cache.Object) {
+	if obj.StatusCode == 0 {
+		p.negatives.remove(obj.Key)
+		return
+	}
+	size := int64(len(obj.Key) + len(*obj.Data))
+	for _, key := range p.negatives.add(obj.Key, size, p.NegativeMaxBytes) {
+		p.delete(key)
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNegativeIndex(t *testing.T) {
+	var ni negativeIndex
+
+	if evicted := ni.add("a", 10, 25); len(evicted) != 0 {
+		t.Errorf("Expected no eviction, but got %v", evicted)
+	}
+	ni.add("b", 10, 25)
+
+	// Test case: Re-adding a key does not count it twice
+	ni.add("a", 10, 25)
+	if size := ni.totalSize(); size != 20 {
+		t.Errorf("Expected size 20, but got %d", size)
+	}
+
+	// Test case: The oldest entries are evicted first
+	evicted := ni.add("c", 10, 25)
+	if fmt.Sprint(evicted) != "[b]" {
+		t.Errorf("Expected eviction of [b], but got %v", evicted)
+	}
+
+	ni.remove("a")
+	if size := ni.totalSize(); size != 10 {
+		t.Errorf("Expected size 10, but got %d", size)
+	}
+}
+
+func TestHttpCachingProxy_NegativeCache(t *testing.T) {
+	_, origin, proxyAddr := newTestCachingProxy(t, func(p *HttpCachingProxy) {
+		p.NegativeTTL = time.Minute
+		// Room for a single negative entry
+		p.NegativeMaxBytes = int64(len(noSuchKeyBody) + 50)
+	})
+	host := origin.addr().String()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	send := func(request string, expectedStatus int) string {
+		t.Helper()
+		fmt.Fprint(conn, request)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if res.StatusCode != expectedStatus {
+			t.Errorf("Expected status %d, but got %d", expectedStatus, res.StatusCode)
+		}
+		return readBody(t, res)
+	}
+	get := func(path string) string {
+		return "GET " + path + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+	}
+
+	// Test case: The 404 response is served from the cache with the original body
+	send(get("/bucket/missing"), http.StatusNotFound)
+	if body := send(get("/bucket/missing"), http.StatusNotFound); body != noSuchKeyBody {
+		t.Errorf("Expected body %s, but got %s", noSuchKeyBody, body)
+	}
+	send("GET /bucket/missing HTTP/1.1\r\nHost: "+host+"\r\nRange: bytes=0-3\r\n\r\n", http.StatusNotFound)
+	if n := origin.requests.Load(); n != 1 {
+		t.Errorf("Expected 1 origin request, but got %d", n)
+	}
+
+	// Test case: PutObject removes the negative entry
+	send("PUT /bucket/missing HTTP/1.1\r\nHost: "+host+"\r\nContent-Length: 7\r\n\r\ncreated", http.StatusOK)
+	if body := send(get("/bucket/missing"), http.StatusOK); body != "created" {
+		t.Errorf("Expected body 'created', but got %s", body)
+	}
+
+	// Test case: Negative entries beyond the budget are removed, the oldest first
+	send(get("/bucket/missing1"), http.StatusNotFound)
+	send(get("/bucket/missing2"), http.StatusNotFound)
+	requests := origin.requests.Load()
+	send(get("/bucket/missing2"), http.StatusNotFound)
+	send(get("/bucket/missing1"), http.StatusNotFound)
+	if n := origin.requests.Load() - requests; n != 1 {
+		t.Errorf("Expected 1 origin request, but got %d", n)
+	}
+}
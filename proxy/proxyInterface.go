@@ -16,6 +16,7 @@ type NetworkTimer struct {
 	WriteRequest  int64 //Time to write the request to outgoing connection
 	ReadResponse  int64 //Time to read the response from outgoing connection
 	WriteResponse int64 //Time to write the response back to the incoming connection
+	ConnReused    bool  //Whether the connection to the target server was taken from the upstream pool
 }
 
 type ProxyStatsEntry struct {
@@ -26,9 +27,10 @@ type ProxyStatsEntry struct {
 	CacheRetrieve int64 //Time to retrieve an object from cache (excluding initializing)
 	Initialize    int64 //Time to initialize an object in cache (after a cache miss)
 
-	CacheMiss bool
-	Forwarded bool
-	Failed    bool
+	CacheMiss     bool
+	Forwarded     bool
+	Failed        bool
+	CacheDecision string //How the cache answered the request, one of the Decision constants
 
 	ObjectKey string
 	WorkerID  int
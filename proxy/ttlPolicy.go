@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+TTLPolicy decides the time to live of a cached object from its key and the headers of the origin
+response. ok is false if the policy has no TTL for the object. Adapters that know the TTL of their
+objects can implement it and be combined with other policies by ChainTTL.
+*/
+type TTLPolicy interface {
+	TTL(key string, header http.Header) (ttl time.Duration, ok bool)
+}
+
+/*
+TTLRules sets the TTL of objects from a header of the origin, by prefix and by bucket, in this
+order. Keys have the form host/bucket/object, prefixes are matched against bucket/object.
+*/
+type TTLRules struct {
+	Header   string                   // Origin header with the TTL in seconds, like the user metadata X-Amz-Meta-Cache-Ttl, empty to ignore headers
+	Prefixes map[string]time.Duration // TTL of the objects starting with the prefix, the longest matching prefix applies
+	Buckets  map[string]time.Duration // TTL of the objects of a bucket
+	Default  time.Duration            // TTL of all other objects, 0 means they do not expire
+}
+
+func (r *TTLRules) TTL(key string, header http.Header) (time.Duration, bool) {
+	if r.Header != "" {
+		if seconds, err := strconv.ParseInt(header.Get(r.Header), 10, 64); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	_, path, _ := strings.Cut(key, "/")
+	longest := -1
+	var ttl time.Duration
+	for prefix, prefixTTL := range r.Prefixes {
+		if len(prefix) > longest && strings.HasPrefix(path, prefix) {
+			longest, ttl = len(prefix), prefixTTL
+		}
+	}
+	if longest >= 0 {
+		return ttl, true
+	}
+
+	bucket, _, _ := strings.Cut(path, "/")
+	if bucketTTL, exists := r.Buckets[bucket]; exists {
+		return bucketTTL, true
+	}
+	return r.Default, r.Default > 0
+}
+
+// ChainTTL combines policies into a policy that applies the first policy that has a TTL for an object
+func ChainTTL(policies ...TTLPolicy) TTLPolicy {
+	return ttlChain(policies)
+}
+
+type ttlChain []TTLPolicy
+
+func (c ttlChain) TTL(key string, header http.Header) (time.Duration, bool) {
+	for _, policy := range c {
+		if ttl, ok := policy.TTL(key, header); ok {
+			return ttl, true
+		}
+	}
+	return 0, false
+}
+
+// expiresAt returns the time a cached object expires according to the TTL policy, zero if it does not expire
+func (p *HttpCachingProxy) expiresAt(key string, header http.Header, storedAt time.Time) time.Time {
+	if p.TTL == nil {
+		return time.Time{}
+	}
+	ttl, ok := p.TTL.TTL(key, header)
+	if !ok || ttl <= 0 {
+		return time.Time{}
+	}
+	return storedAt.Add(ttl)
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTTLRules(t *testing.T) {
+	rules := &TTLRules{
+		Header:   "X-Amz-Meta-Cache-Ttl",
+		Prefixes: map[string]time.Duration{"logs/": time.Hour, "logs/debug/": time.Minute},
+		Buckets:  map[string]time.Duration{"logs": 24 * time.Hour, "static": 7 * 24 * time.Hour},
+		Default:  10 * time.Minute,
+	}
+
+	tests := []struct {
+		key    string
+		header string // TTL header of the origin
+		ttl    time.Duration
+	}{
+		{"localhost/static/index.html?", "", 7 * 24 * time.Hour},
+		{"localhost/static/index.html?", "30", 30 * time.Second},
+		{"localhost/static/index.html?", "invalid", 7 * 24 * time.Hour},
+		{"localhost/logs/debug/1.log?", "", time.Minute},
+		{"localhost/logs/info/1.log?", "", time.Hour},
+		{"localhost/data/1.csv?", "", 10 * time.Minute},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if test.header != "" {
+			header.Set("X-Amz-Meta-Cache-Ttl", test.header)
+		}
+		if ttl, ok := rules.TTL(test.key, header); !ok || ttl != test.ttl {
+			t.Errorf("%s, header %q: Expected TTL %v, but got %v", test.key, test.header, test.ttl, ttl)
+		}
+	}
+
+	// Test case: Policies without a TTL for an object leave it to the next policy
+	chain := ChainTTL(&TTLRules{Buckets: map[string]time.Duration{"logs": time.Hour}}, &TTLRules{Default: time.Minute})
+	if ttl, _ := chain.TTL("localhost/logs/1.log?", nil); ttl != time.Hour {
+		t.Errorf("Expected TTL %v, but got %v", time.Hour, ttl)
+	}
+	if ttl, _ := chain.TTL("localhost/data/1.csv?", nil); ttl != time.Minute {
+		t.Errorf("Expected TTL %v, but got %v", time.Minute, ttl)
+	}
+	if _, ok := (&TTLRules{}).TTL("localhost/data/1.csv?", nil); ok {
+		t.Errorf("Expected no TTL without rules")
+	}
+}
+
+func TestHttpCachingProxy_TTL(t *testing.T) {
+	p, origin, proxyAddr := newTestCachingProxy(t, func(p *HttpCachingProxy) {
+		p.TTL = &TTLRules{Header: "X-Amz-Meta-Cache-Ttl", Buckets: map[string]time.Duration{"bucket": time.Hour}}
+	})
+	host := origin.addr().String()
+	origin.setHeader("/bucket/short", "X-Amz-Meta-Cache-Ttl", "60")
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test case: Cached objects expire after the TTL of their bucket or of the origin header
+	for path, ttl := range map[string]time.Duration{"/bucket/short": time.Minute, "/bucket/long": time.Hour} {
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", path, host)
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("Failed to read response for %s: %v", path, err)
+		}
+		readBody(t, res)
+
+		obj, err := p.Cache.Get(path+"?", nil)
+		if err != nil {
+			t.Fatalf("%s: Expected the object in the cache, but got %v", path, err)
+		}
+		if expiresIn := obj.ExpiresAt.Sub(obj.StoredAt); expiresIn != ttl {
+			t.Errorf("%s: Expected the object to expire after %v, but got %v", path, ttl, expiresIn)
+		}
+	}
+}
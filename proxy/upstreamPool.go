@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultMaxIdleConns    = 64               // Idle connections kept per origin by default
+	DefaultIdleConnTimeout = 90 * time.Second // Time an idle connection is kept by default
+	DefaultDialTimeout     = 5 * time.Second  // Time to wait for a new connection to an origin
+)
+
+// upstreamConn is a keep-alive connection to an origin
+type upstreamConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	addr      string
+	idleSince time.Time
+}
+
+// UpstreamPoolStats counts how often a connection was taken from the pool (hit) or dialed (miss)
+type UpstreamPoolStats struct {
+	Hits   uint64
+	Misses uint64
+	Idle   int
+}
+
+/*
+UpstreamPool keeps idle keep-alive connections per origin address, so forwarded requests and
+cache fills do not pay for a new TCP connection each time. Idle connections are checked for
+closure by the origin before they are reused.
+*/
+type UpstreamPool struct {
+	MaxIdle     int           // Maximum number of idle connections kept per origin
+	IdleTimeout time.Duration // Idle connections older than this are closed instead of reused, 0 means no limit
+	DialTimeout time.Duration // Maximum time to wait for a new connection
+	// Maximum time to wait for the response headers after sending a request, 0 means no limit
+	ResponseTimeout time.Duration
+
+	idle   map[string][]*upstreamConn
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	lock   sync.Mutex
+}
+
+func NewUpstreamPool(maxIdle int, idleTimeout time.Duration) *UpstreamPool {
+	return &UpstreamPool{
+		MaxIdle:     maxIdle,
+		IdleTimeout: idleTimeout,
+		DialTimeout: DefaultDialTimeout,
+		idle:        make(map[string][]*upstreamConn),
+	}
+}
+
+/*
+get returns a healthy idle connection to the address, or dials a new one.
+It also reports whether the connection was reused.
+*/
+func (up *UpstreamPool) get(ctx context.Context, addr net.Addr) (*upstreamConn, bool, error) {
+
+	key := addr.String()
+
+	for {
+		up.lock.Lock()
+		conns := up.idle[key]
+		if len(conns) == 0 {
+			up.lock.Unlock()
+			break
+		}
+		// Most recently used connections are the least likely to be closed by the origin
+		c := conns[len(conns)-1]
+		up.idle[key] = conns[:len(conns)-1]
+		up.lock.Unlock()
+
+		if up.IdleTimeout > 0 && time.Since(c.idleSince) > up.IdleTimeout || !c.healthy() {
+			c.Close()
+			continue
+		}
+		up.hits.Add(1)
+		return c, true, nil
+	}
+
+	up.misses.Add(1)
+
+	dialer := net.Dialer{Timeout: up.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", key)
+	if err != nil {
+		return nil, false, err
+	}
+	return &upstreamConn{Conn: conn, reader: bufio.NewReader(conn), addr: key}, false, nil
+}
+
+// put returns a connection whose last response was read completely to the pool
+func (up *UpstreamPool) put(c *upstreamConn) {
+	up.lock.Lock()
+	defer up.lock.Unlock()
+
+	if len(up.idle[c.addr]) >= up.MaxIdle {
+		c.Close()
+		return
+	}
+	c.idleSince = time.Now()
+	up.idle[c.addr] = append(up.idle[c.addr], c)
+}
+
+/*
+RoundTrip sends the request to the address over a pooled connection and reads the response
+headers. The connection goes back to the pool when the response body was read to the end and
+closed. A request without a body that fails on a reused connection is retried once on a new
+connection, as the origin may have closed the idle connection in the meantime. Requests that
+time out are not retried.
+The request is aborted when its context is done, also while the response body is read, and the
+context error is returned. The connection is closed instead of being reused in this case.
+It also reports whether the response was received on a reused connection.
+*/
+func (up *UpstreamPool) RoundTrip(req *http.Request, addr net.Addr) (*http.Response, bool, error) {
+
+	upstreamReq := newUpstreamRequest(req)
+	retryable := req.Body == nil || req.Body == http.NoBody
+
+	ctx := req.Context()
+
+	for {
+		c, reused, err := up.get(ctx, addr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, false, ctx.Err()
+			}
+			return nil, false, fmt.Errorf("failed to connect to target: %v", err)
+		}
+
+		// A deadline in the past interrupts reads and writes on the connection
+		stop := context.AfterFunc(ctx, func() {
+			c.SetDeadline(time.Unix(1, 0))
+		})
+
+		err = c.writeRequest(upstreamReq)
+		if err == nil && up.ResponseTimeout > 0 {
+			// The timeout starts once the request was sent, so slow request bodies are not cut off
+			c.SetReadDeadline(time.Now().Add(up.ResponseTimeout))
+			if ctx.Err() != nil {
+				// The deadline set on cancellation may have been overridden
+				c.SetDeadline(time.Unix(1, 0))
+			}
+		}
+		var res *http.Response
+		if err == nil {
+			res, err = c.readResponse(upstreamReq)
+		}
+		if err == nil && up.ResponseTimeout > 0 {
+			c.SetReadDeadline(time.Time{})
+		}
+		// Checked after the deadline was reset, which may have overridden the one set on cancellation
+		if err == nil && ctx.Err() != nil {
+			res.Body.Close()
+			err = ctx.Err()
+		}
+		if err != nil {
+			stop()
+			c.Close()
+			if ctx.Err() != nil {
+				return nil, reused, ctx.Err()
+			}
+			if reused && retryable && !isTimeout(err) {
+				retryable = false
+				continue
+			}
+			return nil, reused, err
+		}
+
+		return up.track(c, res, stop), reused, nil
+	}
+}
+
+/*
+newUpstreamRequest prepares a client request to be sent on a pooled connection. Connection
+management headers of the client are not meant for the origin and would prevent reuse.
+*/
+func newUpstreamRequest(req *http.Request) *http.Request {
+	upstreamReq := *req
+	upstreamReq.Header = removeHopHeaders(req.Header)
+	upstreamReq.Close = false
+	return &upstreamReq
+}
+
+/*
+track returns the connection to the pool once the response body was read to the end and closed.
+stop ends the cancellation of the request and reports false if the request was already canceled,
+it may be nil for requests that are not canceled.
+*/
+func (up *UpstreamPool) track(c *upstreamConn, res *http.Response, stop func() bool) *http.Response {
+	res.Body = &pooledBody{
+		ReadCloser: res.Body,
+		pool:       up,
+		conn:       c,
+		stop:       stop,
+		reusable:   !res.Close,
+		eof:        res.Body == http.NoBody,
+	}
+	return res
+}
+
+// Stats returns the hit and miss counts of the pool and the number of idle connections
+func (up *UpstreamPool) Stats() UpstreamPoolStats {
+	up.lock.Lock()
+	idle := 0
+	for _, conns := range up.idle {
+		idle += len(conns)
+	}
+	up.lock.Unlock()
+
+	return UpstreamPoolStats{
+		Hits:   up.hits.Load(),
+		Misses: up.misses.Load(),
+		Idle:   idle,
+	}
+}
+
+func (c *upstreamConn) writeRequest(req *http.Request) error {
+	err := req.Write(c)
+	if err != nil {
+		return fmt.Errorf("failed to send request to target: %w", err)
+	}
+	return nil
+}
+
+func (c *upstreamConn) readResponse(req *http.Request) (*http.Response, error) {
+	res, err := http.ReadResponse(c.reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response from target: %w", err)
+	}
+	return res, nil
+}
+
+/*
+healthy checks an idle connection before it is reused. The origin must not have closed the
+connection or sent any data since the last response, which is checked with a non-blocking peek.
+*/
+func (c *upstreamConn) healthy() bool {
+	if c.reader.Buffered() > 0 {
+		return false
+	}
+
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	healthy := false
+	buf := make([]byte, 1)
+	err = rawConn.Read(func(fd uintptr) bool {
+		_, _, err := syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+		// Nothing to read means the connection is still open and idle
+		healthy = errors.Is(err, syscall.EAGAIN)
+		return true
+	})
+	return err == nil && healthy
+}
+
+/*
+pooledBody returns the connection of a response to the pool once the body was read to the end.
+Bodies closed before the end are not drained, their connection is closed instead.
+*/
+type pooledBody struct {
+	io.ReadCloser
+	pool     *UpstreamPool
+	conn     *upstreamConn
+	stop     func() bool
+	reusable bool
+	eof      bool
+	closed   bool
+}
+
+func (b *pooledBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *pooledBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	// The deadline of a canceled request is still set on the connection
+	if b.stop != nil && !b.stop() {
+		b.reusable = false
+	}
+
+	if !b.eof || !b.reusable {
+		b.conn.Close()
+		return b.ReadCloser.Close()
+	}
+
+	err := b.ReadCloser.Close()
+	if err != nil {
+		b.conn.Close()
+		return err
+	}
+	b.pool.put(b.conn)
+	return nil
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamPool_RoundTrip(t *testing.T) {
+	var newConns atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "data"+r.URL.Path)
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			newConns.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	addr := server.Listener.Addr()
+
+	pool := NewUpstreamPool(DefaultMaxIdleConns, DefaultIdleConnTimeout)
+
+	get := func(path string, close bool) string {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr.String()+path, nil)
+		req.Close = close
+		res, _, err := pool.RoundTrip(req, addr)
+		if err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		return readBody(t, res)
+	}
+
+	// Test case: Connection is reused for consecutive requests
+	for i := 0; i < 3; i++ {
+		if body := get("/bucket/key", false); body != "data/bucket/key" {
+			t.Errorf("Expected body 'data/bucket/key', but got %s", body)
+		}
+	}
+	if n := newConns.Load(); n != 1 {
+		t.Errorf("Expected 1 connection, but got %d", n)
+	}
+	stats := pool.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Idle != 1 {
+		t.Errorf("Expected 2 hits, 1 miss and 1 idle connection, but got %+v", stats)
+	}
+
+	// Test case: Client connection management headers do not reach the origin
+	get("/bucket/key", true)
+	if n := newConns.Load(); n != 1 {
+		t.Errorf("Expected 1 connection, but got %d", n)
+	}
+
+	// Test case: Connection closed by the origin is not reused
+	server.CloseClientConnections()
+	time.Sleep(50 * time.Millisecond)
+	if body := get("/bucket/key", false); body != "data/bucket/key" {
+		t.Errorf("Expected body 'data/bucket/key', but got %s", body)
+	}
+	if n := newConns.Load(); n != 2 {
+		t.Errorf("Expected 2 connections, but got %d", n)
+	}
+
+	// Test case: Response body closed before the end does not return the connection
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr.String()+"/bucket/key", nil)
+	res, _, err := pool.RoundTrip(req, addr)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	res.Body.Close()
+	if idle := pool.Stats().Idle; idle != 0 {
+		t.Errorf("Expected no idle connection, but got %d", idle)
+	}
+}
+
+func TestUpstreamPool_IdleLimits(t *testing.T) {
+	origin := newTestOrigin(t)
+	addr := origin.addr()
+
+	// Test case: No idle connections are kept
+	pool := NewUpstreamPool(0, DefaultIdleConnTimeout)
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr.String()+"/bucket/key", nil)
+	res, _, err := pool.RoundTrip(req, addr)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	readBody(t, res)
+	if idle := pool.Stats().Idle; idle != 0 {
+		t.Errorf("Expected no idle connection, but got %d", idle)
+	}
+
+	// Test case: Idle connections expire
+	pool = NewUpstreamPool(DefaultMaxIdleConns, time.Millisecond)
+	for i := 0; i < 2; i++ {
+		res, reused, err := pool.RoundTrip(req, addr)
+		if err != nil {
+			t.Fatalf("Expected no error, but got %v", err)
+		}
+		if reused {
+			t.Errorf("Expected expired connection not to be reused")
+		}
+		readBody(t, res)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpstreamPool_ResponseTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	addr := server.Listener.Addr()
+
+	pool := NewUpstreamPool(DefaultMaxIdleConns, DefaultIdleConnTimeout)
+	pool.ResponseTimeout = 50 * time.Millisecond
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr.String()+"/bucket/key", nil)
+	start := time.Now()
+	_, _, err := pool.RoundTrip(req, addr)
+	if !isTimeout(err) {
+		t.Errorf("Expected timeout error, but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to time out after 50ms, but it took %v", elapsed)
+	}
+
+	// Test case: The timeout does not cover a slow request body
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprint(w, string(body))
+	}))
+	defer server.Close()
+	addr = server.Listener.Addr()
+
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 4; i++ {
+			time.Sleep(40 * time.Millisecond)
+			fmt.Fprint(pw, "data")
+		}
+		pw.Close()
+	}()
+	req, _ = http.NewRequest(http.MethodPut, "http://"+addr.String()+"/bucket/key", pr)
+	res, _, err := pool.RoundTrip(req, addr)
+	if err != nil {
+		t.Fatalf("Expected no error, but got %v", err)
+	}
+	if body := readBody(t, res); body != "datadatadatadata" {
+		t.Errorf("Expected body 'datadatadatadata', but got %s", body)
+	}
+}